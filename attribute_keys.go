@@ -0,0 +1,216 @@
+package sqlitestore
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+)
+
+// AttributeKeysFilter restricts the entities that ListAttributeKeys looks at.
+type AttributeKeysFilter struct {
+	// Only count the entities that match the query
+	Query string `json:"query,omitempty"`
+	// Only count the entities owned by this address
+	Owner *common.Address `json:"owner,omitempty"`
+	// Also list the synthetic attributes, like $owner and $creator
+	IncludeSynthetic bool `json:"includeSynthetic,omitempty"`
+}
+
+// AttributeKey is an attribute that at least one entity carries.
+type AttributeKey struct {
+	Name string `json:"name"`
+	// Either "string" or "numeric"
+	Type string `json:"type"`
+	// The number of live entities that carry the attribute
+	Entities uint64 `json:"entities"`
+}
+
+// ListAttributeKeys returns the attribute keys of the entities that are alive
+// at atBlock, or the latest block if atBlock is nil, sorted by name and type.
+func (s *SQLiteStore) ListAttributeKeys(
+	ctx context.Context,
+	atBlock *uint64,
+	filter *AttributeKeysFilter,
+) ([]AttributeKey, error) {
+	if filter == nil {
+		filter = &AttributeKeysFilter{}
+	}
+
+	latestHead, err := s.GetLatestHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	block := latestHead
+	if atBlock != nil {
+		block = *atBlock
+	}
+
+	err = s.EnsureBlockPresent(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []AttributeKey
+	if filter.Query == "" && filter.Owner == nil && block == latestHead {
+		// The statistics already hold the counts for the latest block
+		keys, err = s.listAttributeKeysFromStatistics(ctx)
+	} else {
+		keys, err = s.listAttributeKeysOfMatches(ctx, block, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.IncludeSynthetic {
+		return keys, nil
+	}
+
+	userKeys := make([]AttributeKey, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(key.Name, "$") {
+			userKeys = append(userKeys, key)
+		}
+	}
+	return userKeys, nil
+}
+
+func (s *SQLiteStore) listAttributeKeysFromStatistics(ctx context.Context) ([]AttributeKey, error) {
+	statistics, err := s.GetStatistics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]AttributeKey, 0, len(statistics.Attributes)+4)
+	for _, attribute := range statistics.Attributes {
+		keys = append(keys, AttributeKey{
+			Name:     attribute.Name,
+			Type:     attribute.Type,
+			Entities: attribute.Entities,
+		})
+	}
+
+	return withMetadataKeys(keys, statistics.Entities), nil
+}
+
+func (s *SQLiteStore) listAttributeKeysOfMatches(ctx context.Context, block uint64, filter *AttributeKeysFilter) (_ []AttributeKey, err error) {
+	ast, err := s.parseFilter(filter.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Owner != nil {
+		owner := strings.ToLower(filter.Owner.Hex())
+		ast = ast.And(query.ASTTerm{
+			Assign: &query.Equality{
+				Var:   query.OwnerAttributeKey,
+				Value: query.Value{String: &owner},
+			},
+		})
+	}
+
+	matches, err := query.ExistsEvaluator{}.EvaluateMatches(ast, block)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery := strings.Join(
+		[]string{
+			"WITH matches AS (" + matches.Query + ")",
+			"SELECT n.name, 'string', COUNT(*) FROM matches AS e",
+			"INNER JOIN string_attributes AS a ON a.entity_id = e.entity_id AND a.from_block = e.from_block",
+			"INNER JOIN attribute_names AS n ON n.id = a.name_id",
+			"GROUP BY a.name_id",
+			"UNION ALL",
+			"SELECT n.name, 'numeric', COUNT(*) FROM matches AS e",
+			"INNER JOIN numeric_attributes AS a ON a.entity_id = e.entity_id AND a.from_block = e.from_block",
+			"INNER JOIN attribute_names AS n ON n.id = a.name_id",
+			"GROUP BY a.name_id",
+			"UNION ALL",
+			"SELECT '', '', COUNT(*) FROM matches",
+			"ORDER BY 1, 2",
+		},
+		" ",
+	)
+
+	ctx, conn, finish, err := s.startQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = finish(err) }()
+
+	rows, err := conn.QueryContext(ctx, sqlQuery, matches.Args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attribute keys: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		keys    []AttributeKey
+		matched uint64
+	)
+	for rows.Next() {
+		key := AttributeKey{}
+		if err := rows.Scan(&key.Name, &key.Type, &key.Entities); err != nil {
+			return nil, fmt.Errorf("failed to list attribute keys: %w", err)
+		}
+		// The row without a name holds the number of matching entities
+		if key.Name == "" {
+			matched = key.Entities
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list attribute keys: %w", err)
+	}
+
+	return withMetadataKeys(keys, matched), nil
+}
+
+// withMetadataKeys adds the owner, expiration, content type and payload size,
+// which every entity has but that are not stored as attributes, and keeps the
+// keys sorted.
+func withMetadataKeys(keys []AttributeKey, entities uint64) []AttributeKey {
+	if entities == 0 {
+		return keys
+	}
+
+	keys = append(keys,
+		AttributeKey{Name: query.ContentTypeAttributeKey, Type: "string", Entities: entities},
+		AttributeKey{Name: query.ExpirationAttributeKey, Type: "numeric", Entities: entities},
+		AttributeKey{Name: query.OwnerAttributeKey, Type: "string", Entities: entities},
+		AttributeKey{Name: query.PayloadSizeAttributeKey, Type: "numeric", Entities: entities},
+	)
+	slices.SortFunc(keys, func(a, b AttributeKey) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+	})
+
+	return keys
+}
+
+// parseFilter parses a query that restricts the entities to aggregate over,
+// the empty query matches all entities.
+func (s *SQLiteStore) parseFilter(q string) (*query.AST, error) {
+	if q == "" {
+		q = "$all"
+	}
+
+	ast, err := query.ParseWithOptions(q, s.log, s.parseOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	// Filters don't take arguments, this rejects any placeholders
+	ast, err = ast.Bind(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind query arguments: %w", err)
+	}
+	return ast, nil
+}
@@ -21,7 +21,10 @@ func main() {
 	logger := slog.New(slog.Default().Handler())
 
 	cfg := struct {
-		dbPath string
+		dbPath    string
+		evaluator string
+		arguments cli.StringSlice
+		explain   bool
 	}{}
 
 	app := &cli.App{
@@ -34,6 +37,21 @@ func main() {
 				Destination: &cfg.dbPath,
 				EnvVars:     []string{"DB_PATH"},
 			},
+			&cli.StringFlag{
+				Name:        "evaluator",
+				Usage:       "force the query evaluator (exists or tables) instead of letting the planner choose",
+				Destination: &cfg.evaluator,
+			},
+			&cli.StringSliceFlag{
+				Name:        "arg",
+				Usage:       `an argument for the next placeholder of the query, as JSON (e.g. {"number": 10})`,
+				Destination: &cfg.arguments,
+			},
+			&cli.BoolFlag{
+				Name:        "explain",
+				Usage:       "print the SQL and the query plan instead of running the query",
+				Destination: &cfg.explain,
+			},
 		},
 		Action: func(c *cli.Context) error {
 
@@ -43,6 +61,15 @@ func main() {
 				return fmt.Errorf("query is required")
 			}
 
+			arguments := []query.Argument{}
+			for _, raw := range cfg.arguments.Value() {
+				argument := query.Argument{}
+				if err := json.Unmarshal([]byte(raw), &argument); err != nil {
+					return fmt.Errorf("invalid argument %s: %w", raw, err)
+				}
+				arguments = append(arguments, argument)
+			}
+
 			store, err := sqlitestore.NewSQLiteStore(logger, cfg.dbPath, 7)
 			if err != nil {
 				return fmt.Errorf("failed to create SQLite store: %w", err)
@@ -52,9 +79,7 @@ func main() {
 			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 			defer cancel()
 
-			startTime := time.Now()
-
-			response, err := store.QueryEntities(ctx, q, &query.Options{
+			options := &query.Options{
 				IncludeData: &query.IncludeData{
 					Key:         true,
 					Expiration:  true,
@@ -64,7 +89,25 @@ func main() {
 					Attributes:  true,
 				},
 				ResultsPerPage: 20,
-			})
+				Evaluator:      cfg.evaluator,
+				Arguments:      arguments,
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if cfg.explain {
+				explanation, err := store.Explain(ctx, q, options)
+				if err != nil {
+					return fmt.Errorf("failed to explain query: %w", err)
+				}
+				enc.Encode(explanation)
+				return nil
+			}
+
+			startTime := time.Now()
+
+			response, err := store.QueryEntities(ctx, q, options)
 			if err != nil {
 				return fmt.Errorf("failed to query entities: %w", err)
 			}
@@ -73,8 +116,6 @@ func main() {
 
 			logger.Info("query completed", "executionTime", elapsed.Seconds(), "entities", len(response.Data))
 
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", "  ")
 			enc.Encode(response)
 
 			return nil
@@ -0,0 +1,125 @@
+package sqlitestore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies how a payload is compressed in the payload_contents table.
+type Codec string
+
+const (
+	CodecNone   Codec = ""
+	CodecZstd   Codec = "zstd"
+	CodecBrotli Codec = "brotli"
+)
+
+// CompressionRule decides whether and how payloads are compressed.
+type CompressionRule struct {
+	Codec Codec
+	// Payloads smaller than MinSize bytes are stored uncompressed
+	MinSize int
+}
+
+// CompressionPolicy selects the compression rule by the content type of the
+// payload. Keys of ContentTypes are either exact content types, like
+// "application/json", or a type followed by a wildcard, like "text/*".
+// Payloads with a content type that doesn't match any key use Default.
+//
+// Compression only applies to newly inserted payloads, so the policy can be
+// changed at any time.
+type CompressionPolicy struct {
+	Default      CompressionRule
+	ContentTypes map[string]CompressionRule
+}
+
+func (p *CompressionPolicy) ruleFor(contentType string) CompressionRule {
+	// Ignore parameters like the charset
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	if rule, ok := p.ContentTypes[mediaType]; ok {
+		return rule
+	}
+
+	if typ, _, ok := strings.Cut(mediaType, "/"); ok {
+		if rule, ok := p.ContentTypes[typ+"/*"]; ok {
+			return rule
+		}
+	}
+
+	return p.Default
+}
+
+// The zstd encoder and decoder are safe for concurrent use through
+// EncodeAll and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compressPayload compresses the payload according to the policy. It returns
+// the payload as is when the rule doesn't call for compression or when
+// compressing doesn't make it smaller.
+func compressPayload(policy *CompressionPolicy, contentType string, payload []byte) ([]byte, Codec, error) {
+	if policy == nil {
+		return payload, CodecNone, nil
+	}
+
+	rule := policy.ruleFor(contentType)
+	if rule.Codec == CodecNone || len(payload) < rule.MinSize {
+		return payload, CodecNone, nil
+	}
+
+	var compressed []byte
+
+	switch rule.Codec {
+	case CodecZstd:
+		compressed = zstdEncoder.EncodeAll(payload, make([]byte, 0, len(payload)))
+	case CodecBrotli:
+		b := bytes.Buffer{}
+		w := brotli.NewWriter(&b)
+		if _, err := w.Write(payload); err != nil {
+			return nil, CodecNone, fmt.Errorf("failed to compress payload with brotli: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, CodecNone, fmt.Errorf("failed to compress payload with brotli: %w", err)
+		}
+		compressed = b.Bytes()
+	default:
+		return nil, CodecNone, fmt.Errorf("unknown codec: %q", rule.Codec)
+	}
+
+	if len(compressed) >= len(payload) {
+		return payload, CodecNone, nil
+	}
+
+	return compressed, rule.Codec, nil
+}
+
+// decompressPayload reverses compressPayload.
+func decompressPayload(codec Codec, payload []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return payload, nil
+	case CodecZstd:
+		decompressed, err := zstdDecoder.DecodeAll(payload, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload with zstd: %w", err)
+		}
+		return decompressed, nil
+	case CodecBrotli:
+		decompressed, err := io.ReadAll(brotli.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload with brotli: %w", err)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unknown codec: %q", codec)
+	}
+}
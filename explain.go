@@ -0,0 +1,114 @@
+package sqlitestore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+)
+
+// QueryExplanation describes how a query would be run.
+type QueryExplanation struct {
+	// The query in its canonical form
+	Query string `json:"query"`
+	// The evaluator that translated the query, either "exists", "tables" or
+	// "mixed" if its branches are evaluated differently
+	Evaluator string `json:"evaluator"`
+	// The fraction of live entities that the planner estimates to match
+	Selectivity float64 `json:"selectivity"`
+	SQL         string  `json:"sql"`
+	Args        []any   `json:"args"`
+	// The output of EXPLAIN QUERY PLAN, as a tree
+	Plan []*QueryPlanStep `json:"plan"`
+}
+
+// QueryPlanStep is a row of EXPLAIN QUERY PLAN, like "SEARCH e USING INDEX
+// ...", with the steps that SQLite nests under it.
+type QueryPlanStep struct {
+	ID       int              `json:"id"`
+	Parent   int              `json:"parent"`
+	Detail   string           `json:"detail"`
+	Children []*QueryPlanStep `json:"children,omitempty"`
+}
+
+// Explain translates the query in the same way as QueryEntities, including
+// the choice of the evaluator, and returns the SQL with the query plan of
+// SQLite without running the query.
+func (s *SQLiteStore) Explain(
+	ctx context.Context,
+	req string,
+	op *query.Options,
+) (*QueryExplanation, error) {
+	ast, err := query.ParseWithOptions(req, s.log, s.parseOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	prepared, err := s.prepareQuery(ctx, ast, op, resultsPerPage(op)+1)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := s.queryPlan(ctx, prepared.query)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluator := query.EvaluatorExists
+	switch prepared.evaluator.(type) {
+	case query.TablesEvaluator:
+		evaluator = query.EvaluatorTables
+	case query.MixedEvaluator:
+		evaluator = query.EvaluatorMixed
+	}
+
+	return &QueryExplanation{
+		Query:       ast.String(),
+		Evaluator:   evaluator,
+		Selectivity: prepared.selectivity,
+		SQL:         prepared.query.Query,
+		Args:        prepared.query.Args,
+		Plan:        plan,
+	}, nil
+}
+
+// queryPlan runs EXPLAIN QUERY PLAN and links every step to its parent. It
+// waits for a slot and is bounded by the limits like any other query.
+func (s *SQLiteStore) queryPlan(ctx context.Context, q *query.SelectQuery) (_ []*QueryPlanStep, err error) {
+	ctx, conn, finish, err := s.startQuery(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get query plan: %w", err)
+	}
+	defer func() { err = finish(err) }()
+
+	rows, err := conn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+q.Query, q.Args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get query plan: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		roots   []*QueryPlanStep
+		steps   = map[int]*QueryPlanStep{}
+		notUsed int
+	)
+	for rows.Next() {
+		step := &QueryPlanStep{}
+		if err := rows.Scan(&step.ID, &step.Parent, &notUsed, &step.Detail); err != nil {
+			return nil, fmt.Errorf("failed to get query plan: %w", err)
+		}
+		steps[step.ID] = step
+
+		// The parents come before their children
+		if parent, ok := steps[step.Parent]; ok {
+			parent.Children = append(parent.Children, step)
+		} else {
+			roots = append(roots, step)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get query plan: %w", err)
+	}
+
+	return roots, nil
+}
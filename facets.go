@@ -0,0 +1,217 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+)
+
+// DefaultFacetLimit is the number of values returned per facet if no limit is
+// given.
+const DefaultFacetLimit = 10
+
+// Facet is an attribute whose most common values should be counted.
+type Facet struct {
+	Name string `json:"name"`
+	// Either "string" or "numeric"
+	Type string `json:"type"`
+	// The number of values to return, at most query.QueryResultCountLimit
+	Limit uint64 `json:"limit"`
+}
+
+type FacetOptions struct {
+	AtBlock *uint64 `json:"atBlock"`
+	Facets  []Facet `json:"facets"`
+}
+
+type FacetValue struct {
+	// A string or a uint64, depending on the type of the facet
+	Value    any    `json:"value"`
+	Entities uint64 `json:"entities"`
+}
+
+type FacetResult struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Values []FacetValue `json:"values"`
+}
+
+type FacetsResponse struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	// The number of entities that match the query
+	Entities uint64        `json:"entities"`
+	Facets   []FacetResult `json:"facets"`
+}
+
+// QueryFacets counts the distinct values of the facet attributes among the
+// entities that match the query. The values of every facet are sorted by the
+// number of entities that carry them, the most common ones first. All facets
+// are computed from the same snapshot of the database.
+func (s *SQLiteStore) QueryFacets(
+	ctx context.Context,
+	req string,
+	options *FacetOptions,
+) (_ *FacetsResponse, err error) {
+	if options == nil {
+		options = &FacetOptions{}
+	}
+
+	for _, facet := range options.Facets {
+		if facet.Type != "string" && facet.Type != "numeric" {
+			return nil, fmt.Errorf("a type of either 'string' or 'numeric' needs to be provided for the facet '%s'", facet.Name)
+		}
+	}
+
+	ast, err := s.parseFilter(req)
+	if err != nil {
+		return nil, err
+	}
+
+	latestHead, err := s.GetLatestHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	block := latestHead
+	if options.AtBlock != nil {
+		block = *options.AtBlock
+	}
+
+	err = s.EnsureBlockPresent(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := query.ExistsEvaluator{}.EvaluateMatches(ast, block)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, conn, finish, err := s.startQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = finish(err) }()
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	response := &FacetsResponse{
+		BlockNumber: block,
+		Facets:      make([]FacetResult, 0, len(options.Facets)),
+	}
+
+	err = tx.QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT COUNT(*) FROM (%s)", matches.Query),
+		matches.Args...,
+	).Scan(&response.Entities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count matching entities: %w", err)
+	}
+
+	for _, facet := range options.Facets {
+		result, err := s.queryFacet(ctx, tx, matches, facet)
+		if err != nil {
+			return nil, err
+		}
+		response.Facets = append(response.Facets, *result)
+	}
+
+	return response, nil
+}
+
+func (s *SQLiteStore) queryFacet(ctx context.Context, tx *sql.Tx, matches *query.SelectQuery, facet Facet) (*FacetResult, error) {
+	limit := facet.Limit
+	if limit == 0 {
+		limit = DefaultFacetLimit
+	}
+	limit = min(limit, query.QueryResultCountLimit)
+
+	args := append([]any{}, matches.Args...)
+
+	var valueQuery string
+	if selector, numeric, ok := query.MetadataAttributeSelector(facet.Name, "e", "e"); ok {
+		// The matches carry the columns of both the metadata and the payload
+		if numeric != (facet.Type == "numeric") {
+			return nil, fmt.Errorf("the facet '%s' has the wrong type '%s'", facet.Name, facet.Type)
+		}
+		valueQuery = fmt.Sprintf("SELECT %s AS value FROM matches AS e", selector)
+	} else {
+		table := "string_attributes"
+		if facet.Type == "numeric" {
+			table = "numeric_attributes"
+		}
+		args = append(args, facet.Name)
+		valueQuery = strings.Join(
+			[]string{
+				"SELECT a.value AS value FROM matches AS e",
+				"INNER JOIN", table, "AS a ON a.entity_id = e.entity_id AND a.from_block = e.from_block",
+				fmt.Sprintf("WHERE a.name_id = (SELECT n.id FROM attribute_names AS n WHERE n.name = ?%d)", len(args)),
+			},
+			" ",
+		)
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		strings.Join(
+			[]string{
+				"WITH matches AS (" + matches.Query + ")",
+				"SELECT value, COUNT(*) AS entities FROM (" + valueQuery + ")",
+				"GROUP BY value",
+				"ORDER BY entities DESC, value ASC",
+				fmt.Sprintf("LIMIT %d", limit),
+			},
+			" ",
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query facet %s: %w", facet.Name, err)
+	}
+	defer rows.Close()
+
+	result := &FacetResult{
+		Name:   facet.Name,
+		Type:   facet.Type,
+		Values: []FacetValue{},
+	}
+
+	for rows.Next() {
+		var (
+			stringValue  string
+			numericValue int64
+			entities     uint64
+			value        any
+		)
+		if facet.Type == "numeric" {
+			value = &numericValue
+		} else {
+			value = &stringValue
+		}
+		if err := rows.Scan(value, &entities); err != nil {
+			return nil, fmt.Errorf("failed to query facet %s: %w", facet.Name, err)
+		}
+
+		facetValue := FacetValue{Entities: entities, Value: stringValue}
+		if facet.Type == "numeric" {
+			// Numeric values are stored as their two's complement, see store.Uint64
+			facetValue.Value = uint64(numericValue)
+		}
+		result.Values = append(result.Values, facetValue)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query facet %s: %w", facet.Name, err)
+	}
+
+	return result, nil
+}
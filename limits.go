@@ -0,0 +1,161 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrOverloaded is returned when a query can't be admitted, because too
+	// many queries are already running and waiting.
+	ErrOverloaded = errors.New("store overloaded")
+	// ErrQueryTimeout is returned when a query ran for longer than
+	// QueryLimits.Timeout and was interrupted.
+	ErrQueryTimeout = errors.New("query timed out")
+	// ErrTooManySteps is returned when a query ran for more than
+	// QueryLimits.MaxSteps steps of the SQLite virtual machine and was
+	// interrupted.
+	ErrTooManySteps = errors.New("query took too many steps")
+)
+
+// QueryLimits bounds the resources that a single query can use, the zero
+// value doesn't limit anything.
+//
+// The steps and the time are checked by a progress handler that SQLite calls
+// while the query runs, so a query that examines too many rows is interrupted
+// even if it returns few of them.
+type QueryLimits struct {
+	// The time a query can run for
+	Timeout time.Duration
+	// The number of steps of the SQLite virtual machine that a query can run
+	// for, checked every thousand steps
+	MaxSteps uint64
+	// The number of queries that can run at the same time
+	MaxConcurrent int
+	// The number of queries that can wait for one of the others to finish,
+	// beyond which queries fail with ErrOverloaded. Any number of queries can
+	// wait if 0, and none if negative. Only used with MaxConcurrent.
+	MaxQueued int
+	// How long a query waits before it fails with ErrOverloaded, by default
+	// it waits until its context is done
+	QueueTimeout time.Duration
+}
+
+// admission lets at most MaxConcurrent queries run at the same time and at
+// most MaxQueued wait for a slot.
+type admission struct {
+	limits QueryLimits
+	slots  chan struct{}
+	queued atomic.Int64
+}
+
+func newAdmission(limits QueryLimits) *admission {
+	a := &admission{limits: limits}
+	if limits.MaxConcurrent > 0 {
+		a.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return a
+}
+
+func (a *admission) acquire(ctx context.Context) error {
+	if a.slots == nil {
+		return nil
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	queued := a.queued.Add(1)
+	defer a.queued.Add(-1)
+	if a.limits.MaxQueued != 0 && queued > int64(a.limits.MaxQueued) {
+		return fmt.Errorf("%w: %d queries running and %d waiting", ErrOverloaded, a.limits.MaxConcurrent, a.limits.MaxQueued)
+	}
+
+	var timeout <-chan time.Time
+	if a.limits.QueueTimeout > 0 {
+		timer := time.NewTimer(a.limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("%w: waited %s for one of %d running queries", ErrOverloaded, a.limits.QueueTimeout, a.limits.MaxConcurrent)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *admission) release() {
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// startQuery waits until the query can run and returns the context and the
+// read connection to run it with, the query is interrupted once it exceeds the
+// steps or the time of the limits. finish needs to be called with the error of
+// the query once it is done, it returns ErrTooManySteps or ErrQueryTimeout if
+// the query was interrupted because of the limits.
+func (s *SQLiteStore) startQuery(ctx context.Context) (context.Context, *sql.Conn, func(error) error, error) {
+	if err := s.admission.acquire(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+
+	queryCtx, cancel := ctx, context.CancelFunc(func() {})
+	if s.admission.limits.Timeout > 0 {
+		queryCtx, cancel = context.WithTimeout(ctx, s.admission.limits.Timeout)
+	}
+
+	conn, err := s.readPool.Conn(queryCtx)
+	if err != nil {
+		timedOut := errors.Is(queryCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+		s.admission.release()
+		if timedOut {
+			return nil, nil, nil, fmt.Errorf("%w after %s waiting for a read connection: %w", ErrQueryTimeout, s.admission.limits.Timeout, err)
+		}
+		return nil, nil, nil, fmt.Errorf("failed to get a read connection: %w", err)
+	}
+
+	budget := newQueryBudget(queryCtx, s.admission.limits.MaxSteps)
+	stopBudget, err := startBudget(queryCtx, conn, budget)
+	if err != nil {
+		conn.Close()
+		cancel()
+		s.admission.release()
+		return nil, nil, nil, err
+	}
+
+	finish := func(err error) error {
+		// The query is interrupted with an error of SQLite, so check the
+		// budget and the context to know why it failed
+		timedOut := errors.Is(queryCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		stopBudget()
+		conn.Close()
+		cancel()
+		s.admission.release()
+
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(budget.exceeded, ErrTooManySteps):
+			return fmt.Errorf("%w: more than %d: %w", ErrTooManySteps, s.admission.limits.MaxSteps, err)
+		case timedOut || errors.Is(budget.exceeded, ErrQueryTimeout):
+			return fmt.Errorf("%w after %s: %w", ErrQueryTimeout, s.admission.limits.Timeout, err)
+		default:
+			return err
+		}
+	}
+
+	return queryCtx, conn, finish, nil
+}
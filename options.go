@@ -0,0 +1,63 @@
+package sqlitestore
+
+import (
+	"time"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+)
+
+// Option configures optional behaviour of the SQLiteStore.
+type Option func(*SQLiteStore)
+
+// WithCompressionPolicy compresses newly inserted payloads according to the
+// policy. Without it, payloads are stored uncompressed.
+func WithCompressionPolicy(policy CompressionPolicy) Option {
+	return func(s *SQLiteStore) {
+		s.compression = &policy
+	}
+}
+
+// WithParseOptions sets how queries are parsed, for example to limit their
+// size or to keep nested ORs instead of normalising queries to DNF.
+func WithParseOptions(options query.ParseOptions) Option {
+	return func(s *SQLiteStore) {
+		s.parseOptions = options
+	}
+}
+
+// WithSlowQueryLog records the last size queries that ran for at least the
+// threshold, together with their query plan. A size of 0 or less turns the
+// slow-query log off.
+func WithSlowQueryLog(threshold time.Duration, size int) Option {
+	return func(s *SQLiteStore) {
+		s.slowQueries = newSlowQueryLog(threshold, size)
+	}
+}
+
+// WithQueryLimits bounds the time, the steps and the concurrency of the
+// queries, to keep expensive queries from taking up all read connections.
+func WithQueryLimits(limits QueryLimits) Option {
+	return func(s *SQLiteStore) {
+		s.admission = newAdmission(limits)
+	}
+}
+
+// WithBlockWait limits how long queries wait for a block that the store hasn't
+// processed yet. Blocks that are more than maxBlocksAhead blocks ahead of the
+// head fail right away, and other blocks fail after maxWait, both with
+// ErrBlockNotYetAvailable. A limit of 0 means no limit.
+func WithBlockWait(maxBlocksAhead uint64, maxWait time.Duration) Option {
+	return func(s *SQLiteStore) {
+		s.maxBlocksAhead = maxBlocksAhead
+		s.maxBlockWait = maxWait
+	}
+}
+
+// WithCursorKey signs the cursors with an HMAC, so that clients can't craft
+// or alter them. Cursors signed with another key, or not signed, are rejected
+// with query.ErrInvalidCursor.
+func WithCursorKey(key []byte) Option {
+	return func(s *SQLiteStore) {
+		s.cursorKey = key
+	}
+}
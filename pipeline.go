@@ -0,0 +1,266 @@
+package sqlitestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"runtime"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/sync/errgroup"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+	"github.com/Arkiv-Network/arkiv-events/events"
+)
+
+// preparedBatch is a batch of blocks whose operations have already been
+// decoded into ready-to-insert rows, so that the writer only needs to execute
+// statements while it holds the write transaction.
+type preparedBatch struct {
+	firstBlock uint64
+	lastBlock  uint64
+	blocks     []preparedBlock
+}
+
+type preparedBlock struct {
+	number     uint64
+	operations []preparedOperation
+}
+
+// preparedOperation holds everything that can be computed for an operation
+// without looking at the database.
+type preparedOperation struct {
+	operation *events.Operation
+
+	// superseded is set on updates that are followed by another update of the
+	// same entity in the same block, only the last one needs to be applied.
+	superseded bool
+
+	key []byte
+
+	// Lower-cased owner for Create, Update and ChangeOwner
+	owner string
+
+	// Content address of the payload for Create and Update, computed before
+	// compression so that identical content is only stored once
+	payloadHash []byte
+	payload     []byte
+	codec       Codec
+
+	// The content attributes, the owner and expiration are stored separately
+	// in entity_metadata.
+	stringAttributes  map[string]string
+	numericAttributes map[string]uint64
+
+	// The JSON encoded attributes. For Update the attributes that are carried
+	// over from the creation of the entity are added by the writer, which
+	// copies them from the previous version.
+	stringAttributesJSON  string
+	numericAttributesJSON string
+}
+
+type preparedBatchOrError struct {
+	batch *preparedBatch
+	err   error
+}
+
+// prepareBatches reads batches from the iterator and prepares them in the
+// background. One batch is prepared ahead while the caller is writing the
+// current one, and the batches are delivered in the order of the iterator.
+//
+// The returned done channel is closed once the background goroutine stopped
+// reading from the iterator, which it does after the iterator is exhausted or
+// after ctx is cancelled and the iterator yielded its next batch.
+func prepareBatches(ctx context.Context, iterator arkivevents.BatchIterator, compression *CompressionPolicy) (batches <-chan preparedBatchOrError, done <-chan struct{}) {
+	out := make(chan preparedBatchOrError, 1)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer close(out)
+
+		for batch := range iterator {
+			item := preparedBatchOrError{}
+			if batch.Error != nil {
+				item.err = batch.Error
+			} else {
+				item.batch, item.err = prepareBatch(ctx, batch.Batch, compression)
+			}
+
+			select {
+			case out <- item:
+			case <-ctx.Done():
+				return
+			}
+
+			if item.err != nil {
+				return
+			}
+		}
+	}()
+
+	return out, stopped
+}
+
+func prepareBatch(ctx context.Context, batch events.BlockBatch, compression *CompressionPolicy) (*preparedBatch, error) {
+	if len(batch.Blocks) == 0 {
+		return nil, fmt.Errorf("received an empty batch")
+	}
+
+	prepared := &preparedBatch{
+		firstBlock: batch.Blocks[0].Number,
+		lastBlock:  batch.Blocks[len(batch.Blocks)-1].Number,
+		blocks:     make([]preparedBlock, len(batch.Blocks)),
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+
+	for i := range batch.Blocks {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			block, err := prepareBlock(&batch.Blocks[i], compression)
+			if err != nil {
+				return err
+			}
+			prepared.blocks[i] = *block
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return prepared, nil
+}
+
+func prepareBlock(block *events.Block, compression *CompressionPolicy) (*preparedBlock, error) {
+	prepared := &preparedBlock{
+		number:     block.Number,
+		operations: make([]preparedOperation, 0, len(block.Operations)),
+	}
+
+	lastUpdates := map[common.Hash]*events.OPUpdate{}
+	for _, operation := range block.Operations {
+		if operation.Update != nil {
+			lastUpdates[operation.Update.Key] = operation.Update
+		}
+	}
+
+	for i := range block.Operations {
+		operation := &block.Operations[i]
+		op := preparedOperation{
+			operation: operation,
+		}
+
+		switch {
+
+		case operation.Create != nil:
+			key := operation.Create.Key
+			op.key = key.Bytes()
+			op.owner = strings.ToLower(operation.Create.Owner.Hex())
+			op.payloadHash = crypto.Keccak256(operation.Create.Content)
+
+			var err error
+			op.payload, op.codec, err = compressPayload(compression, operation.Create.ContentType, operation.Create.Content)
+			if err != nil {
+				return nil, err
+			}
+
+			op.stringAttributes = maps.Clone(operation.Create.StringAttributes)
+			if op.stringAttributes == nil {
+				op.stringAttributes = map[string]string{}
+			}
+			op.stringAttributes["$creator"] = op.owner
+			op.stringAttributes["$key"] = strings.ToLower(key.Hex())
+
+			stringAttributesBytes, err := json.Marshal(op.stringAttributes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal string attributes: %w", err)
+			}
+			op.stringAttributesJSON = string(stringAttributesBytes)
+
+			op.numericAttributes = maps.Clone(operation.Create.NumericAttributes)
+			if op.numericAttributes == nil {
+				op.numericAttributes = map[string]uint64{}
+			}
+			op.numericAttributes["$createdAtBlock"] = uint64(block.Number)
+
+			sequence := block.Number<<32 | operation.TxIndex<<16 | operation.OpIndex
+			op.numericAttributes["$sequence"] = sequence
+			op.numericAttributes["$txIndex"] = uint64(operation.TxIndex)
+			op.numericAttributes["$opIndex"] = uint64(operation.OpIndex)
+
+			numericAttributesBytes, err := json.Marshal(op.numericAttributes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal numeric attributes: %w", err)
+			}
+			op.numericAttributesJSON = string(numericAttributesBytes)
+
+		case operation.Update != nil:
+			if lastUpdates[operation.Update.Key] != operation.Update {
+				op.superseded = true
+				break
+			}
+
+			op.key = operation.Update.Key.Bytes()
+			op.owner = strings.ToLower(operation.Update.Owner.Hex())
+			op.payloadHash = crypto.Keccak256(operation.Update.Content)
+
+			var err error
+			op.payload, op.codec, err = compressPayload(compression, operation.Update.ContentType, operation.Update.Content)
+			if err != nil {
+				return nil, err
+			}
+
+			op.stringAttributes = maps.Clone(operation.Update.StringAttributes)
+			if op.stringAttributes == nil {
+				op.stringAttributes = map[string]string{}
+			}
+			op.stringAttributes["$key"] = strings.ToLower(operation.Update.Key.Hex())
+
+			stringAttributesBytes, err := json.Marshal(op.stringAttributes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal string attributes: %w", err)
+			}
+			op.stringAttributesJSON = string(stringAttributesBytes)
+
+			op.numericAttributes = maps.Clone(operation.Update.NumericAttributes)
+			if op.numericAttributes == nil {
+				op.numericAttributes = map[string]uint64{}
+			}
+
+			numericAttributesBytes, err := json.Marshal(op.numericAttributes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal numeric attributes: %w", err)
+			}
+			op.numericAttributesJSON = string(numericAttributesBytes)
+
+		case operation.Delete != nil:
+			op.key = common.Hash(*operation.Delete).Bytes()
+
+		case operation.Expire != nil:
+			op.key = common.Hash(*operation.Expire).Bytes()
+
+		case operation.ExtendBTL != nil:
+			op.key = operation.ExtendBTL.Key.Bytes()
+
+		case operation.ChangeOwner != nil:
+			op.key = operation.ChangeOwner.Key.Bytes()
+			op.owner = strings.ToLower(operation.ChangeOwner.Owner.Hex())
+
+		default:
+			return nil, fmt.Errorf("unknown operation: %v", operation)
+		}
+
+		prepared.operations = append(prepared.operations, op)
+	}
+
+	return prepared, nil
+}
@@ -0,0 +1,52 @@
+// The progress handler that interrupts queries that exceed their budget. It is
+// installed on every connection by an auto extension of SQLite, because
+// go-sqlite3 doesn't expose the handle of its connections.
+//
+// The declarations are those of the public API of SQLite, which go-sqlite3
+// compiles in.
+
+#include <stdint.h>
+
+#include "_cgo_export.h"
+
+typedef struct sqlite3 sqlite3;
+typedef struct sqlite3_context sqlite3_context;
+typedef struct sqlite3_value sqlite3_value;
+typedef struct sqlite3_api_routines sqlite3_api_routines;
+
+#define ARKIV_SQLITE_UTF8 1
+
+void sqlite3_progress_handler(sqlite3 *, int, int (*)(void *), void *);
+int sqlite3_create_function(
+	sqlite3 *,
+	const char *,
+	int,
+	int,
+	void *,
+	void (*)(sqlite3_context *, int, sqlite3_value **),
+	void (*)(sqlite3_context *, int, sqlite3_value **),
+	void (*)(sqlite3_context *));
+sqlite3 *sqlite3_context_db_handle(sqlite3_context *);
+void sqlite3_result_int64(sqlite3_context *, long long);
+int sqlite3_auto_extension(void (*)(void));
+
+static int progress_steps;
+
+static int arkiv_progress(void *db) {
+	return arkivProgress((long long)(intptr_t)db);
+}
+
+// arkiv_connection_id() identifies the connection to the progress handler.
+static void arkiv_connection_id(sqlite3_context *ctx, int argc, sqlite3_value **argv) {
+	sqlite3_result_int64(ctx, (long long)(intptr_t)sqlite3_context_db_handle(ctx));
+}
+
+static int arkiv_progress_init(sqlite3 *db, char **err, const sqlite3_api_routines *api) {
+	sqlite3_progress_handler(db, progress_steps, arkiv_progress, db);
+	return sqlite3_create_function(db, "arkiv_connection_id", 0, ARKIV_SQLITE_UTF8, 0, arkiv_connection_id, 0, 0);
+}
+
+int arkiv_register_progress(int steps) {
+	progress_steps = steps;
+	return sqlite3_auto_extension((void (*)(void))arkiv_progress_init);
+}
@@ -0,0 +1,97 @@
+package sqlitestore
+
+/*
+int arkiv_register_progress(int steps);
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// progressSteps is the number of virtual machine steps that SQLite runs
+// between two calls of the progress handler, the budget of a query is checked
+// at this granularity.
+const progressSteps = 1000
+
+var (
+	registerProgressOnce sync.Once
+	registerProgressErr  error
+)
+
+// registerProgressHandler installs the progress handler of progress.c on the
+// connections that are opened from now on, in this and any other database of
+// the process. Without a budget the handler lets queries run.
+func registerProgressHandler() error {
+	registerProgressOnce.Do(func() {
+		if rc := C.arkiv_register_progress(progressSteps); rc != 0 {
+			registerProgressErr = fmt.Errorf("failed to register the progress handler: SQLite error %d", int(rc))
+		}
+	})
+	return registerProgressErr
+}
+
+// queryBudgets holds the budget of the query that is running on a connection,
+// by the id that arkiv_connection_id() returns on it.
+var queryBudgets sync.Map
+
+// queryBudget is what a query can use before SQLite interrupts it from the
+// progress handler. It is only used by the connection that the query runs on,
+// which runs one statement at a time.
+type queryBudget struct {
+	// The number of virtual machine steps, no limit if 0
+	maxSteps uint64
+	// When the query needs to be done, no limit if zero
+	deadline time.Time
+
+	steps uint64
+	// Why the query was interrupted, ErrTooManySteps or ErrQueryTimeout
+	exceeded error
+}
+
+func newQueryBudget(ctx context.Context, maxSteps uint64) *queryBudget {
+	deadline, _ := ctx.Deadline()
+	return &queryBudget{
+		maxSteps: maxSteps,
+		deadline: deadline,
+	}
+}
+
+// progress is called every progressSteps steps and returns whether the query
+// needs to be interrupted.
+func (b *queryBudget) progress() bool {
+	b.steps += progressSteps
+	switch {
+	case b.maxSteps > 0 && b.steps > b.maxSteps:
+		b.exceeded = ErrTooManySteps
+	case !b.deadline.IsZero() && time.Now().After(b.deadline):
+		b.exceeded = ErrQueryTimeout
+	}
+	return b.exceeded != nil
+}
+
+//export arkivProgress
+func arkivProgress(connectionID C.longlong) C.int {
+	budget, ok := queryBudgets.Load(int64(connectionID))
+	if !ok || !budget.(*queryBudget).progress() {
+		return 0
+	}
+	return 1
+}
+
+// startBudget applies the budget to the queries on the connection until the
+// returned function is called.
+func startBudget(ctx context.Context, conn *sql.Conn, budget *queryBudget) (func(), error) {
+	var connectionID int64
+	err := conn.QueryRowContext(ctx, "SELECT arkiv_connection_id()").Scan(&connectionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify the connection: %w", err)
+	}
+
+	queryBudgets.Store(connectionID, budget)
+	return func() { queryBudgets.Delete(connectionID) }, nil
+}
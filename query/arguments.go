@@ -0,0 +1,269 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrInvalidArgument is returned when the arguments of a query don't match its
+// placeholders.
+var ErrInvalidArgument = errors.New("invalid query argument")
+
+// Placeholder is the position of a query argument, $1 refers to the first
+// argument.
+type Placeholder int
+
+func (p *Placeholder) Capture(values []string) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(values[0], "$"))
+	if err != nil {
+		return fmt.Errorf("invalid placeholder %s: %w", values[0], err)
+	}
+	*p = Placeholder(n)
+	return nil
+}
+
+func (p Placeholder) String() string {
+	return fmt.Sprintf("$%d", int(p))
+}
+
+// Argument is the value of a placeholder in a query. Exactly one of the fields
+// needs to be set. Addresses and keys are compared as the lower case hex
+// strings that they are stored as, and lists can only be used with IN.
+type Argument struct {
+	String  *string         `json:"string,omitempty"`
+	Number  *uint64         `json:"number,omitempty"`
+	Address *common.Address `json:"address,omitempty"`
+	Key     *common.Hash    `json:"key,omitempty"`
+	Strings []string        `json:"strings,omitempty"`
+	Numbers []uint64        `json:"numbers,omitempty"`
+}
+
+func StringArgument(value string) Argument {
+	return Argument{String: &value}
+}
+
+func NumberArgument(value uint64) Argument {
+	return Argument{Number: &value}
+}
+
+func AddressArgument(value common.Address) Argument {
+	return Argument{Address: &value}
+}
+
+func KeyArgument(value common.Hash) Argument {
+	return Argument{Key: &value}
+}
+
+func StringsArgument(values ...string) Argument {
+	return Argument{Strings: values}
+}
+
+func NumbersArgument(values ...uint64) Argument {
+	return Argument{Numbers: values}
+}
+
+func (a Argument) isSet() []bool {
+	return []bool{
+		a.String != nil,
+		a.Number != nil,
+		a.Address != nil,
+		a.Key != nil,
+		a.Strings != nil,
+		a.Numbers != nil,
+	}
+}
+
+// value returns the single value of the argument.
+func (a Argument) value() (Value, bool) {
+	switch {
+	case a.String != nil:
+		return Value{String: a.String}, true
+	case a.Number != nil:
+		return Value{Number: a.Number}, true
+	case a.Address != nil:
+		hex := strings.ToLower(a.Address.Hex())
+		return Value{String: &hex}, true
+	case a.Key != nil:
+		hex := strings.ToLower(a.Key.Hex())
+		return Value{String: &hex}, true
+	default:
+		return Value{}, false
+	}
+}
+
+// Bind returns a copy of the AST in which the placeholders are replaced by the
+// arguments. The AST itself is left as is, so that a parsed query can be
+// bound to different arguments. It fails if an argument is missing or if its
+// type doesn't fit the operator.
+func (t *AST) Bind(arguments []Argument) (*AST, error) {
+	for i, argument := range arguments {
+		set := 0
+		for _, isSet := range argument.isSet() {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("%w: $%d needs to have exactly one value set", ErrInvalidArgument, i+1)
+		}
+	}
+
+	if t.Expr == nil {
+		return t, nil
+	}
+
+	b := binder{arguments: arguments}
+
+	or, err := b.bindOr(&t.Expr.Or)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AST{Expr: &ASTExpr{Or: *or}}, nil
+}
+
+type binder struct {
+	arguments []Argument
+}
+
+func (b binder) argument(p Placeholder) (Argument, error) {
+	if int(p) > len(b.arguments) {
+		return Argument{}, fmt.Errorf("%w: no argument for %s", ErrInvalidArgument, p)
+	}
+	return b.arguments[p-1], nil
+}
+
+func (b binder) bindOr(or *ASTOr) (*ASTOr, error) {
+	bound := &ASTOr{Terms: make([]ASTAnd, 0, len(or.Terms))}
+	for _, and := range or.Terms {
+		terms := make([]ASTTerm, 0, len(and.Terms))
+		for _, term := range and.Terms {
+			boundTerm, err := b.bindTerm(term)
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, boundTerm)
+		}
+		bound.Terms = append(bound.Terms, ASTAnd{Terms: terms})
+	}
+	return bound, nil
+}
+
+// bindTerm binds the placeholders of the term, the parts of the term without
+// placeholders are shared with the original.
+func (b binder) bindTerm(term ASTTerm) (ASTTerm, error) {
+	switch {
+	case term.Or != nil:
+		or, err := b.bindOr(term.Or)
+		return ASTTerm{Or: or}, err
+	case term.Assign != nil:
+		value, err := b.bindValue(term.Assign.Var, term.Assign.Value)
+		return ASTTerm{Assign: &Equality{Var: term.Assign.Var, IsNot: term.Assign.IsNot, Value: value}}, err
+	case term.LessThan != nil:
+		value, err := b.bindValue(term.LessThan.Var, term.LessThan.Value)
+		return ASTTerm{LessThan: &LessThan{Var: term.LessThan.Var, Value: value}}, err
+	case term.LessOrEqualThan != nil:
+		value, err := b.bindValue(term.LessOrEqualThan.Var, term.LessOrEqualThan.Value)
+		return ASTTerm{LessOrEqualThan: &LessOrEqualThan{Var: term.LessOrEqualThan.Var, Value: value}}, err
+	case term.GreaterThan != nil:
+		value, err := b.bindValue(term.GreaterThan.Var, term.GreaterThan.Value)
+		return ASTTerm{GreaterThan: &GreaterThan{Var: term.GreaterThan.Var, Value: value}}, err
+	case term.GreaterOrEqualThan != nil:
+		value, err := b.bindValue(term.GreaterOrEqualThan.Var, term.GreaterOrEqualThan.Value)
+		return ASTTerm{GreaterOrEqualThan: &GreaterOrEqualThan{Var: term.GreaterOrEqualThan.Var, Value: value}}, err
+	case term.Between != nil:
+		between, err := b.bindBetween(term.Between)
+		return ASTTerm{Between: between}, err
+	case term.Inclusion != nil:
+		inclusion, err := b.bindInclusion(term.Inclusion)
+		return ASTTerm{Inclusion: inclusion}, err
+	case term.Glob != nil:
+		glob, err := b.bindGlob(term.Glob)
+		return ASTTerm{Glob: glob}, err
+	default:
+		return term, nil
+	}
+}
+
+func (b binder) bindValue(name string, value Value) (Value, error) {
+	if value.Placeholder == nil {
+		return value, nil
+	}
+
+	argument, err := b.argument(*value.Placeholder)
+	if err != nil {
+		return Value{}, err
+	}
+
+	bound, ok := argument.value()
+	if !ok {
+		return Value{}, fmt.Errorf("%w: %s of %s needs to be a single value, not a list", ErrInvalidArgument, *value.Placeholder, name)
+	}
+
+	return bound.normalise(name), nil
+}
+
+func (b binder) bindBetween(between *Between) (*Between, error) {
+	low, err := b.bindValue(between.Var, between.Low)
+	if err != nil {
+		return nil, err
+	}
+	high, err := b.bindValue(between.Var, between.High)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := &Between{Var: between.Var, IsNot: between.IsNot, Low: low, High: high}
+	if err := bound.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+	return bound, nil
+}
+
+func (b binder) bindInclusion(inclusion *Inclusion) (*Inclusion, error) {
+	if inclusion.Values.Placeholder == nil {
+		return inclusion, nil
+	}
+
+	p := *inclusion.Values.Placeholder
+	argument, err := b.argument(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var values Values
+	switch {
+	case len(argument.Strings) > 0:
+		values.Strings = argument.Strings
+	case len(argument.Numbers) > 0:
+		values.Numbers = argument.Numbers
+	default:
+		return nil, fmt.Errorf("%w: %s of %s needs to be a non-empty list", ErrInvalidArgument, p, inclusion.Var)
+	}
+
+	bound := &Inclusion{Var: inclusion.Var, IsNot: inclusion.IsNot, Values: values}
+	return bound.Normalise(), nil
+}
+
+func (b binder) bindGlob(glob *Glob) (*Glob, error) {
+	if glob.Placeholder == nil {
+		return glob, nil
+	}
+
+	p := *glob.Placeholder
+	argument, err := b.argument(p)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := argument.value()
+	if !ok || value.String == nil {
+		return nil, fmt.Errorf("%w: %s of %s needs to be a string pattern", ErrInvalidArgument, p, glob.Var)
+	}
+
+	return &Glob{Var: glob.Var, IsNot: glob.IsNot, Value: *value.String}, nil
+}
@@ -0,0 +1,67 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBind(t *testing.T) {
+	ast, err := Parse(`$owner = $1 && price > $2 || name ~ $3 || id IN $4 || price BETWEEN $2 AND 100`, log)
+	require.NoError(t, err)
+
+	owner := common.HexToAddress("0xABCDEF")
+
+	bound, err := ast.Bind([]Argument{
+		AddressArgument(owner),
+		NumberArgument(10),
+		StringArgument(`a"b*`),
+		NumbersArgument(1, 2, 3),
+	})
+	require.NoError(t, err)
+
+	require.Equal(
+		t,
+		[]ASTAnd{
+			{Terms: []ASTTerm{
+				{Assign: &Equality{Var: "$owner", Value: Value{String: pointerOf("0x0000000000000000000000000000000000abcdef")}}},
+				{GreaterThan: &GreaterThan{Var: "price", Value: Value{Number: pointerOf(uint64(10))}}},
+			}},
+			{Terms: []ASTTerm{{Glob: &Glob{Var: "name", Value: `a"b*`}}}},
+			{Terms: []ASTTerm{{Inclusion: &Inclusion{Var: "id", Values: Values{Numbers: []uint64{1, 2, 3}}}}}},
+			{Terms: []ASTTerm{{Between: &Between{Var: "price", Low: Value{Number: pointerOf(uint64(10))}, High: Value{Number: pointerOf(uint64(100))}}}}},
+		},
+		bound.Expr.Or.Terms,
+	)
+
+	// The parsed query can be bound again to other arguments
+	require.Equal(t, pointerOf(Placeholder(1)), ast.Expr.Or.Terms[0].Terms[0].Assign.Value.Placeholder)
+
+	_, err = ast.Bind([]Argument{StringArgument("0x1"), NumberArgument(1), StringArgument("*"), StringsArgument("a")})
+	require.NoError(t, err)
+}
+
+func TestBind_Errors(t *testing.T) {
+	cases := []struct {
+		query     string
+		arguments []Argument
+	}{
+		{`a = $1`, nil},
+		{`a = $2`, []Argument{NumberArgument(1)}},
+		{`a = $1`, []Argument{NumbersArgument(1, 2)}},
+		{`a IN $1`, []Argument{NumberArgument(1)}},
+		{`a ~ $1`, []Argument{NumberArgument(1)}},
+		{`a BETWEEN $1 AND 10`, []Argument{StringArgument("a")}},
+		{`a = 1`, []Argument{{}}},
+		{`a = $1`, []Argument{{String: pointerOf("a"), Number: pointerOf(uint64(1))}}},
+	}
+
+	for _, c := range cases {
+		ast, err := Parse(c.query, log)
+		require.NoError(t, err, c.query)
+
+		_, err = ast.Bind(c.arguments)
+		require.ErrorIs(t, err, ErrInvalidArgument, c.query)
+	}
+}
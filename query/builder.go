@@ -0,0 +1,208 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Literal is the type of the values that attributes can be compared to.
+// Integers need to be non-negative.
+type Literal interface {
+	~string | ~int | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// Expr is a query expression that is built in Go instead of being parsed, for
+// example:
+//
+//	query.Build(query.And(query.Eq("type", "order"), query.Gt("price", 10)))
+//
+// The values don't need to be quoted or escaped. Build normalises the
+// expression in the same way as Parse, so the AST can be passed to the
+// evaluators or to SQLiteStore.QueryEntitiesAST.
+type Expr struct {
+	expr EqualExpr
+	err  error
+}
+
+// Build turns the expression into a normalised AST.
+func Build(expr Expr) (*AST, error) {
+	return BuildWithOptions(expr, ParseOptions{})
+}
+
+func BuildWithOptions(expr Expr, options ParseOptions) (*AST, error) {
+	if expr.err != nil {
+		return nil, expr.err
+	}
+
+	return expressionOf(expr.expr).normalise(options)
+}
+
+func Eq[V Literal](name string, value V) Expr {
+	return valueExpr(value, func(v Value) EqualExpr {
+		return EqualExpr{Assign: &Equality{Var: name, Value: v}}
+	})
+}
+
+func Neq[V Literal](name string, value V) Expr {
+	return valueExpr(value, func(v Value) EqualExpr {
+		return EqualExpr{Assign: &Equality{Var: name, IsNot: true, Value: v}}
+	})
+}
+
+func Lt[V Literal](name string, value V) Expr {
+	return valueExpr(value, func(v Value) EqualExpr {
+		return EqualExpr{LessThan: &LessThan{Var: name, Value: v}}
+	})
+}
+
+func Lte[V Literal](name string, value V) Expr {
+	return valueExpr(value, func(v Value) EqualExpr {
+		return EqualExpr{LessOrEqualThan: &LessOrEqualThan{Var: name, Value: v}}
+	})
+}
+
+func Gt[V Literal](name string, value V) Expr {
+	return valueExpr(value, func(v Value) EqualExpr {
+		return EqualExpr{GreaterThan: &GreaterThan{Var: name, Value: v}}
+	})
+}
+
+func Gte[V Literal](name string, value V) Expr {
+	return valueExpr(value, func(v Value) EqualExpr {
+		return EqualExpr{GreaterOrEqualThan: &GreaterOrEqualThan{Var: name, Value: v}}
+	})
+}
+
+// InRange matches the values from low to high, both included.
+func InRange[V Literal](name string, low V, high V) Expr {
+	l, err := literal(low)
+	if err != nil {
+		return Expr{err: err}
+	}
+	h, err := literal(high)
+	if err != nil {
+		return Expr{err: err}
+	}
+
+	return Expr{expr: EqualExpr{Between: &Between{Var: name, Low: l, High: h}}}
+}
+
+func In[V Literal](name string, values ...V) Expr {
+	return inclusion(name, false, values)
+}
+
+func NotIn[V Literal](name string, values ...V) Expr {
+	return inclusion(name, true, values)
+}
+
+// Matches matches the string values against a glob pattern.
+func Matches(name string, pattern string) Expr {
+	return Expr{expr: EqualExpr{Glob: &Glob{Var: name, Value: pattern}}}
+}
+
+// Has matches the entities that have the attribute, with any value.
+func Has(name string) Expr {
+	return Expr{expr: EqualExpr{Exists: &Exists{Var: name}}}
+}
+
+func And(exprs ...Expr) Expr {
+	if len(exprs) == 0 {
+		return Expr{err: errors.New("And needs at least one expression")}
+	}
+
+	and := AndExpression{Left: exprs[0].expr}
+	for _, e := range exprs[1:] {
+		and.Right = append(and.Right, &AndRHS{Expr: e.expr})
+	}
+
+	return Expr{
+		expr: EqualExpr{Paren: &Paren{Nested: Expression{Or: OrExpression{Left: and}}}},
+		err:  errorOf(exprs),
+	}
+}
+
+func Or(exprs ...Expr) Expr {
+	if len(exprs) == 0 {
+		return Expr{err: errors.New("Or needs at least one expression")}
+	}
+
+	or := OrExpression{Left: AndExpression{Left: exprs[0].expr}}
+	for _, e := range exprs[1:] {
+		or.Right = append(or.Right, &OrRHS{Expr: AndExpression{Left: e.expr}})
+	}
+
+	return Expr{
+		expr: EqualExpr{Paren: &Paren{Nested: Expression{Or: or}}},
+		err:  errorOf(exprs),
+	}
+}
+
+func Not(expr Expr) Expr {
+	return Expr{
+		expr: EqualExpr{Paren: &Paren{IsNot: true, Nested: *expressionOf(expr.expr)}},
+		err:  expr.err,
+	}
+}
+
+func expressionOf(e EqualExpr) *Expression {
+	return &Expression{Or: OrExpression{Left: AndExpression{Left: e}}}
+}
+
+func errorOf(exprs []Expr) error {
+	for _, e := range exprs {
+		if e.err != nil {
+			return e.err
+		}
+	}
+	return nil
+}
+
+func valueExpr[V Literal](value V, term func(Value) EqualExpr) Expr {
+	v, err := literal(value)
+	if err != nil {
+		return Expr{err: err}
+	}
+	return Expr{expr: term(v)}
+}
+
+func inclusion[V Literal](name string, isNot bool, values []V) Expr {
+	if len(values) == 0 {
+		return Expr{err: fmt.Errorf("IN on %s needs at least one value", name)}
+	}
+
+	inclusion := &Inclusion{Var: name, IsNot: isNot}
+	for _, value := range values {
+		v, err := literal(value)
+		if err != nil {
+			return Expr{err: err}
+		}
+		if v.String != nil {
+			inclusion.Values.Strings = append(inclusion.Values.Strings, *v.String)
+		} else {
+			inclusion.Values.Numbers = append(inclusion.Values.Numbers, *v.Number)
+		}
+	}
+
+	return Expr{expr: EqualExpr{Inclusion: inclusion}}
+}
+
+// literal converts the Go value into a Value, the constraint only lets
+// through strings and integers.
+func literal[V Literal](value V) (Value, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		return Value{String: &s}, nil
+	case reflect.Int:
+		if v.Int() < 0 {
+			return Value{}, fmt.Errorf("negative value %d, attributes can only hold non-negative numbers", v.Int())
+		}
+		n := uint64(v.Int())
+		return Value{Number: &n}, nil
+	default:
+		n := v.Uint()
+		return Value{Number: &n}, nil
+	}
+}
@@ -0,0 +1,53 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	type kind string
+
+	cases := []struct {
+		expr  Expr
+		query string
+	}{
+		{Eq("type", "order"), `type = "order"`},
+		{And(Eq("type", kind("order")), Gt("price", 10)), `type = "order" && price > 10`},
+		{Or(Lt("a", uint64(1)), Lte("b", uint32(2)), Gte("c", 3)), `a < 1 || b <= 2 || c >= 3`},
+		{Not(And(Neq("a", 1), Or(Eq("b", "x"), Eq("c", "y")))), `!(a != 1 && (b = "x" || c = "y"))`},
+		{In("$owner", "0xABC", "0xdef"), `$owner IN ("0xABC" "0xdef")`},
+		{NotIn("n", 1, 2), `n NOT IN (1 2)`},
+		{InRange("price", 10, 20), `price BETWEEN 10 AND 20`},
+		{And(Matches("name", `it's "*"`), Not(Has("deleted"))), `name ~ "it's \"*\"" && !exists(deleted)`},
+	}
+
+	for _, c := range cases {
+		expected, err := Parse(c.query, log)
+		require.NoError(t, err, c.query)
+
+		built, err := Build(c.expr)
+		require.NoError(t, err, c.query)
+
+		require.Equal(t, expected, built, c.query)
+	}
+}
+
+func TestBuild_Errors(t *testing.T) {
+	_, err := Build(And(Eq("a", 1), Gt("b", -1)))
+	require.ErrorContains(t, err, "negative")
+
+	_, err = Build(Or())
+	require.Error(t, err)
+
+	_, err = Build(In[string]("a"))
+	require.Error(t, err)
+
+	terms := []Expr{}
+	for range 11 {
+		terms = append(terms, Or(Eq("a", 1), Eq("b", 2)))
+	}
+	_, err = Build(And(terms...))
+	require.ErrorIs(t, err, ErrQueryTooComplex)
+}
@@ -0,0 +1,94 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func countTerms(ast *AST) uint64 {
+	terms := uint64(0)
+	for _, and := range ast.Expr.Or.Terms {
+		terms += uint64(len(and.Terms))
+	}
+	return terms
+}
+
+func TestDNFSize_MatchesNormalisedQuery(t *testing.T) {
+	queries := []string{
+		`a = 1`,
+		`a = 1 && b = 2 || c = 3`,
+		`(a = 1 || b = 2) && (c = 3 || d = 4 || e = 5)`,
+		`!(a = 1 || b = 2) && (c = 3 || d = 4)`,
+		`!((a = 1 || b = 2) && (c = 3 || d = 4)) || e = 5`,
+		`!(name < 123 || !(name2 = "abc" && name2 != "bcd")) && !(name3 = "def") || name4 = 456`,
+	}
+
+	for _, q := range queries {
+		v, err := Parser.ParseString("", q)
+		require.NoError(t, err)
+
+		ast := v.Normalise()
+		size := v.Expression.dnfSize(false)
+
+		require.Equal(t, uint64(len(ast.Expr.Or.Terms)), size.conjunctions, q)
+		require.Equal(t, countTerms(ast), size.terms, q)
+	}
+}
+
+func TestParse_TooComplex(t *testing.T) {
+	clauses := make([]string, 0, 40)
+	for range 40 {
+		clauses = append(clauses, `(a = 1 || b = 1)`)
+	}
+	q := strings.Join(clauses, " && ")
+
+	_, err := Parse(q, log)
+	require.ErrorIs(t, err, ErrQueryTooComplex)
+
+	_, err = ParseWithOptions(`(a = 1 || b = 1) && (c = 1 || d = 1)`, log, ParseOptions{MaxTerms: 7})
+	require.ErrorIs(t, err, ErrQueryTooComplex)
+
+	_, err = ParseWithOptions(`(a = 1 || b = 1) && (c = 1 || d = 1)`, log, ParseOptions{MaxTerms: 8})
+	require.NoError(t, err)
+
+	// Without normalising to DNF the query stays small
+	ast, err := ParseWithOptions(q, log, ParseOptions{Nested: true})
+	require.NoError(t, err)
+	require.Len(t, ast.Expr.Or.Terms, 1)
+	require.Len(t, ast.Expr.Or.Terms[0].Terms, 40)
+
+	_, err = evaluator.EvaluateAST(ast, queryOptions)
+	require.NoError(t, err)
+}
+
+func TestParseNested_PushesDownNegations(t *testing.T) {
+	ast, err := ParseWithOptions(`!(a = 1 && (b = 2 || c < 3)) && d = 4`, log, ParseOptions{Nested: true})
+	require.NoError(t, err)
+
+	// !(a = 1 && (b = 2 || c < 3)) is a != 1 || (b != 2 && c >= 3)
+	require.Equal(t,
+		&AST{
+			Expr: &ASTExpr{
+				Or: ASTOr{
+					Terms: []ASTAnd{{
+						Terms: []ASTTerm{
+							{Or: &ASTOr{
+								Terms: []ASTAnd{
+									{Terms: []ASTTerm{{Assign: &Equality{Var: "a", IsNot: true, Value: Value{Number: pointerOf(uint64(1))}}}}},
+									{Terms: []ASTTerm{
+										{Assign: &Equality{Var: "b", IsNot: true, Value: Value{Number: pointerOf(uint64(2))}}},
+										{GreaterOrEqualThan: &GreaterOrEqualThan{Var: "c", Value: Value{Number: pointerOf(uint64(3))}}},
+									}},
+								},
+							}},
+							{Assign: &Equality{Var: "d", Value: Value{Number: pointerOf(uint64(4))}}},
+						},
+					}},
+				},
+			},
+		},
+		ast,
+	)
+}
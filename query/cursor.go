@@ -1,47 +1,85 @@
 package query
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"slices"
+	"math"
+	"reflect"
+)
+
+// ErrInvalidCursor is returned for cursors that can't be decoded, that were
+// tampered with or that were produced for another query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A cursor is encoded as URL-safe base64 of:
+//
+//	version | flags | fingerprint (8 bytes) | uvarint block number |
+//	per order by column: type tag | value | HMAC-SHA256 (16 bytes, if signed)
+//
+// The values follow the order by columns of the query, so the cursor doesn't
+// need to name its columns. The fingerprint binds the cursor to the query,
+// its order by and the fetched columns, and the HMAC makes it tamper-evident
+// if the options hold a key.
+const cursorVersion = 1
+
+const (
+	cursorFlagSigned = 1 << iota
+	cursorFlagBackward
+)
+
+const (
+	cursorFingerprintSize = 8
+	cursorMACSize         = 16
+)
+
+// The type tags of the cursor values
+const (
+	cursorNull byte = iota
+	cursorInt
+	cursorUint
+	cursorFloat
+	cursorString
+	cursorBytes
 )
 
 func (opts *QueryOptions) EncodeCursor(cursor *Cursor) (string, error) {
-	bs, err := json.Marshal(cursor)
-	if err != nil {
-		return "", fmt.Errorf("error marshalling cursor: %w", err)
+	if len(cursor.ColumnValues) != len(opts.OrderBy) {
+		return "", fmt.Errorf("cursor has %d values for %d order by columns", len(cursor.ColumnValues), len(opts.OrderBy))
 	}
-	opts.Log.Info("encode cursor", "cursor", string(bs))
-	encodedCursor := make([]any, 0, len(cursor.ColumnValues)*3+1)
 
-	encodedCursor = append(encodedCursor, cursor.BlockNumber)
+	flags := byte(0)
+	if len(opts.CursorKey) > 0 {
+		flags |= cursorFlagSigned
+	}
+	if cursor.Backward {
+		flags |= cursorFlagBackward
+	}
 
-	for _, c := range cursor.ColumnValues {
-		columnIx, err := opts.GetColumnIndex(c.ColumnName)
-		if err != nil {
-			return "", fmt.Errorf("could not find column index: %w", err)
+	buf := []byte{cursorVersion, flags}
+	buf = append(buf, opts.cursorFingerprint()...)
+	buf = binary.AppendUvarint(buf, cursor.BlockNumber)
+
+	for i, c := range cursor.ColumnValues {
+		if c.ColumnName != opts.OrderBy[i].Column.Name {
+			return "", fmt.Errorf("cursor value %d is for column %s instead of %s", i, c.ColumnName, opts.OrderBy[i].Column.Name)
 		}
-		descending := uint64(0)
-		if c.Descending {
-			descending = 1
+
+		var err error
+		buf, err = appendCursorValue(buf, c.Value)
+		if err != nil {
+			return "", fmt.Errorf("could not encode cursor value of %s: %w", c.ColumnName, err)
 		}
-		encodedCursor = append(encodedCursor,
-			uint64(columnIx), c.Value, descending,
-		)
 	}
 
-	s, err := json.Marshal(encodedCursor)
-	if err != nil {
-		return "", fmt.Errorf("could not marshal cursor: %w", err)
+	if flags&cursorFlagSigned != 0 {
+		buf = append(buf, opts.cursorMAC(buf)...)
 	}
-	opts.Log.Info("Encoded cursor", "cursor", string(s))
-
-	hexCursor := hex.EncodeToString([]byte(s))
-	opts.Log.Info("Hex encoded cursor", "cursor", hexCursor)
 
-	return hexCursor, nil
+	return base64.RawURLEncoding.EncodeToString(buf), nil
 }
 
 func (opts *QueryOptions) DecodeCursor(cursorStr string) (*Cursor, error) {
@@ -49,83 +87,199 @@ func (opts *QueryOptions) DecodeCursor(cursorStr string) (*Cursor, error) {
 		return nil, nil
 	}
 
-	bs, err := hex.DecodeString(cursorStr)
+	buf, err := base64.RawURLEncoding.DecodeString(cursorStr)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode cursor: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
 	}
 
-	cursor := Cursor{}
+	if len(buf) < 2+cursorFingerprintSize {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidCursor)
+	}
+	if buf[0] != cursorVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrInvalidCursor, buf[0])
+	}
 
-	encoded := make([]any, 0)
-	err = json.Unmarshal(bs, &encoded)
-	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal cursor: %w (%s)", err, string(bs))
+	flags := buf[1]
+	signed := flags&cursorFlagSigned != 0
+	switch {
+	case flags&^(cursorFlagSigned|cursorFlagBackward) != 0:
+		return nil, fmt.Errorf("%w: unknown flags %d", ErrInvalidCursor, flags)
+	case signed != (len(opts.CursorKey) > 0):
+		return nil, fmt.Errorf("%w: signature doesn't match the configuration", ErrInvalidCursor)
+	case signed:
+		if len(buf) < 2+cursorFingerprintSize+cursorMACSize {
+			return nil, fmt.Errorf("%w: too short", ErrInvalidCursor)
+		}
+		mac := buf[len(buf)-cursorMACSize:]
+		buf = buf[:len(buf)-cursorMACSize]
+		if !hmac.Equal(mac, opts.cursorMAC(buf)) {
+			return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidCursor)
+		}
 	}
 
-	firstValue, ok := encoded[0].(float64)
-	if !ok {
-		return nil, fmt.Errorf("invalid block number: %d", encoded[0])
+	fingerprint := buf[2 : 2+cursorFingerprintSize]
+	if !hmac.Equal(fingerprint, opts.cursorFingerprint()) {
+		return nil, fmt.Errorf("%w: produced for another query or order", ErrInvalidCursor)
 	}
-	blockNumber := uint64(firstValue)
-	cursor.BlockNumber = blockNumber
 
-	cursor.ColumnValues = make([]CursorValue, 0, len(encoded)-1)
+	r := &cursorReader{buf: buf[2+cursorFingerprintSize:]}
 
-	for c := range slices.Chunk(encoded[1:], 3) {
-		if len(c) != 3 {
-			return nil, fmt.Errorf("invalid length of cursor array: %d", len(c))
-		}
+	cursor := Cursor{
+		BlockNumber:  r.uvarint(),
+		ColumnValues: make([]CursorValue, 0, len(opts.OrderBy)),
+		Backward:     flags&cursorFlagBackward != 0,
+	}
+	for _, o := range opts.OrderBy {
+		cursor.ColumnValues = append(cursor.ColumnValues, CursorValue{
+			ColumnName: o.Column.Name,
+			Value:      r.value(),
+			Descending: o.Descending,
+		})
+	}
 
-		firstValue, ok := c[0].(float64)
-		if !ok {
-			return nil, fmt.Errorf("unknown column index: %d", c[0])
-		}
-		thirdValue, ok := c[2].(float64)
-		if !ok {
-			return nil, fmt.Errorf("unknown value for descending: %d", c[3])
-		}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, r.err)
+	}
+	if len(r.buf) > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidCursor, len(r.buf))
+	}
 
-		columnIx := int(firstValue)
-		if columnIx >= len(opts.Columns) {
-			return nil, fmt.Errorf("unknown column index: %d", columnIx)
-		}
+	opts.Log.Info("Decoded cursor", "blockNumber", cursor.BlockNumber, "values", len(cursor.ColumnValues))
 
-		descendingInt := int(thirdValue)
-		descending := false
-		switch descendingInt {
-		case 0:
-			descending = false
-		case 1:
-			descending = true
-		default:
-			return nil, fmt.Errorf("unknown value for descending: %d", descendingInt)
+	return &cursor, nil
+}
+
+// cursorFingerprint hashes everything that the meaning of the cursor values
+// depends on.
+func (opts *QueryOptions) cursorFingerprint() []byte {
+	h := sha256.New()
+	writeField := func(s string) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		h.Write([]byte(s))
+	}
+
+	writeField(opts.Query)
+	for _, o := range opts.OrderBy {
+		writeField(o.Column.QualifiedName)
+		writeField(fmt.Sprint(o.Descending))
+	}
+	for _, c := range opts.Columns {
+		writeField(c.Name)
+	}
+
+	return h.Sum(nil)[:cursorFingerprintSize]
+}
+
+func (opts *QueryOptions) cursorMAC(data []byte) []byte {
+	mac := hmac.New(sha256.New, opts.CursorKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:cursorMACSize]
+}
+
+// appendCursorValue encodes a value as scanned from the database, which may
+// be behind any number of pointers.
+func appendCursorValue(buf []byte, value any) ([]byte, error) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return append(buf, cursorNull), nil
 		}
+		v = v.Elem()
+	}
 
-		value := c[1]
-		if opts.Columns[columnIx].IsBytes {
-			encoded, ok := value.(string)
-			if !ok {
-				return nil, fmt.Errorf("failed to decode cursor, byte column is not a string")
-			}
-			decoded, err := base64.StdEncoding.DecodeString(encoded)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode cursor: %w", err)
-			}
-			value = decoded
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(buf, cursorNull), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(append(buf, cursorInt), v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(append(buf, cursorUint), v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(buf, cursorFloat), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		buf = binary.AppendUvarint(append(buf, cursorString), uint64(v.Len()))
+		return append(buf, v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = binary.AppendUvarint(append(buf, cursorBytes), uint64(v.Len()))
+			return append(buf, v.Bytes()...), nil
 		}
+	}
 
-		cursor.ColumnValues = append(cursor.ColumnValues, CursorValue{
-			ColumnName: opts.Columns[columnIx].Name,
-			Value:      value,
-			Descending: descending,
-		})
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// cursorReader decodes the values of a cursor, keeping the first error.
+type cursorReader struct {
+	buf []byte
+	err error
+}
+
+func (r *cursorReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
 	}
+	r.buf = nil
+}
 
-	jsonCursor, err := json.Marshal(cursor)
-	if err != nil {
-		return nil, err
+func (r *cursorReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail(errors.New("malformed number"))
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *cursorReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail(errors.New("malformed number"))
+		return 0
 	}
-	opts.Log.Info("Decoded cursor", "cursor", string(jsonCursor))
+	r.buf = r.buf[n:]
+	return v
+}
 
-	return &cursor, nil
+func (r *cursorReader) bytes(n uint64) []byte {
+	if n > uint64(len(r.buf)) {
+		r.fail(errors.New("value exceeds the cursor"))
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *cursorReader) value() any {
+	if len(r.buf) == 0 {
+		r.fail(errors.New("missing value"))
+		return nil
+	}
+
+	tag := r.buf[0]
+	r.buf = r.buf[1:]
+
+	switch tag {
+	case cursorNull:
+		return nil
+	case cursorInt:
+		return r.varint()
+	case cursorUint:
+		return r.uvarint()
+	case cursorFloat:
+		b := r.bytes(8)
+		if b == nil {
+			return nil
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	case cursorString:
+		return string(r.bytes(r.uvarint()))
+	case cursorBytes:
+		return append([]byte{}, r.bytes(r.uvarint())...)
+	default:
+		r.fail(fmt.Errorf("unknown value type %d", tag))
+		return nil
+	}
 }
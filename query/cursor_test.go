@@ -0,0 +1,108 @@
+package query
+
+import (
+	"encoding/base64"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func cursorOptions(t *testing.T, q string, key []byte) *QueryOptions {
+	options, err := NewQueryOptions(log, 10, &InternalQueryOptions{
+		IncludeData: &IncludeData{Key: true},
+		OrderBy: []OrderByAnnotation{
+			{Name: "name", Type: "string"},
+			{Name: "price", Type: "numeric", Descending: true},
+		},
+		Query:     q,
+		CursorKey: key,
+	})
+	require.NoError(t, err)
+	return options
+}
+
+func testCursor(options *QueryOptions) *Cursor {
+	name := "a name"
+	price := any(int64(-5))
+	fromBlock := uint64(math.MaxUint64 - 1)
+	entityID := any(int64(1) << 60)
+
+	return &Cursor{
+		BlockNumber: uint64(1)<<53 + 1,
+		ColumnValues: []CursorValue{
+			{ColumnName: options.OrderBy[0].Column.Name, Value: &name},
+			{ColumnName: options.OrderBy[1].Column.Name, Value: &price, Descending: true},
+			{ColumnName: options.OrderBy[2].Column.Name, Value: &fromBlock},
+			{ColumnName: options.OrderBy[3].Column.Name, Value: &entityID},
+		},
+	}
+}
+
+func TestCursor_RoundTrip(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		options := cursorOptions(t, `name = "a"`, key)
+
+		encoded, err := options.EncodeCursor(testCursor(options))
+		require.NoError(t, err)
+
+		decoded, err := options.DecodeCursor(encoded)
+		require.NoError(t, err)
+
+		require.Equal(t, uint64(1)<<53+1, decoded.BlockNumber)
+		require.Equal(
+			t,
+			[]any{"a name", int64(-5), uint64(math.MaxUint64 - 1), int64(1) << 60},
+			[]any{
+				decoded.ColumnValues[0].Value,
+				decoded.ColumnValues[1].Value,
+				decoded.ColumnValues[2].Value,
+				decoded.ColumnValues[3].Value,
+			},
+		)
+		require.True(t, decoded.ColumnValues[1].Descending)
+		require.Equal(t, options.OrderBy[3].Column.Name, decoded.ColumnValues[3].ColumnName)
+	}
+}
+
+func TestCursor_Invalid(t *testing.T) {
+	options := cursorOptions(t, `name = "a"`, nil)
+	encoded, err := options.EncodeCursor(testCursor(options))
+	require.NoError(t, err)
+
+	signed := cursorOptions(t, `name = "a"`, []byte("secret"))
+	encodedSigned, err := signed.EncodeCursor(testCursor(signed))
+	require.NoError(t, err)
+
+	tamper := func(cursor string, f func([]byte) []byte) string {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(f(raw))
+	}
+
+	tests := []struct {
+		name    string
+		options *QueryOptions
+		cursor  string
+	}{
+		{"not base64", options, "!!"},
+		{"old format", options, "5b312c5d"},
+		{"truncated", options, tamper(encoded, func(b []byte) []byte { return b[:len(b)-3] })},
+		{"trailing bytes", options, tamper(encoded, func(b []byte) []byte { return append(b, 0) })},
+		{"other query", cursorOptions(t, `name = "b"`, nil), encoded},
+		{"unsigned with a key", signed, encoded},
+		{"signed without a key", options, encodedSigned},
+		{"other key", cursorOptions(t, `name = "a"`, []byte("other")), encodedSigned},
+		{"altered value", signed, tamper(encodedSigned, func(b []byte) []byte {
+			b[len(b)-cursorMACSize-1]++
+			return b
+		})},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.options.DecodeCursor(tc.cursor)
+			require.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
@@ -162,3 +162,14 @@ func TestSorting(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestBetweenExpr(t *testing.T) {
+	expr, err := Parse(`price BETWEEN 10 AND 20`, log)
+	require.NoError(t, err)
+
+	res, err := evaluator.EvaluateAST(expr, queryOptions)
+	require.NoError(t, err)
+
+	require.Contains(t, res.Query, "a.value BETWEEN ?2 AND ?3")
+	require.Equal(t, []any{uint64(0), uint64(10), uint64(20), "price"}, res.Args)
+}
@@ -27,7 +27,15 @@ func (e ExistsEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 		" ",
 	))
 
+	blockArg := builder.PushArgument(builder.options.AtBlock)
+	builder.writeMetadataJoin(blockArg)
+
 	for i, orderBy := range builder.options.OrderByAnnotations {
+		if _, ok := getMetadataAttribute(orderBy.Name); ok {
+			// Already available through the entity_metadata join or the payload
+			continue
+		}
+
 		tableName := ""
 		indexName := ""
 		switch orderBy.Type {
@@ -47,13 +55,13 @@ func (e ExistsEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 
 		fmt.Fprintf(builder.queryBuilder,
 			" LEFT JOIN %[1]s AS %s INDEXED BY %[4]s"+
-				" ON %[2]s.entity_key = e.entity_key"+
+				" ON %[2]s.entity_id = e.entity_id"+
 				" AND %[2]s.from_block = e.from_block"+
-				" AND %[2]s.key = %[3]s",
+				" AND %[2]s.name_id = %[3]s",
 
 			tableName,
 			sortingTable,
-			keyPlaceholder,
+			attributeNameID(keyPlaceholder),
 			indexName,
 		)
 	}
@@ -70,7 +78,6 @@ func (e ExistsEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 		builder.queryBuilder.WriteString(" AND ")
 	}
 
-	blockArg := builder.PushArgument(builder.options.AtBlock)
 	fmt.Fprintf(builder.queryBuilder, "%s BETWEEN e.from_block AND e.to_block - 1", blockArg)
 
 	if ast.Expr != nil {
@@ -85,14 +92,51 @@ func (e ExistsEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 	orderColumns := make([]string, 0, len(builder.options.OrderBy))
 	for _, o := range builder.options.OrderBy {
 		suffix := ""
-		if o.Descending {
+		// Backward pages are read in the reverse order
+		if o.Descending != builder.options.Backward {
 			suffix = " DESC"
 		}
 		orderColumns = append(orderColumns, o.Column.Name+suffix)
 	}
 	builder.queryBuilder.WriteString(strings.Join(orderColumns, ", "))
 
-	fmt.Fprintf(builder.queryBuilder, " LIMIT %d", QueryResultCountLimit)
+	if builder.options.Limit > 0 {
+		fmt.Fprintf(builder.queryBuilder, " LIMIT %d", builder.options.Limit)
+	}
+
+	return &SelectQuery{
+		Query: builder.queryBuilder.String(),
+		Args:  builder.args,
+	}, nil
+}
+
+// EvaluateMatches returns a query that selects the entity_id and from_block of
+// the version of every entity that matches the query at the given block,
+// together with its payload_hash, content_type, owner and expires_at. It is
+// meant to be used as a subquery to aggregate over the matching entities, see
+// MetadataAttributeSelector.
+func (e ExistsEvaluator) EvaluateMatches(ast *AST, atBlock uint64) (*SelectQuery, error) {
+	builder := QueryBuilder{
+		options:      QueryOptions{AtBlock: atBlock},
+		queryBuilder: &strings.Builder{},
+		args:         []any{},
+		needsComma:   false,
+		needsWhere:   true,
+	}
+
+	builder.queryBuilder.WriteString("SELECT e.entity_id, e.from_block, e.payload_hash, e.content_type, m.owner, m.expires_at FROM payloads AS e")
+
+	blockArg := builder.PushArgument(atBlock)
+	builder.writeMetadataJoin(blockArg)
+
+	fmt.Fprintf(builder.queryBuilder, " WHERE %s BETWEEN e.from_block AND e.to_block - 1", blockArg)
+
+	if ast.Expr != nil {
+		err := e.addOrConditions(&ast.Expr.Or, &builder)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &SelectQuery{
 		Query: builder.queryBuilder.String(),
@@ -121,6 +165,29 @@ func (e ExistsEvaluator) addOrConditions(expr *ASTOr, b *QueryBuilder) error {
 	return nil
 }
 
+// addNestedConditions writes a nested disjunction, which occurs as a term of
+// a conjunction when the query was not normalised to DNF.
+func (e ExistsEvaluator) addNestedConditions(expr *ASTOr, b *QueryBuilder) error {
+	b.queryBuilder.WriteString("((")
+
+	err := e.addAndConditions(&expr.Terms[0], b)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range expr.Terms[1:] {
+		b.queryBuilder.WriteString(") OR (")
+		err = e.addAndConditions(&r, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.queryBuilder.WriteString("))")
+
+	return nil
+}
+
 func (e ExistsEvaluator) addAndConditions(expr *ASTAnd, b *QueryBuilder) error {
 	err := e.addTermConditions(&expr.Terms[0], b)
 	if err != nil {
@@ -138,16 +205,30 @@ func (e ExistsEvaluator) addAndConditions(expr *ASTAnd, b *QueryBuilder) error {
 	return nil
 }
 
-func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
+func (e ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
+	if term.Or != nil {
+		return e.addNestedConditions(term.Or, b)
+	}
+
+	if term.Exists != nil {
+		e.addExistsConditions(term.Exists, b)
+		return nil
+	}
+
+	if term.Comparison != nil {
+		b.queryBuilder.WriteString(b.comparisonCondition(term.Comparison, "m", "e"))
+		return nil
+	}
+
 	var (
 		attrType  string
-		key       string
+		varName   string
 		operation string
 		value     string
 	)
 
 	if term.Assign != nil {
-		key = b.PushArgument(term.Assign.Var)
+		varName = term.Assign.Var
 		val := term.Assign.Value
 		if val.String != nil {
 			attrType = "string"
@@ -162,15 +243,13 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 			operation = "!="
 		}
 	} else if term.Inclusion != nil {
-		key = b.PushArgument(term.Inclusion.Var)
+		varName = term.Inclusion.Var
 		var values []string
 		attrType = "string"
 		if len(term.Inclusion.Values.Strings) > 0 {
 			values = make([]string, 0, len(term.Inclusion.Values.Strings))
 			for _, value := range term.Inclusion.Values.Strings {
-				if term.Inclusion.Var == OwnerAttributeKey ||
-					term.Inclusion.Var == CreatorAttributeKey ||
-					term.Inclusion.Var == KeyAttributeKey {
+				if isHexAttribute(term.Inclusion.Var) {
 					values = append(values, b.PushArgument(strings.ToLower(value)))
 				} else {
 					values = append(values, b.PushArgument(value))
@@ -192,7 +271,7 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 			operation = "NOT IN"
 		}
 	} else if term.LessThan != nil {
-		key = b.PushArgument(term.LessThan.Var)
+		varName = term.LessThan.Var
 		val := term.LessThan.Value
 		if val.String != nil {
 			attrType = "string"
@@ -203,7 +282,7 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 		}
 		operation = "<"
 	} else if term.LessOrEqualThan != nil {
-		key = b.PushArgument(term.LessOrEqualThan.Var)
+		varName = term.LessOrEqualThan.Var
 		val := term.LessOrEqualThan.Value
 		if val.String != nil {
 			attrType = "string"
@@ -214,7 +293,7 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 		}
 		operation = "<="
 	} else if term.GreaterThan != nil {
-		key = b.PushArgument(term.GreaterThan.Var)
+		varName = term.GreaterThan.Var
 		val := term.GreaterThan.Value
 		if val.String != nil {
 			attrType = "string"
@@ -225,7 +304,7 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 		}
 		operation = ">"
 	} else if term.GreaterOrEqualThan != nil {
-		key = b.PushArgument(term.GreaterOrEqualThan.Var)
+		varName = term.GreaterOrEqualThan.Var
 		val := term.GreaterOrEqualThan.Value
 		if val.String != nil {
 			attrType = "string"
@@ -235,8 +314,23 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 			value = b.PushArgument(*val.Number)
 		}
 		operation = ">="
+	} else if term.Between != nil {
+		varName = term.Between.Var
+		low, high := term.Between.Low, term.Between.High
+		if low.String != nil {
+			attrType = "string"
+			value = b.PushArgument(*low.String) + " AND " + b.PushArgument(*high.String)
+		} else {
+			attrType = "numeric"
+			value = b.PushArgument(*low.Number) + " AND " + b.PushArgument(*high.Number)
+		}
+
+		operation = "BETWEEN"
+		if term.Between.IsNot {
+			operation = "NOT BETWEEN"
+		}
 	} else if term.Glob != nil {
-		key = b.PushArgument(term.Glob.Var)
+		varName = term.Glob.Var
 		val := term.Glob.Value
 		attrType = "string"
 		value = b.PushArgument(val)
@@ -249,6 +343,19 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 		return fmt.Errorf("EqualExpr::addConditions: unnormalised expression, paren is non-nil")
 	}
 
+	if attr, ok := getMetadataAttribute(varName); ok {
+		// An attribute with the wrong type never matches, just like for
+		// attributes that don't exist in the attribute table of that type
+		if attr.Numeric != (attrType == "numeric") {
+			b.queryBuilder.WriteString("FALSE")
+			return nil
+		}
+		fmt.Fprintf(b.queryBuilder, "%s %s %s", attr.selector("m", "e"), operation, value)
+		return nil
+	}
+
+	key := b.PushArgument(varName)
+
 	attrTable := "string_attributes"
 	attrIndex := "string_attributes_entity_kv_idx"
 	if attrType == "numeric" {
@@ -266,10 +373,10 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 			"INDEXED BY",
 			attrIndex,
 			"WHERE",
-			"a.entity_key = e.entity_key",
+			"a.entity_id = e.entity_id",
 			"AND a.from_block = e.from_block",
-			"AND a.key =",
-			key,
+			"AND a.name_id =",
+			attributeNameID(key),
 			"AND a.value",
 			operation,
 			value,
@@ -280,3 +387,47 @@ func (ExistsEvaluator) addTermConditions(term *ASTTerm, b *QueryBuilder) error {
 
 	return nil
 }
+
+// addExistsConditions writes the condition that the entity has an attribute
+// with the given name, of either type.
+func (e ExistsEvaluator) addExistsConditions(expr *Exists, b *QueryBuilder) {
+	if _, ok := getMetadataAttribute(expr.Var); ok {
+		// Every entity has an owner, an expiration and a payload
+		if expr.IsNot {
+			b.queryBuilder.WriteString("FALSE")
+		} else {
+			b.queryBuilder.WriteString("TRUE")
+		}
+		return
+	}
+
+	key := b.PushArgument(expr.Var)
+
+	if expr.IsNot {
+		b.queryBuilder.WriteString("NOT ")
+	}
+
+	conditions := make([]string, 0, 2)
+	for _, attrTable := range []string{"string_attributes", "numeric_attributes"} {
+		conditions = append(conditions, strings.Join(
+			[]string{
+				"EXISTS (",
+				"SELECT 1",
+				"FROM",
+				attrTable,
+				"AS a",
+				"INDEXED BY",
+				attrTable + "_entity_kv_idx",
+				"WHERE",
+				"a.entity_id = e.entity_id",
+				"AND a.from_block = e.from_block",
+				"AND a.name_id =",
+				attributeNameID(key),
+				")",
+			},
+			" ",
+		))
+	}
+
+	fmt.Fprintf(b.queryBuilder, "(%s)", strings.Join(conditions, " OR "))
+}
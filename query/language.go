@@ -1,7 +1,11 @@
 package query
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
+	"math/bits"
 	"slices"
 	"strings"
 
@@ -27,17 +31,19 @@ var lex = lexer.MustSimple([]lexer.SimpleRule{
 	{Name: "NotGlob", Pattern: `!~`},
 	{Name: "Glob", Pattern: `~`},
 	{Name: "Not", Pattern: `!`},
+	{Name: "Plus", Pattern: `\+`},
+	{Name: "Minus", Pattern: `-`},
 	{Name: "EntityKey", Pattern: `0x[a-fA-F0-9]{64}`},
 	{Name: "Address", Pattern: `0x[a-fA-F0-9]{40}`},
 	{Name: "String", Pattern: `"(?:[^"\\]|\\.)*"`},
 	{Name: "Number", Pattern: `[0-9]+`},
 	{Name: "Ident", Pattern: AnnotationIdentRegex},
+	// Placeholders for the query arguments, starting at $1
+	{Name: "Placeholder", Pattern: `\$[1-9][0-9]*`},
+	// Marks a reference to an attribute on the right side of a comparison
+	{Name: "AttrRef", Pattern: `\$attr\b`},
 	// Meta-annotations, should start with $
-	{Name: "Owner", Pattern: `\$owner`},
-	{Name: "Creator", Pattern: `\$creator`},
-	{Name: "Key", Pattern: `\$key`},
-	{Name: "Expiration", Pattern: `\$expiration`},
-	{Name: "Sequence", Pattern: `\$sequence`},
+	{Name: "Synthetic", Pattern: `\$(?:owner|creator|key|expiration|sequence|createdAtBlock|txIndex|opIndex|contentType|payloadSize)`},
 	{Name: "All", Pattern: `\$all`},
 	{Name: "Star", Pattern: `\*`},
 })
@@ -62,6 +68,39 @@ type ASTTerm struct {
 	GreaterThan        *GreaterThan
 	GreaterOrEqualThan *GreaterOrEqualThan
 	Glob               *Glob
+	Exists             *Exists
+	Between            *Between
+	Comparison         *Comparison
+
+	// Or is a nested disjunction that was kept as is instead of being
+	// distributed over the surrounding conjunction. It only occurs in ASTs
+	// that were parsed with ParseOptions.Nested.
+	Or *ASTOr
+}
+
+// And returns a copy of the AST that additionally requires all of the terms
+// to hold.
+func (t *AST) And(terms ...ASTTerm) *AST {
+	if len(terms) == 0 {
+		return t
+	}
+
+	if t.Expr == nil {
+		return &AST{
+			Expr: &ASTExpr{
+				Or: ASTOr{Terms: []ASTAnd{{Terms: terms}}},
+			},
+		}
+	}
+
+	or := ASTOr{Terms: make([]ASTAnd, 0, len(t.Expr.Or.Terms))}
+	for _, and := range t.Expr.Or.Terms {
+		or.Terms = append(or.Terms, ASTAnd{
+			Terms: append(slices.Clone(and.Terms), terms...),
+		})
+	}
+
+	return &AST{Expr: &ASTExpr{Or: or}}
 }
 
 type TopLevel struct {
@@ -275,14 +314,19 @@ func (e *AndRHS) invert() *OrRHS {
 type EqualExpr struct {
 	Paren *Paren `parser:"  @@"`
 
+	Exists *Exists `parser:"| @@"`
+
 	Assign    *Equality  `parser:"| @@"`
 	Inclusion *Inclusion `parser:"| @@"`
+	Between   *Between   `parser:"| @@"`
 
 	LessThan           *LessThan           `parser:"| @@"`
 	LessOrEqualThan    *LessOrEqualThan    `parser:"| @@"`
 	GreaterThan        *GreaterThan        `parser:"| @@"`
 	GreaterOrEqualThan *GreaterOrEqualThan `parser:"| @@"`
 	Glob               *Glob               `parser:"| @@"`
+
+	Comparison *Comparison `parser:"| @@"`
 }
 
 // Normalise on an EqualExpr can return multiple EqualExpr if the expression
@@ -321,6 +365,18 @@ func (e *EqualExpr) Normalise() ASTTerm {
 		return ASTTerm{Inclusion: e.Inclusion.Normalise()}
 	}
 
+	if e.Exists != nil {
+		return ASTTerm{Exists: e.Exists}
+	}
+
+	if e.Between != nil {
+		return ASTTerm{Between: e.Between.Normalise()}
+	}
+
+	if e.Comparison != nil {
+		return ASTTerm{Comparison: e.Comparison}
+	}
+
 	panic("This should not happen!")
 }
 
@@ -357,6 +413,18 @@ func (e *EqualExpr) invert() *EqualExpr {
 		return &EqualExpr{Inclusion: e.Inclusion.invert()}
 	}
 
+	if e.Exists != nil {
+		return &EqualExpr{Exists: e.Exists.invert()}
+	}
+
+	if e.Between != nil {
+		return &EqualExpr{Between: e.Between.invert()}
+	}
+
+	if e.Comparison != nil {
+		return &EqualExpr{Comparison: e.Comparison.invert()}
+	}
+
 	panic("This should not happen!")
 }
 
@@ -383,9 +451,10 @@ func (e *Paren) invert() *Paren {
 }
 
 type Glob struct {
-	Var   string `parser:"@Ident"`
-	IsNot bool   `parser:"((Glob | @NotGlob) | (@('NOT' | 'not')? ('GLOB' | 'glob')))"`
-	Value string `parser:"@String"`
+	Var         string       `parser:"@(Ident | Synthetic)"`
+	IsNot       bool         `parser:"((Glob | @NotGlob) | (@('NOT' | 'not')? ('GLOB' | 'glob')))"`
+	Value       string       `parser:"( @String"`
+	Placeholder *Placeholder `parser:"| @Placeholder )"`
 }
 
 func (e *Glob) Normalise() *Glob {
@@ -395,29 +464,22 @@ func (e *Glob) Normalise() *Glob {
 
 func (e *Glob) invert() *Glob {
 	return &Glob{
-		Var:   e.Var,
-		IsNot: !e.IsNot,
-		Value: e.Value,
+		Var:         e.Var,
+		IsNot:       !e.IsNot,
+		Value:       e.Value,
+		Placeholder: e.Placeholder,
 	}
 }
 
 type LessThan struct {
-	Var   string `parser:"@Ident Lt"`
+	Var   string `parser:"@(Ident | Synthetic) Lt"`
 	Value Value  `parser:"@@"`
 }
 
 func (e *LessThan) Normalise() *LessThan {
-	switch e.Var {
-	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
-		val := strings.ToLower(*e.Value.String)
-		return &LessThan{
-			Var: e.Var,
-			Value: Value{
-				String: &val,
-			},
-		}
-	default:
-		return e
+	return &LessThan{
+		Var:   e.Var,
+		Value: e.Value.normalise(e.Var),
 	}
 }
 
@@ -429,22 +491,14 @@ func (e *LessThan) invert() *GreaterOrEqualThan {
 }
 
 type LessOrEqualThan struct {
-	Var   string `parser:"@Ident Leqt"`
+	Var   string `parser:"@(Ident | Synthetic) Leqt"`
 	Value Value  `parser:"@@"`
 }
 
 func (e *LessOrEqualThan) Normalise() *LessOrEqualThan {
-	switch e.Var {
-	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
-		val := strings.ToLower(*e.Value.String)
-		return &LessOrEqualThan{
-			Var: e.Var,
-			Value: Value{
-				String: &val,
-			},
-		}
-	default:
-		return e
+	return &LessOrEqualThan{
+		Var:   e.Var,
+		Value: e.Value.normalise(e.Var),
 	}
 }
 
@@ -456,22 +510,14 @@ func (e *LessOrEqualThan) invert() *GreaterThan {
 }
 
 type GreaterThan struct {
-	Var   string `parser:"@Ident Gt"`
+	Var   string `parser:"@(Ident | Synthetic) Gt"`
 	Value Value  `parser:"@@"`
 }
 
 func (e *GreaterThan) Normalise() *GreaterThan {
-	switch e.Var {
-	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
-		val := strings.ToLower(*e.Value.String)
-		return &GreaterThan{
-			Var: e.Var,
-			Value: Value{
-				String: &val,
-			},
-		}
-	default:
-		return e
+	return &GreaterThan{
+		Var:   e.Var,
+		Value: e.Value.normalise(e.Var),
 	}
 }
 
@@ -483,22 +529,14 @@ func (e *GreaterThan) invert() *LessOrEqualThan {
 }
 
 type GreaterOrEqualThan struct {
-	Var   string `parser:"@Ident Geqt"`
+	Var   string `parser:"@(Ident | Synthetic) Geqt"`
 	Value Value  `parser:"@@"`
 }
 
 func (e *GreaterOrEqualThan) Normalise() *GreaterOrEqualThan {
-	switch e.Var {
-	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
-		val := strings.ToLower(*e.Value.String)
-		return &GreaterOrEqualThan{
-			Var: e.Var,
-			Value: Value{
-				String: &val,
-			},
-		}
-	default:
-		return e
+	return &GreaterOrEqualThan{
+		Var:   e.Var,
+		Value: e.Value.normalise(e.Var),
 	}
 }
 
@@ -511,24 +549,16 @@ func (e *GreaterOrEqualThan) invert() *LessThan {
 
 // Equality represents a simple equality (e.g. name = 123).
 type Equality struct {
-	Var   string `parser:"@(Ident | Key | Owner | Creator | Expiration | Sequence)"`
+	Var   string `parser:"@(Ident | Synthetic)"`
 	IsNot bool   `parser:"(Eq | @Neq)"`
 	Value Value  `parser:"@@"`
 }
 
 func (e *Equality) Normalise() *Equality {
-	switch e.Var {
-	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
-		val := strings.ToLower(*e.Value.String)
-		return &Equality{
-			Var:   e.Var,
-			IsNot: e.IsNot,
-			Value: Value{
-				String: &val,
-			},
-		}
-	default:
-		return e
+	return &Equality{
+		Var:   e.Var,
+		IsNot: e.IsNot,
+		Value: e.Value.normalise(e.Var),
 	}
 }
 
@@ -541,27 +571,27 @@ func (e *Equality) invert() *Equality {
 }
 
 type Inclusion struct {
-	Var    string `parser:"@(Ident | Key | Owner | Creator | Expiration | Sequence)"`
+	Var    string `parser:"@(Ident | Synthetic)"`
 	IsNot  bool   `parser:"(@('NOT'|'not')? ('IN'|'in'))"`
 	Values Values `parser:"@@"`
 }
 
 func (e *Inclusion) Normalise() *Inclusion {
-	switch e.Var {
-	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
-		vals := make([]string, 0, len(e.Values.Strings))
-		for _, val := range e.Values.Strings {
-			vals = append(vals, strings.ToLower(val))
-		}
-		return &Inclusion{
-			Var: e.Var,
-			Values: Values{
-				Strings: vals,
-			},
-		}
-	default:
+	if !isHexAttribute(e.Var) || len(e.Values.Strings) == 0 {
 		return e
 	}
+
+	vals := make([]string, 0, len(e.Values.Strings))
+	for _, val := range e.Values.Strings {
+		vals = append(vals, strings.ToLower(val))
+	}
+	return &Inclusion{
+		Var:   e.Var,
+		IsNot: e.IsNot,
+		Values: Values{
+			Strings: vals,
+		},
+	}
 }
 
 func (e *Inclusion) invert() *Inclusion {
@@ -572,29 +602,389 @@ func (e *Inclusion) invert() *Inclusion {
 	}
 }
 
-// Value is a literal value (a number or a string).
+// Between matches the values in the closed range from Low to High, which
+// compiles to a single range scan over the attribute index. Both bounds need
+// to be of the same type.
+type Between struct {
+	Var   string `parser:"@(Ident | Synthetic)"`
+	IsNot bool   `parser:"@('NOT' | 'not')? ('BETWEEN' | 'between')"`
+	Low   Value  `parser:"@@"`
+	High  Value  `parser:"('AND' | 'and') @@"`
+}
+
+func (e *Between) Normalise() *Between {
+	return &Between{
+		Var:   e.Var,
+		IsNot: e.IsNot,
+		Low:   e.Low.normalise(e.Var),
+		High:  e.High.normalise(e.Var),
+	}
+}
+
+func (e *Between) invert() *Between {
+	return &Between{
+		Var:   e.Var,
+		IsNot: !e.IsNot,
+		Low:   e.Low,
+		High:  e.High,
+	}
+}
+
+func (e *Between) validate() error {
+	// The types of placeholders are only known once the arguments are bound
+	if e.Low.Placeholder != nil || e.High.Placeholder != nil {
+		return nil
+	}
+	if (e.Low.Number == nil) != (e.High.Number == nil) {
+		return fmt.Errorf("the bounds of %s BETWEEN need to be of the same type", e.Var)
+	}
+	return nil
+}
+
+// Comparison compares two attributes of the same entity, optionally with a
+// constant offset added to the right one (e.g. $expiration > $createdAtBlock
+// + 1000). Both attributes need to exist and be of the same type, and offsets
+// are only allowed for numeric attributes.
+//
+// An attribute on the right needs to be marked with $attr(...), like in
+// minBid < $attr(maxBid), so that a value that is missing its quotes isn't
+// taken for an attribute. Synthetic attributes can be used without it.
+type Comparison struct {
+	Left     string  `parser:"@(Ident | Synthetic)"`
+	Operator string  `parser:"@(Eq | Neq | Lt | Leqt | Gt | Geqt)"`
+	Right    string  `parser:"( @Synthetic | AttrRef LParen @(Ident | Synthetic) RParen )"`
+	Offset   *Offset `parser:"@@?"`
+}
+
+// Offset is a constant that is added to or subtracted from an attribute.
+type Offset struct {
+	Negative bool   `parser:"(Plus | @Minus)"`
+	Value    uint64 `parser:"@Number"`
+}
+
+var invertedOperators = map[string]string{
+	"=":  "!=",
+	"!=": "=",
+	"<":  ">=",
+	">=": "<",
+	"<=": ">",
+	">":  "<=",
+}
+
+func (e *Comparison) invert() *Comparison {
+	return &Comparison{
+		Left:     e.Left,
+		Operator: invertedOperators[e.Operator],
+		Right:    e.Right,
+		Offset:   e.Offset,
+	}
+}
+
+func (e *Comparison) validate() error {
+	if e.Offset == nil {
+		return nil
+	}
+	for _, name := range []string{e.Left, e.Right} {
+		if attr, ok := getMetadataAttribute(name); ok && !attr.Numeric {
+			return fmt.Errorf("an offset can't be added to the string attribute %s", name)
+		}
+	}
+	return nil
+}
+
+// Exists matches the entities that have an attribute with the given name, of
+// either type and with any value. Negated, it matches the entities that
+// don't have it.
+type Exists struct {
+	IsNot bool   `parser:"@(Not | 'NOT' | 'not')? ('exists' | 'EXISTS') LParen"`
+	Var   string `parser:"@(Ident | Synthetic) RParen"`
+}
+
+func (e *Exists) invert() *Exists {
+	return &Exists{
+		Var:   e.Var,
+		IsNot: !e.IsNot,
+	}
+}
+
+// Value is a literal value (a number or a string), or a placeholder for a
+// query argument.
 type Value struct {
-	String *string `parser:"  (@String | @EntityKey | @Address)"`
-	Number *uint64 `parser:"| @Number"`
+	String      *string      `parser:"  (@String | @EntityKey | @Address)"`
+	Number      *uint64      `parser:"| @Number"`
+	Placeholder *Placeholder `parser:"| @Placeholder"`
+}
+
+// isHexAttribute returns whether the values of the synthetic attribute are
+// hex encoded, which are stored in lower case.
+func isHexAttribute(name string) bool {
+	switch name {
+	case KeyAttributeKey, OwnerAttributeKey, CreatorAttributeKey:
+		return true
+	default:
+		return false
+	}
+}
+
+func (v Value) normalise(name string) Value {
+	if !isHexAttribute(name) || v.String == nil {
+		return v
+	}
+
+	val := strings.ToLower(*v.String)
+	return Value{String: &val}
 }
 
 type Values struct {
 	Strings []string `parser:"  '(' (@String | @EntityKey | @Address)+ ')'"`
 	Numbers []uint64 `parser:"| '(' @Number+ ')'"`
+	// A placeholder for a list argument
+	Placeholder *Placeholder `parser:"| @Placeholder"`
 }
 
 var Parser = participle.MustBuild[TopLevel](
 	participle.Lexer(lex),
 	participle.Elide("Whitespace"),
 	participle.Unquote("String"),
+	// Inclusion and Between both start with the attribute and an optional NOT,
+	// and comparisons with a literal start like comparisons of two attributes
+	participle.UseLookahead(2),
 )
 
+// DefaultMaxTerms is the default limit on the number of terms of a query
+// after it has been normalised to DNF.
+const DefaultMaxTerms uint64 = 1000
+
+// ErrQueryTooComplex is returned for queries that would grow beyond the
+// configured limit when they are normalised to DNF.
+var ErrQueryTooComplex = errors.New("query is too complex")
+
+type ParseOptions struct {
+	// MaxTerms limits the number of terms of the query after normalising it to
+	// DNF, where every AND of nested ORs turns into the cross product of their
+	// terms. Defaults to DefaultMaxTerms.
+	MaxTerms uint64
+	// Nested keeps nested ORs as they are instead of normalising the query to
+	// DNF, so that the size of the AST is linear in the size of the query.
+	// Negations are still pushed down to the terms.
+	Nested bool
+}
+
 func Parse(s string, log *slog.Logger) (*AST, error) {
+	return ParseWithOptions(s, log, ParseOptions{})
+}
+
+func ParseWithOptions(s string, log *slog.Logger, options ParseOptions) (*AST, error) {
 	log.Info("parsing query", "query", s)
 
 	v, err := Parser.ParseString("", s)
 	if err != nil {
+		return nil, newParseError(s, err)
+	}
+
+	if v.Expression == nil {
+		return &AST{}, nil
+	}
+
+	return v.Expression.normalise(options)
+}
+
+// normalise validates the expression and turns it into an AST, in DNF unless
+// the options ask for nested terms.
+func (e *Expression) normalise(options ParseOptions) (*AST, error) {
+	if err := e.validate(); err != nil {
 		return nil, err
 	}
-	return v.Normalise(), err
+
+	if options.Nested {
+		return &AST{
+			Expr: &ASTExpr{Or: *e.normaliseNested()},
+		}, nil
+	}
+
+	maxTerms := options.MaxTerms
+	if maxTerms == 0 {
+		maxTerms = DefaultMaxTerms
+	}
+
+	// Check the size upfront, since building the DNF is what is expensive
+	if size := e.dnfSize(false); size.terms > maxTerms {
+		return nil, fmt.Errorf(
+			"%w: it has more than %d terms when normalised, try to factor out common terms or reduce the number of nested ORs",
+			ErrQueryTooComplex,
+			maxTerms,
+		)
+	}
+
+	return &AST{Expr: e.Normalise()}, nil
+}
+
+// validate checks the constraints that the grammar can't express.
+func (e *Expression) validate() error {
+	if err := e.Or.Left.validate(); err != nil {
+		return err
+	}
+	for _, rhs := range e.Or.Right {
+		if err := rhs.Expr.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *AndExpression) validate() error {
+	if err := e.Left.validate(); err != nil {
+		return err
+	}
+	for _, rhs := range e.Right {
+		if err := rhs.Expr.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EqualExpr) validate() error {
+	switch {
+	case e.Paren != nil:
+		return e.Paren.Nested.validate()
+	case e.Between != nil:
+		return e.Between.validate()
+	case e.Comparison != nil:
+		return e.Comparison.validate()
+	default:
+		return nil
+	}
+}
+
+// dnfSize is the size of an expression in DNF.
+type dnfSize struct {
+	conjunctions uint64
+	terms        uint64
+}
+
+func (a dnfSize) or(b dnfSize) dnfSize {
+	return dnfSize{
+		conjunctions: saturatingAdd(a.conjunctions, b.conjunctions),
+		terms:        saturatingAdd(a.terms, b.terms),
+	}
+}
+
+// and distributes the conjunctions of a over those of b, every conjunction of
+// the result combines one conjunction of each.
+func (a dnfSize) and(b dnfSize) dnfSize {
+	return dnfSize{
+		conjunctions: saturatingMul(a.conjunctions, b.conjunctions),
+		terms: saturatingAdd(
+			saturatingMul(a.terms, b.conjunctions),
+			saturatingMul(b.terms, a.conjunctions),
+		),
+	}
+}
+
+var (
+	emptyOr  = dnfSize{conjunctions: 0, terms: 0}
+	emptyAnd = dnfSize{conjunctions: 1, terms: 0}
+)
+
+func saturatingAdd(a, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
+
+func saturatingMul(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi != 0 {
+		return math.MaxUint64
+	}
+	return lo
+}
+
+// dnfSize computes the size of the expression in DNF without building it. A
+// negated OR turns into an AND and vice versa, like in invert.
+func (e *Expression) dnfSize(negated bool) dnfSize {
+	return e.Or.dnfSize(negated)
+}
+
+func (e *OrExpression) dnfSize(negated bool) dnfSize {
+	combine, size := dnfSize.or, emptyOr
+	if negated {
+		combine, size = dnfSize.and, emptyAnd
+	}
+
+	size = combine(size, e.Left.dnfSize(negated))
+	for _, rhs := range e.Right {
+		size = combine(size, rhs.Expr.dnfSize(negated))
+	}
+	return size
+}
+
+func (e *AndExpression) dnfSize(negated bool) dnfSize {
+	combine, size := dnfSize.and, emptyAnd
+	if negated {
+		combine, size = dnfSize.or, emptyOr
+	}
+
+	size = combine(size, e.Left.dnfSize(negated))
+	for _, rhs := range e.Right {
+		size = combine(size, rhs.Expr.dnfSize(negated))
+	}
+	return size
+}
+
+func (e *EqualExpr) dnfSize(negated bool) dnfSize {
+	if e.Paren != nil {
+		return e.Paren.Nested.dnfSize(negated != e.Paren.IsNot)
+	}
+	return dnfSize{conjunctions: 1, terms: 1}
+}
+
+// normaliseNested pushes the negations down to the terms like Normalise, but
+// keeps nested ORs instead of distributing the surrounding AND over them.
+func (e *Expression) normaliseNested() *ASTOr {
+	return e.Or.normaliseNested()
+}
+
+func (e *OrExpression) normaliseNested() *ASTOr {
+	terms := []ASTAnd{e.Left.normaliseNested()}
+	for _, rhs := range e.Right {
+		terms = append(terms, rhs.Expr.normaliseNested())
+	}
+
+	return &ASTOr{
+		Terms: terms,
+	}
+}
+
+func (e *AndExpression) normaliseNested() ASTAnd {
+	terms := e.Left.normaliseNested()
+	for _, rhs := range e.Right {
+		terms = append(terms, rhs.Expr.normaliseNested()...)
+	}
+
+	return ASTAnd{
+		Terms: terms,
+	}
+}
+
+func (e *EqualExpr) normaliseNested() []ASTTerm {
+	if e.Paren == nil {
+		return []ASTTerm{e.Normalise()}
+	}
+
+	nested := e.Paren.Nested
+	if e.Paren.IsNot {
+		nested = *nested.invert()
+	}
+
+	or := nested.normaliseNested()
+	if len(or.Terms) == 1 {
+		// A parenthesised conjunction can be merged into the surrounding one
+		return or.Terms[0].Terms
+	}
+
+	return []ASTTerm{{Or: or}}
 }
@@ -922,3 +922,182 @@ func TestParse(t *testing.T) {
 	})
 
 }
+
+func TestParse_Exists(t *testing.T) {
+	t.Run("exists", func(t *testing.T) {
+		v, err := Parse(`exists(name) && !exists(other)`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{Exists: &Exists{Var: "name"}},
+				{Exists: &Exists{Var: "other", IsNot: true}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("negated", func(t *testing.T) {
+		v, err := Parse(`!(exists(name) || NOT EXISTS(other))`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{Exists: &Exists{Var: "name", IsNot: true}},
+				{Exists: &Exists{Var: "other"}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("attribute named exists", func(t *testing.T) {
+		v, err := Parse(`exists = 1`, log)
+		require.NoError(t, err)
+		require.Equal(t, "exists", v.Expr.Or.Terms[0].Terms[0].Assign.Var)
+	})
+
+	t.Run("missing name", func(t *testing.T) {
+		_, err := Parse(`exists()`, log)
+		require.Error(t, err)
+	})
+}
+
+func TestParse_SyntheticAttributes(t *testing.T) {
+	t.Run("range", func(t *testing.T) {
+		v, err := Parse(`$createdAtBlock > 1000 && $payloadSize <= 10`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{GreaterThan: &GreaterThan{Var: "$createdAtBlock", Value: Value{Number: pointerOf(uint64(1000))}}},
+				{LessOrEqualThan: &LessOrEqualThan{Var: "$payloadSize", Value: Value{Number: pointerOf(uint64(10))}}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("negated inclusion", func(t *testing.T) {
+		v, err := Parse(`$owner NOT IN ("0xABCD" "0xef01")`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			&Inclusion{Var: "$owner", IsNot: true, Values: Values{Strings: []string{"0xabcd", "0xef01"}}},
+			v.Expr.Or.Terms[0].Terms[0].Inclusion,
+		)
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		v, err := Parse(`$contentType ~ "image/*"`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			&Glob{Var: "$contentType", Value: "image/*"},
+			v.Expr.Or.Terms[0].Terms[0].Glob,
+		)
+	})
+
+	t.Run("number for a hex attribute", func(t *testing.T) {
+		v, err := Parse(`$owner < 5`, log)
+		require.NoError(t, err)
+		require.Equal(t, pointerOf(uint64(5)), v.Expr.Or.Terms[0].Terms[0].LessThan.Value.Number)
+	})
+
+	t.Run("unknown synthetic attribute", func(t *testing.T) {
+		_, err := Parse(`$unknown = 1`, log)
+		require.Error(t, err)
+	})
+}
+
+func TestParse_Between(t *testing.T) {
+	t.Run("numeric", func(t *testing.T) {
+		v, err := Parse(`price BETWEEN 10 AND 20 AND type = "a"`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{Between: &Between{Var: "price", Low: Value{Number: pointerOf(uint64(10))}, High: Value{Number: pointerOf(uint64(20))}}},
+				{Assign: &Equality{Var: "type", Value: Value{String: pointerOf("a")}}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("negated", func(t *testing.T) {
+		v, err := Parse(`!(name between "a" and "b" || $owner NOT BETWEEN "0xA" AND "0xB")`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{Between: &Between{Var: "name", IsNot: true, Low: Value{String: pointerOf("a")}, High: Value{String: pointerOf("b")}}},
+				{Between: &Between{Var: "$owner", Low: Value{String: pointerOf("0xa")}, High: Value{String: pointerOf("0xb")}}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("mixed types", func(t *testing.T) {
+		_, err := Parse(`a = 1 || (price BETWEEN 10 AND "20")`, log)
+		require.ErrorContains(t, err, "same type")
+	})
+}
+
+func TestParse_Comparison(t *testing.T) {
+	t.Run("attributes", func(t *testing.T) {
+		v, err := Parse(`minBid < $attr(maxBid) && $expiration >= $attr(deadline)`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{Comparison: &Comparison{Left: "minBid", Operator: "<", Right: "maxBid"}},
+				{Comparison: &Comparison{Left: "$expiration", Operator: ">=", Right: "deadline"}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("offset", func(t *testing.T) {
+		v, err := Parse(`$expiration > $createdAtBlock + 1000 || a = $attr(b) - 1`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTAnd{
+				{Terms: []ASTTerm{{Comparison: &Comparison{Left: "$expiration", Operator: ">", Right: "$createdAtBlock", Offset: &Offset{Value: 1000}}}}},
+				{Terms: []ASTTerm{{Comparison: &Comparison{Left: "a", Operator: "=", Right: "b", Offset: &Offset{Negative: true, Value: 1}}}}},
+			},
+			v.Expr.Or.Terms,
+		)
+	})
+
+	t.Run("negated", func(t *testing.T) {
+		v, err := Parse(`!(a < $attr(b) || a != $attr(b))`, log)
+		require.NoError(t, err)
+
+		require.Equal(
+			t,
+			[]ASTTerm{
+				{Comparison: &Comparison{Left: "a", Operator: ">=", Right: "b"}},
+				{Comparison: &Comparison{Left: "a", Operator: "=", Right: "b"}},
+			},
+			v.Expr.Or.Terms[0].Terms,
+		)
+	})
+
+	t.Run("unmarked attribute", func(t *testing.T) {
+		_, err := Parse(`name = foo`, log)
+		require.Error(t, err)
+	})
+
+	t.Run("offset of a string attribute", func(t *testing.T) {
+		_, err := Parse(`a < $owner + 1`, log)
+		require.ErrorContains(t, err, "$owner")
+	})
+}
@@ -0,0 +1,83 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MixedEvaluator evaluates every branch of the top-level disjunction of a
+// query with its own evaluator. The branches are combined like in the
+// TablesEvaluator, a branch for the ExistsEvaluator selects the live payloads
+// that meet its conditions instead of starting from the attribute indexes.
+type MixedEvaluator struct {
+	// The evaluator of each branch, in the order of the query
+	Branches []QueryEvaluator
+}
+
+var _ QueryEvaluator = MixedEvaluator{}
+
+func (e MixedEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQuery, error) {
+	return TablesEvaluator{}.evaluate(ast, options, e.evaluateExpr)
+}
+
+func (e MixedEvaluator) evaluateExpr(expr *ASTExpr, b *QueryBuilder) (string, error) {
+	if len(expr.Or.Terms) != len(e.Branches) {
+		return "", fmt.Errorf("query has %d branches for %d evaluators", len(expr.Or.Terms), len(e.Branches))
+	}
+
+	b.queryBuilder.WriteString("WITH ")
+
+	tableName := ""
+	for i := range expr.Or.Terms {
+		branchTable, err := e.evaluateBranch(&expr.Or.Terms[i], e.Branches[i], b)
+		if err != nil {
+			return "", err
+		}
+
+		if i == 0 {
+			tableName = branchTable
+			continue
+		}
+
+		leftTable := tableName
+		tableName = b.nextTableName()
+
+		b.writeComma()
+		fmt.Fprintf(b.queryBuilder, "%s AS (SELECT * FROM %s UNION SELECT * FROM %s)", tableName, leftTable, branchTable)
+	}
+
+	return tableName, nil
+}
+
+// evaluateBranch writes the table of the entities that match the branch.
+func (e MixedEvaluator) evaluateBranch(and *ASTAnd, evaluator QueryEvaluator, b *QueryBuilder) (string, error) {
+	switch evaluator.(type) {
+	case TablesEvaluator:
+		return TablesEvaluator{}.EvaluateAnd(and, b), nil
+
+	case ExistsEvaluator:
+		// The conditions are written on their own, since the table can only be
+		// written once they are complete. The arguments are numbered, so they
+		// can still be pushed in between.
+		queryBuilder := b.queryBuilder
+		conditions := &strings.Builder{}
+		b.queryBuilder = conditions
+		err := ExistsEvaluator{}.addAndConditions(and, b)
+		b.queryBuilder = queryBuilder
+		if err != nil {
+			return "", err
+		}
+
+		blockArg := b.PushArgument(b.options.AtBlock)
+
+		return b.createLeafQuery(fmt.Sprintf(
+			"SELECT e.entity_id, e.from_block FROM payloads AS e%s WHERE %s BETWEEN e.from_block AND e.to_block - 1 AND (%s)",
+			metadataJoin(blockArg),
+			blockArg,
+			conditions.String(),
+		)), nil
+
+	default:
+		return "", fmt.Errorf("unsupported evaluator for a branch: %T", evaluator)
+	}
+}
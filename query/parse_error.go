@@ -0,0 +1,265 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// ParseError describes where and why a query couldn't be parsed. It can be
+// serialised to return it as structured data.
+type ParseError struct {
+	// The position of the offending token, lines and columns start at 1 and
+	// the offset at 0
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Offset int `json:"offset"`
+	// The offending token, empty at the end of the query
+	Token string `json:"token,omitempty"`
+	// The tokens that would have been valid at the position, if known
+	Expected []string `json:"expected,omitempty"`
+	Message  string   `json:"message"`
+	// A hint on how to fix common mistakes
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+	if e.Suggestion != "" {
+		msg += ": " + e.Suggestion
+	}
+	return msg
+}
+
+// syntheticAttributes are the attributes that can be used in queries with a
+// $ prefix.
+var syntheticAttributes = []string{
+	OwnerAttributeKey,
+	CreatorAttributeKey,
+	KeyAttributeKey,
+	ExpirationAttributeKey,
+	SequenceAttributeKey,
+	CreatedAtBlockKey,
+	TxIndexAttributeKey,
+	OpIndexAttributeKey,
+	ContentTypeAttributeKey,
+	PayloadSizeAttributeKey,
+}
+
+// The grammar rules that show up in the expectations of participle, and the
+// tokens they start with
+var expectedRules = map[string][]string{
+	"Value":  {"<string>", "<number>", "<entitykey>", "<address>", "<placeholder>"},
+	"Values": {`"("`, "<placeholder>"},
+	"Offset": {"<plus>", "<minus>"},
+}
+
+var expectedPattern = regexp.MustCompile(`\(expected (.*)\)$`)
+
+// participle only reports the expectation of one of the alternatives that got
+// the furthest, so after operators and connectives the expected tokens are
+// derived from the preceding text instead.
+var (
+	afterOperatorPattern   = regexp.MustCompile(`(=|<|>)\s*$`)
+	afterConnectivePattern = regexp.MustCompile(`(&&|\|\||\(|!)\s*$`)
+	termTokens             = []string{`"("`, `"!"`, `"exists"`, "<ident>", "<synthetic>"}
+	valueTokens            = append(slices.Clone(expectedRules["Value"]), "<synthetic>", `"$attr"`)
+)
+
+// newParseError converts the errors of the lexer and the parser into a
+// ParseError, other errors are returned as is.
+func newParseError(query string, err error) error {
+	var perr participle.Error
+	if !errors.As(err, &perr) {
+		return err
+	}
+
+	pos := perr.Position()
+	before := query[:min(pos.Offset, len(query))]
+	parseError := &ParseError{
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Offset:  pos.Offset,
+		Message: perr.Message(),
+	}
+
+	var unexpected *participle.UnexpectedTokenError
+	var lexerError *lexer.Error
+	switch {
+	case errors.As(err, &unexpected):
+		parseError.Message = "unexpected end of query"
+		if !unexpected.Unexpected.EOF() {
+			parseError.Token = unexpected.Unexpected.Value
+			parseError.Message = fmt.Sprintf("unexpected token %q", parseError.Token)
+		}
+
+		switch {
+		case afterOperatorPattern.MatchString(before):
+			parseError.Expected = valueTokens
+		case afterConnectivePattern.MatchString(before):
+			parseError.Expected = termTokens
+		default:
+			if match := expectedPattern.FindStringSubmatch(perr.Message()); match != nil {
+				parseError.Expected = expectedTokens(match[1])
+			}
+		}
+		if len(parseError.Expected) > 0 {
+			parseError.Message += ", expected " + strings.Join(parseError.Expected, " or ")
+		}
+	case errors.As(err, &lexerError):
+		// The lexer reports the rest of the query, the token is the part up
+		// to the next space
+		parseError.Token, _, _ = strings.Cut(query[len(before):], " ")
+		parseError.Message = fmt.Sprintf("invalid input %q", parseError.Token)
+	}
+
+	parseError.Suggestion = suggest(before, parseError.Token)
+
+	return parseError
+}
+
+// expectedTokens returns the tokens that the expectation of participle starts
+// with, like ["<ident>", "<synthetic>"] for "(<ident> | <synthetic>) <rparen>".
+func expectedTokens(expectation string) []string {
+	tokens := []string{}
+	seen := map[string]bool{}
+
+	var collect func(string)
+	collect = func(expectation string) {
+		for _, alternative := range splitTopLevel(expectation, '|') {
+			first := splitTopLevel(alternative, ' ')[0]
+			first = strings.TrimRight(first, "?*+!")
+
+			switch {
+			case first == "":
+			case strings.HasPrefix(first, "(") && strings.HasSuffix(first, ")"):
+				collect(first[1 : len(first)-1])
+			case expectedRules[first] != nil:
+				for _, token := range expectedRules[first] {
+					collect(token)
+				}
+			default:
+				// Keywords are accepted in upper and lower case
+				if !seen[strings.ToUpper(first)] {
+					seen[strings.ToUpper(first)] = true
+					tokens = append(tokens, first)
+				}
+			}
+		}
+	}
+	collect(expectation)
+
+	return tokens
+}
+
+// splitTopLevel splits the expectation at the separator, ignoring the
+// separators within parentheses and quotes.
+func splitTopLevel(expectation string, separator rune) []string {
+	parts := []string{}
+	depth := 0
+	quoted := false
+	start := 0
+	for i, r := range expectation {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == separator && depth == 0:
+			parts = append(parts, strings.TrimSpace(expectation[start:i]))
+			start = i + 1
+		}
+	}
+	parts = append(parts, strings.TrimSpace(expectation[start:]))
+
+	return parts
+}
+
+// A bare word after an operator, like foo in name = foo
+var (
+	operatorPattern  = regexp.MustCompile(`(=|<|>|~)\s*$`)
+	bareWordPattern  = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_]*$`)
+	unquotedValueTip = `string values need to be quoted, like "value"`
+)
+
+// suggest returns a hint for common mistakes, given the query up to the
+// offending token.
+func suggest(before string, token string) string {
+	switch {
+	case strings.HasPrefix(token, "&") && !strings.HasPrefix(token, "&&"):
+		return "use && to combine terms"
+	case strings.HasPrefix(token, "|") && !strings.HasPrefix(token, "||"):
+		return "use || to combine alternatives"
+	case strings.HasPrefix(token, "'"):
+		return `strings need to be quoted with double quotes, like "value"`
+	case strings.HasPrefix(token, "$"):
+		return suggestSyntheticAttribute(token)
+	case operatorPattern.MatchString(before) && bareWordPattern.MatchString(token):
+		// Only comparisons can have an attribute on the right
+		if strings.HasSuffix(strings.TrimSpace(before), "~") {
+			return unquotedValueTip
+		}
+		return unquotedValueTip + ", or attributes marked, like $attr(" + token + ")"
+	default:
+		return ""
+	}
+}
+
+func suggestSyntheticAttribute(token string) string {
+	name := strings.TrimRightFunc(token, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	// Strip anything after the name, like in $ownr=
+	if i := strings.IndexFunc(name[1:], func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}); i >= 0 {
+		name = name[:i+1]
+	}
+
+	closest, distance := "", len(name)
+	for _, attribute := range syntheticAttributes {
+		d := editDistance(strings.ToLower(name), strings.ToLower(attribute))
+		if d < distance {
+			closest, distance = attribute, d
+		}
+	}
+
+	if closest != "" && distance <= 2 {
+		return fmt.Sprintf("unknown attribute %s, did you mean %s?", name, closest)
+	}
+	return fmt.Sprintf("unknown attribute %s, the attributes starting with $ are %s", name, strings.Join(syntheticAttributes, ", "))
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	ar, br := []rune(a), []rune(b)
+
+	previous := make([]int, len(br)+1)
+	current := make([]int, len(br)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := range ar {
+		current[0] = i + 1
+		for j := range br {
+			cost := 1
+			if ar[i] == br[j] {
+				cost = 0
+			}
+			current[j+1] = min(previous[j+1]+1, current[j]+1, previous[j]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(br)]
+}
@@ -0,0 +1,153 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected ParseError
+	}{
+		{
+			query: `a = 1 & b = 2`,
+			expected: ParseError{
+				Line: 1, Column: 7, Offset: 6,
+				Token:      "&",
+				Message:    `invalid input "&"`,
+				Suggestion: "use && to combine terms",
+			},
+		},
+		{
+			query: `a = 1 | b = 2`,
+			expected: ParseError{
+				Line: 1, Column: 7, Offset: 6,
+				Token:      "|",
+				Message:    `invalid input "|"`,
+				Suggestion: "use || to combine alternatives",
+			},
+		},
+		{
+			query: `$ownr = "0x1"`,
+			expected: ParseError{
+				Line: 1, Column: 1, Offset: 0,
+				Token:      "$ownr",
+				Message:    `invalid input "$ownr"`,
+				Suggestion: "unknown attribute $ownr, did you mean $owner?",
+			},
+		},
+		{
+			query: `name = foo`,
+			expected: ParseError{
+				Line: 1, Column: 8, Offset: 7,
+				Token:      "foo",
+				Expected:   []string{"<string>", "<number>", "<entitykey>", "<address>", "<placeholder>", "<synthetic>", `"$attr"`},
+				Message:    `unexpected token "foo", expected <string> or <number> or <entitykey> or <address> or <placeholder> or <synthetic> or "$attr"`,
+				Suggestion: `string values need to be quoted, like "value", or attributes marked, like $attr(foo)`,
+			},
+		},
+		{
+			query: `name ~ foo`,
+			expected: ParseError{
+				Line: 1, Column: 8, Offset: 7,
+				Token:      "foo",
+				Expected:   []string{"<string>", "<placeholder>"},
+				Message:    `unexpected token "foo", expected <string> or <placeholder>`,
+				Suggestion: `string values need to be quoted, like "value"`,
+			},
+		},
+		{
+			query: "a = 1 &&\n  name = foo",
+			expected: ParseError{
+				Line: 2, Column: 10, Offset: 18,
+				Token:      "foo",
+				Expected:   []string{"<string>", "<number>", "<entitykey>", "<address>", "<placeholder>", "<synthetic>", `"$attr"`},
+				Message:    `unexpected token "foo", expected <string> or <number> or <entitykey> or <address> or <placeholder> or <synthetic> or "$attr"`,
+				Suggestion: `string values need to be quoted, like "value", or attributes marked, like $attr(foo)`,
+			},
+		},
+		{
+			query: `name = 'test'`,
+			expected: ParseError{
+				Line: 1, Column: 8, Offset: 7,
+				Token:      "'test'",
+				Message:    `invalid input "'test'"`,
+				Suggestion: `strings need to be quoted with double quotes, like "value"`,
+			},
+		},
+		{
+			query: `a IN 1`,
+			expected: ParseError{
+				Line: 1, Column: 6, Offset: 5,
+				Token:    "1",
+				Expected: []string{`"("`, "<placeholder>"},
+				Message:  `unexpected token "1", expected "(" or <placeholder>`,
+			},
+		},
+		{
+			query: `(a = 1`,
+			expected: ParseError{
+				Line: 1, Column: 7, Offset: 6,
+				Expected: []string{"<rparen>"},
+				Message:  "unexpected end of query, expected <rparen>",
+			},
+		},
+		{
+			query: `a = 1 && `,
+			expected: ParseError{
+				Line: 1, Column: 10, Offset: 9,
+				Expected: termTokens,
+				Message:  `unexpected end of query, expected "(" or "!" or "exists" or <ident> or <synthetic>`,
+			},
+		},
+		{
+			query: `a BETWEEN 1`,
+			expected: ParseError{
+				Line: 1, Column: 12, Offset: 11,
+				Expected: []string{`"AND"`},
+				Message:  `unexpected end of query, expected "AND"`,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := Parse(tc.query, log)
+
+			var parseError *ParseError
+			require.True(t, errors.As(err, &parseError), "unexpected error %v", err)
+			require.Equal(t, tc.expected, *parseError)
+		})
+	}
+}
+
+func TestParse_ErrorsSuggestAttributes(t *testing.T) {
+	_, err := Parse(`$foo = 1`, log)
+
+	var parseError *ParseError
+	require.ErrorAs(t, err, &parseError)
+	require.Contains(t, parseError.Suggestion, "unknown attribute $foo")
+	for _, attribute := range syntheticAttributes {
+		require.Contains(t, parseError.Suggestion, attribute)
+	}
+}
+
+func TestParseError_JSON(t *testing.T) {
+	_, err := Parse(`(a = 1`, log)
+
+	var parseError *ParseError
+	require.ErrorAs(t, err, &parseError)
+	require.Equal(t, "1:7: unexpected end of query, expected <rparen>", parseError.Error())
+
+	encoded, err := json.Marshal(parseError)
+	require.NoError(t, err)
+	require.JSONEq(
+		t,
+		`{"line":1,"column":7,"offset":6,"expected":["<rparen>"],"message":"unexpected end of query, expected <rparen>"}`,
+		string(encoded),
+	)
+}
@@ -0,0 +1,245 @@
+package query
+
+import (
+	"fmt"
+)
+
+// Names of the evaluators that can be forced through Options.Evaluator.
+const (
+	EvaluatorAuto   = ""
+	EvaluatorExists = "exists"
+	EvaluatorTables = "tables"
+)
+
+// EvaluatorMixed is the name of the MixedEvaluator, which the planner chooses
+// per query and which therefore can't be forced.
+const EvaluatorMixed = "mixed"
+
+// DefaultSelectivityThreshold is the estimated fraction of live entities
+// below which a query is driven from the attribute indexes.
+const DefaultSelectivityThreshold = 0.05
+
+// AttributeStatistics describes the live values of one attribute.
+type AttributeStatistics struct {
+	// The number of live entities that carry the attribute
+	Entities uint64
+	// The (estimated) number of distinct values of the attribute
+	DistinctValues uint64
+}
+
+// Statistics provides the planner with estimates about the stored data.
+type Statistics interface {
+	// Entities returns the number of live entities.
+	Entities() uint64
+	// Attribute returns the statistics of the string or numeric attribute with
+	// the given name. It returns false if no live entity carries it.
+	Attribute(name string, numeric bool) (AttributeStatistics, bool)
+}
+
+// Planner picks the evaluator for every branch of the top-level disjunction of
+// a query based on how many entities the branch is estimated to match.
+// Branches that only match a few entities are evaluated with the
+// TablesEvaluator, which starts from the attribute indexes, while all other
+// branches use the ExistsEvaluator, which walks the payloads in order and
+// stops as soon as a page is full. Queries with branches for both are
+// evaluated with the MixedEvaluator.
+type Planner struct {
+	// Without statistics the planner always picks the ExistsEvaluator
+	Statistics Statistics
+	// Defaults to DefaultSelectivityThreshold
+	Threshold float64
+}
+
+var _ QueryEvaluator = Planner{}
+
+// Evaluator returns the evaluator with the given name, or the one that the
+// planner chooses for the query for EvaluatorAuto.
+func (p Planner) Evaluator(ast *AST, name string) (QueryEvaluator, error) {
+	switch name {
+	case EvaluatorAuto:
+		return p.Choose(ast), nil
+	case EvaluatorExists:
+		return ExistsEvaluator{}, nil
+	case EvaluatorTables:
+		return TablesEvaluator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown evaluator: %q", name)
+	}
+}
+
+func (p Planner) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQuery, error) {
+	return p.Choose(ast).EvaluateAST(ast, options)
+}
+
+// Choose returns the evaluator that is expected to be the cheapest for the
+// query.
+func (p Planner) Choose(ast *AST) QueryEvaluator {
+	if p.Statistics == nil || ast.Expr == nil {
+		return ExistsEvaluator{}
+	}
+
+	threshold := p.Threshold
+	if threshold == 0 {
+		threshold = DefaultSelectivityThreshold
+	}
+
+	total := float64(p.Statistics.Entities())
+
+	branches := make([]QueryEvaluator, 0, len(ast.Expr.Or.Terms))
+	selective := 0
+	for i := range ast.Expr.Or.Terms {
+		if total == 0 || p.andSelectivity(&ast.Expr.Or.Terms[i], total) <= threshold {
+			branches = append(branches, TablesEvaluator{})
+			selective++
+		} else {
+			branches = append(branches, ExistsEvaluator{})
+		}
+	}
+
+	switch selective {
+	case 0:
+		return ExistsEvaluator{}
+	case len(branches):
+		return TablesEvaluator{}
+	default:
+		return MixedEvaluator{Branches: branches}
+	}
+}
+
+// Selectivity estimates the fraction of live entities that match the query.
+func (p Planner) Selectivity(ast *AST) float64 {
+	if p.Statistics == nil || ast.Expr == nil {
+		return 1
+	}
+
+	total := float64(p.Statistics.Entities())
+	if total == 0 {
+		return 0
+	}
+
+	return p.orSelectivity(&ast.Expr.Or, total)
+}
+
+func (p Planner) orSelectivity(or *ASTOr, total float64) float64 {
+	selectivity := 0.0
+	for i := range or.Terms {
+		selectivity += p.andSelectivity(&or.Terms[i], total)
+	}
+
+	return min(selectivity, 1)
+}
+
+// andSelectivity estimates an intersection, which can't be larger than its
+// most selective term.
+func (p Planner) andSelectivity(and *ASTAnd, total float64) float64 {
+	selectivity := 1.0
+	for i := range and.Terms {
+		selectivity = min(selectivity, p.termSelectivity(&and.Terms[i], total))
+	}
+
+	return selectivity
+}
+
+func (p Planner) termSelectivity(term *ASTTerm, total float64) float64 {
+	if term.Or != nil {
+		return p.orSelectivity(term.Or, total)
+	}
+
+	if term.Exists != nil {
+		return p.existsSelectivity(term.Exists, total)
+	}
+
+	if term.Comparison != nil {
+		return p.comparisonSelectivity(term.Comparison, total)
+	}
+
+	var (
+		name    string
+		numeric bool
+		// The number of distinct values the term matches, 0 for ranges
+		values int
+		// Whether the term matches every value except the given ones
+		negated bool
+	)
+
+	switch {
+	case term.Assign != nil:
+		name, numeric = term.Assign.Var, term.Assign.Value.Number != nil
+		values, negated = 1, term.Assign.IsNot
+	case term.Inclusion != nil:
+		name, numeric = term.Inclusion.Var, len(term.Inclusion.Values.Numbers) > 0
+		values = max(len(term.Inclusion.Values.Strings), len(term.Inclusion.Values.Numbers))
+		negated = term.Inclusion.IsNot
+	case term.LessThan != nil:
+		name, numeric = term.LessThan.Var, term.LessThan.Value.Number != nil
+	case term.LessOrEqualThan != nil:
+		name, numeric = term.LessOrEqualThan.Var, term.LessOrEqualThan.Value.Number != nil
+	case term.GreaterThan != nil:
+		name, numeric = term.GreaterThan.Var, term.GreaterThan.Value.Number != nil
+	case term.GreaterOrEqualThan != nil:
+		name, numeric = term.GreaterOrEqualThan.Var, term.GreaterOrEqualThan.Value.Number != nil
+	case term.Between != nil:
+		name, numeric = term.Between.Var, term.Between.Low.Number != nil
+		negated = term.Between.IsNot
+	case term.Glob != nil:
+		name, negated = term.Glob.Var, term.Glob.IsNot
+	default:
+		return 1
+	}
+
+	// The metadata attributes, like the owner, are not stored as attributes,
+	// so there are no statistics for them
+	if _, ok := getMetadataAttribute(name); ok {
+		return 1
+	}
+
+	stats, ok := p.Statistics.Attribute(name, numeric)
+	if !ok {
+		return 0
+	}
+
+	withAttribute := min(float64(stats.Entities)/total, 1)
+
+	switch {
+	case negated:
+		return withAttribute
+	case values > 0 && stats.DistinctValues > 0:
+		return min(withAttribute*float64(values)/float64(stats.DistinctValues), withAttribute)
+	default:
+		// Without a histogram, assume that a range or pattern matches a third
+		// of the values
+		return withAttribute / 3
+	}
+}
+
+// comparisonSelectivity assumes that a comparison matches a third of the
+// entities that have both attributes, or all of them for !=.
+func (p Planner) comparisonSelectivity(term *Comparison, total float64) float64 {
+	withAttributes := 1.0
+	for _, name := range []string{term.Left, term.Right} {
+		withAttributes = min(withAttributes, p.existsSelectivity(&Exists{Var: name}, total))
+	}
+
+	if term.Operator == "!=" {
+		return withAttributes
+	}
+	return withAttributes / 3
+}
+
+func (p Planner) existsSelectivity(term *Exists, total float64) float64 {
+	withAttribute := 1.0
+	if _, ok := getMetadataAttribute(term.Var); !ok {
+		entities := uint64(0)
+		for _, numeric := range []bool{false, true} {
+			if stats, ok := p.Statistics.Attribute(term.Var, numeric); ok {
+				entities += stats.Entities
+			}
+		}
+		withAttribute = min(float64(entities)/total, 1)
+	}
+
+	if term.IsNot {
+		return 1 - withAttribute
+	}
+	return withAttribute
+}
@@ -0,0 +1,81 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testStatistics struct {
+	entities   uint64
+	attributes map[string]AttributeStatistics
+}
+
+func (s testStatistics) Entities() uint64 {
+	return s.entities
+}
+
+func (s testStatistics) Attribute(name string, numeric bool) (AttributeStatistics, bool) {
+	stats, ok := s.attributes[name]
+	return stats, ok
+}
+
+func TestPlanner_Choose(t *testing.T) {
+	planner := Planner{
+		Statistics: testStatistics{
+			entities: 1000,
+			attributes: map[string]AttributeStatistics{
+				"type":  {Entities: 1000, DistinctValues: 2},
+				"id":    {Entities: 1000, DistinctValues: 1000},
+				"price": {Entities: 1000, DistinctValues: 500},
+			},
+		},
+	}
+
+	cases := []struct {
+		query    string
+		expected QueryEvaluator
+	}{
+		{`$all`, ExistsEvaluator{}},
+		{`type = "a"`, ExistsEvaluator{}},
+		{`id = "a"`, TablesEvaluator{}},
+		{`type = "a" && id = "a"`, TablesEvaluator{}},
+		{`type = "a" || id = "a"`, MixedEvaluator{Branches: []QueryEvaluator{ExistsEvaluator{}, TablesEvaluator{}}}},
+		{`id = "a" || id = "b"`, TablesEvaluator{}},
+		{`type = "a" || price > 10`, ExistsEvaluator{}},
+		{`id != "a"`, ExistsEvaluator{}},
+		{`price > 10`, ExistsEvaluator{}},
+		{`unknown = "a"`, TablesEvaluator{}},
+		{`$owner = "0x1"`, ExistsEvaluator{}},
+		{`exists(id)`, ExistsEvaluator{}},
+		{`!exists(id)`, TablesEvaluator{}},
+		{`!exists(unknown)`, ExistsEvaluator{}},
+		{`exists(unknown)`, TablesEvaluator{}},
+		{`!exists($owner)`, TablesEvaluator{}},
+	}
+
+	for _, c := range cases {
+		ast, err := Parse(c.query, log)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, planner.Choose(ast), c.query)
+	}
+}
+
+func TestPlanner_WithoutStatistics(t *testing.T) {
+	ast, err := Parse(`id = "a"`, log)
+	require.NoError(t, err)
+
+	require.Equal(t, ExistsEvaluator{}, Planner{}.Choose(ast))
+}
+
+func TestPlanner_Evaluator(t *testing.T) {
+	ast, err := Parse(`id = "a"`, log)
+	require.NoError(t, err)
+
+	evaluator, err := Planner{}.Evaluator(ast, EvaluatorTables)
+	require.NoError(t, err)
+	require.Equal(t, TablesEvaluator{}, evaluator)
+
+	_, err = Planner{}.Evaluator(ast, "fastest")
+	require.Error(t, err)
+}
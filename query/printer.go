@@ -0,0 +1,245 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The printer writes queries in a canonical form: operators are written as
+// symbols (&&, ||, !, ~) or upper case keywords (IN, BETWEEN), with single
+// spaces around binary operators and strings quoted as Go string literals.
+// Printing a parsed query gives back a query that parses to the same tree, as
+// long as the attribute names are valid identifiers. Queries that only differ
+// in whitespace or keyword case print the same.
+
+// String prints the query as it was parsed, before normalisation, so the
+// parentheses and negations are kept as they were written.
+func (t *TopLevel) String() string {
+	if t.Expression == nil {
+		return "$all"
+	}
+	return t.Expression.String()
+}
+
+func (e *Expression) String() string {
+	sb := &strings.Builder{}
+	e.Or.print(sb)
+	return sb.String()
+}
+
+func (e *OrExpression) print(sb *strings.Builder) {
+	e.Left.print(sb)
+	for _, rhs := range e.Right {
+		sb.WriteString(" || ")
+		rhs.Expr.print(sb)
+	}
+}
+
+func (e *AndExpression) print(sb *strings.Builder) {
+	e.Left.print(sb)
+	for _, rhs := range e.Right {
+		sb.WriteString(" && ")
+		rhs.Expr.print(sb)
+	}
+}
+
+func (e *EqualExpr) print(sb *strings.Builder) {
+	switch {
+	case e.Paren != nil:
+		if e.Paren.IsNot {
+			sb.WriteString("!")
+		}
+		sb.WriteString("(")
+		e.Paren.Nested.Or.print(sb)
+		sb.WriteString(")")
+	case e.Assign != nil:
+		e.Assign.print(sb)
+	case e.Inclusion != nil:
+		e.Inclusion.print(sb)
+	case e.Between != nil:
+		e.Between.print(sb)
+	case e.LessThan != nil:
+		printTerm(sb, e.LessThan.Var, "<", e.LessThan.Value)
+	case e.LessOrEqualThan != nil:
+		printTerm(sb, e.LessOrEqualThan.Var, "<=", e.LessOrEqualThan.Value)
+	case e.GreaterThan != nil:
+		printTerm(sb, e.GreaterThan.Var, ">", e.GreaterThan.Value)
+	case e.GreaterOrEqualThan != nil:
+		printTerm(sb, e.GreaterOrEqualThan.Var, ">=", e.GreaterOrEqualThan.Value)
+	case e.Glob != nil:
+		e.Glob.print(sb)
+	case e.Exists != nil:
+		e.Exists.print(sb)
+	case e.Comparison != nil:
+		e.Comparison.print(sb)
+	}
+}
+
+// String prints the normalised query. An AST in DNF prints without
+// parentheses, since && binds stronger than ||.
+func (t *AST) String() string {
+	if t.Expr == nil {
+		return "$all"
+	}
+
+	sb := &strings.Builder{}
+	t.Expr.Or.print(sb)
+	return sb.String()
+}
+
+func (e *ASTOr) print(sb *strings.Builder) {
+	for i, and := range e.Terms {
+		if i > 0 {
+			sb.WriteString(" || ")
+		}
+		for j, term := range and.Terms {
+			if j > 0 {
+				sb.WriteString(" && ")
+			}
+			term.print(sb)
+		}
+	}
+}
+
+func (t *ASTTerm) String() string {
+	sb := &strings.Builder{}
+	t.print(sb)
+	return sb.String()
+}
+
+func (t *ASTTerm) print(sb *strings.Builder) {
+	switch {
+	case t.Or != nil:
+		sb.WriteString("(")
+		t.Or.print(sb)
+		sb.WriteString(")")
+	default:
+		// The leaves are the same as in the parse tree
+		leaf := EqualExpr{
+			Assign:             t.Assign,
+			Inclusion:          t.Inclusion,
+			Between:            t.Between,
+			LessThan:           t.LessThan,
+			LessOrEqualThan:    t.LessOrEqualThan,
+			GreaterThan:        t.GreaterThan,
+			GreaterOrEqualThan: t.GreaterOrEqualThan,
+			Glob:               t.Glob,
+			Exists:             t.Exists,
+			Comparison:         t.Comparison,
+		}
+		leaf.print(sb)
+	}
+}
+
+func (e *Equality) print(sb *strings.Builder) {
+	operator := "="
+	if e.IsNot {
+		operator = "!="
+	}
+	printTerm(sb, e.Var, operator, e.Value)
+}
+
+func (e *Inclusion) print(sb *strings.Builder) {
+	sb.WriteString(e.Var)
+	if e.IsNot {
+		sb.WriteString(" NOT")
+	}
+	sb.WriteString(" IN ")
+
+	if e.Values.Placeholder != nil {
+		sb.WriteString(e.Values.Placeholder.String())
+		return
+	}
+
+	sb.WriteString("(")
+	for i, s := range e.Values.Strings {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(strconv.Quote(s))
+	}
+	for i, n := range e.Values.Numbers {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(strconv.FormatUint(n, 10))
+	}
+	sb.WriteString(")")
+}
+
+func (e *Between) print(sb *strings.Builder) {
+	sb.WriteString(e.Var)
+	if e.IsNot {
+		sb.WriteString(" NOT")
+	}
+	sb.WriteString(" BETWEEN ")
+	e.Low.print(sb)
+	sb.WriteString(" AND ")
+	e.High.print(sb)
+}
+
+func (e *Glob) print(sb *strings.Builder) {
+	sb.WriteString(e.Var)
+	if e.IsNot {
+		sb.WriteString(" !~ ")
+	} else {
+		sb.WriteString(" ~ ")
+	}
+
+	if e.Placeholder != nil {
+		sb.WriteString(e.Placeholder.String())
+	} else {
+		sb.WriteString(strconv.Quote(e.Value))
+	}
+}
+
+func (e *Exists) print(sb *strings.Builder) {
+	if e.IsNot {
+		sb.WriteString("!")
+	}
+	sb.WriteString("exists(")
+	sb.WriteString(e.Var)
+	sb.WriteString(")")
+}
+
+func (e *Comparison) print(sb *strings.Builder) {
+	sb.WriteString(e.Left)
+	sb.WriteString(" ")
+	sb.WriteString(e.Operator)
+	sb.WriteString(" ")
+	if strings.HasPrefix(e.Right, "$") {
+		sb.WriteString(e.Right)
+	} else {
+		sb.WriteString("$attr(")
+		sb.WriteString(e.Right)
+		sb.WriteString(")")
+	}
+
+	if e.Offset != nil {
+		if e.Offset.Negative {
+			sb.WriteString(" - ")
+		} else {
+			sb.WriteString(" + ")
+		}
+		sb.WriteString(strconv.FormatUint(e.Offset.Value, 10))
+	}
+}
+
+func printTerm(sb *strings.Builder, name string, operator string, value Value) {
+	sb.WriteString(name)
+	sb.WriteString(" ")
+	sb.WriteString(operator)
+	sb.WriteString(" ")
+	value.print(sb)
+}
+
+func (v Value) print(sb *strings.Builder) {
+	switch {
+	case v.Placeholder != nil:
+		sb.WriteString(v.Placeholder.String())
+	case v.String != nil:
+		sb.WriteString(strconv.Quote(*v.String))
+	case v.Number != nil:
+		sb.WriteString(strconv.FormatUint(*v.Number, 10))
+	}
+}
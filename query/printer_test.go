@@ -0,0 +1,205 @@
+package query
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrint(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{`$all`, `$all`},
+		{`a=1 and b  !=  "x"`, `a = 1 && b != "x"`},
+		{`!(a = 1 OR b < 2)`, `a != 1 && b >= 2`},
+		{`a in ("x" "y") || b NOT IN (1 2)`, `a IN ("x" "y") || b NOT IN (1 2)`},
+		{`(a = 1 || b = 2) && c glob "x*"`, `a = 1 && c ~ "x*" || b = 2 && c ~ "x*"`},
+		{`not exists(a) && b between 1 and 2`, `!exists(a) && b BETWEEN 1 AND 2`},
+		{`$expiration > $createdAtBlock+10 && $owner = $1`, `$expiration > $createdAtBlock + 10 && $owner = $1`},
+		{`$owner = 0x000000000000000000000000000000000000ABCD`, `$owner = "0x000000000000000000000000000000000000abcd"`},
+	}
+
+	for _, c := range cases {
+		ast, err := Parse(c.query, log)
+		require.NoError(t, err, c.query)
+		require.Equal(t, c.expected, ast.String(), c.query)
+	}
+}
+
+func TestPrint_TopLevel(t *testing.T) {
+	top, err := Parser.ParseString("", `NOT (a = 1 or b = "x")  AND  c in (1 2)`)
+	require.NoError(t, err)
+
+	require.Equal(t, `!(a = 1 || b = "x") && c IN (1 2)`, top.String())
+}
+
+// queryGenerator writes random queries. The structure of the query only
+// depends on structure, while whitespace and the choice between equivalent
+// keywords only depend on style, so that the same structure can be written
+// in different ways.
+type queryGenerator struct {
+	structure *rand.Rand
+	style     *rand.Rand
+}
+
+func (g queryGenerator) pick(options ...string) string {
+	return options[g.style.IntN(len(options))]
+}
+
+func (g queryGenerator) space() string {
+	return g.pick("", " ", "  ", "\n")
+}
+
+func (g queryGenerator) spaced(s string) string {
+	return g.pick(" ", "  ", "\n") + s + g.pick(" ", "  ", "\n")
+}
+
+func (g queryGenerator) name() string {
+	return []string{"a", "b", "price", "$owner", "$createdAtBlock", "$contentType", "déçevant"}[g.structure.IntN(7)]
+}
+
+func (g queryGenerator) value() string {
+	switch g.structure.IntN(4) {
+	case 0:
+		return strconv.Quote([]string{"x", `it's "quoted"`, "tab\there", "0xABCD", "é*"}[g.structure.IntN(5)])
+	case 1:
+		return fmt.Sprintf("$%d", g.structure.IntN(3)+1)
+	default:
+		return strconv.FormatUint(g.structure.Uint64N(1000), 10)
+	}
+}
+
+func (g queryGenerator) number() string {
+	return strconv.FormatUint(g.structure.Uint64N(1000), 10)
+}
+
+func (g queryGenerator) term() string {
+	name := g.name()
+	switch g.structure.IntN(9) {
+	case 0:
+		return name + g.space() + []string{"=", "!="}[g.structure.IntN(2)] + g.space() + g.value()
+	case 1:
+		return name + g.space() + []string{"<", "<=", ">", ">="}[g.structure.IntN(4)] + g.space() + g.value()
+	case 2:
+		values := []string{}
+		for range g.structure.IntN(3) + 1 {
+			values = append(values, g.number())
+		}
+		not := ""
+		if g.structure.IntN(2) == 0 {
+			not = g.spaced(g.pick("NOT", "not"))
+		} else {
+			not = " "
+		}
+		return name + not + g.pick("IN", "in") + g.space() + "(" + strings.Join(values, " ") + ")"
+	case 3:
+		if g.structure.IntN(2) == 0 {
+			return name + g.space() + g.pick("~", " glob ", " GLOB ") + g.space() + `"x*"`
+		}
+		return name + g.pick(g.space()+"!~", " NOT GLOB", " not glob") + g.space() + `"x*"`
+	case 4:
+		not := ""
+		if g.structure.IntN(2) == 0 {
+			not = g.pick("!", "NOT ", "not ")
+		}
+		return not + g.pick("exists", "EXISTS") + "(" + g.space() + name + g.space() + ")"
+	case 5:
+		not := " "
+		if g.structure.IntN(2) == 0 {
+			not = g.spaced(g.pick("NOT", "not"))
+		}
+		return name + not + g.pick("BETWEEN", "between") + " " + g.number() + g.spaced(g.pick("AND", "and")) + g.number()
+	case 6:
+		// Offsets can only be added to numeric attributes
+		name = []string{"a", "price", "$createdAtBlock"}[g.structure.IntN(3)]
+		offset := ""
+		switch g.structure.IntN(3) {
+		case 0:
+			offset = g.space() + "+" + g.space() + g.number()
+		case 1:
+			offset = g.space() + "-" + g.space() + g.number()
+		}
+		return name + g.space() + []string{"=", "!=", "<", "<=", ">", ">="}[g.structure.IntN(6)] + g.space() + "$attr(" + g.space() + "b" + g.space() + ")" + offset
+	default:
+		return name + g.space() + "=" + g.space() + g.value()
+	}
+}
+
+func (g queryGenerator) expression(depth int) string {
+	if depth == 0 || g.structure.IntN(3) == 0 {
+		return g.term()
+	}
+
+	terms := []string{}
+	for range g.structure.IntN(3) + 1 {
+		term := g.expression(depth - 1)
+		switch g.structure.IntN(3) {
+		case 0:
+			term = "(" + g.space() + term + g.space() + ")"
+		case 1:
+			term = g.pick("!", "NOT ", "not ") + "(" + term + ")"
+		}
+		terms = append(terms, term)
+	}
+
+	operator := []string{"&&", "||"}[g.structure.IntN(2)]
+	joined := terms[0]
+	for _, term := range terms[1:] {
+		if operator == "&&" {
+			joined += g.spaced(g.pick("&&", "AND", "and")) + term
+		} else {
+			joined += g.spaced(g.pick("||", "OR", "or")) + term
+		}
+	}
+	return joined
+}
+
+func TestPrint_RoundTrip(t *testing.T) {
+	for seed := range uint64(500) {
+		generate := func(style uint64) string {
+			return queryGenerator{
+				structure: rand.New(rand.NewPCG(seed, 0)),
+				style:     rand.New(rand.NewPCG(seed, style)),
+			}.expression(3)
+		}
+		q := generate(1)
+
+		top, err := Parser.ParseString("", q)
+		require.NoError(t, err, q)
+
+		// The parse tree survives printing and parsing
+		printed := top.String()
+		reparsed, err := Parser.ParseString("", printed)
+		require.NoError(t, err, printed)
+		require.Equal(t, top, reparsed, q)
+
+		ast, err := Parse(q, log)
+		if err != nil {
+			require.ErrorIs(t, err, ErrQueryTooComplex, q)
+			continue
+		}
+
+		// The AST survives printing and parsing, and prints the same again
+		canonical := ast.String()
+		reparsedAST, err := Parse(canonical, log)
+		require.NoError(t, err, canonical)
+		require.Equal(t, ast, reparsedAST, q)
+		require.Equal(t, canonical, reparsedAST.String(), q)
+
+		// The same query written differently prints the same
+		other := generate(2)
+		otherTop, err := Parser.ParseString("", other)
+		require.NoError(t, err, other)
+		require.Equal(t, printed, otherTop.String(), other)
+
+		otherAST, err := Parse(other, log)
+		require.NoError(t, err, other)
+		require.Equal(t, canonical, otherAST.String(), other)
+	}
+}
@@ -67,6 +67,93 @@ func (b *QueryBuilder) GetOptions() *QueryOptions {
 	return &b.options
 }
 
+// writeMetadataJoin joins the owner and expiration of the entity that are valid
+// at the queried block. Since an entity only has entity_metadata rows while it
+// is alive, this also filters out entities that have expired.
+func (b *QueryBuilder) writeMetadataJoin(blockArg string) {
+	b.queryBuilder.WriteString(metadataJoin(blockArg))
+}
+
+func metadataJoin(blockArg string) string {
+	return fmt.Sprintf(
+		" INNER JOIN entity_metadata AS m"+
+			" ON m.entity_id = e.entity_id"+
+			" AND %s BETWEEN m.from_block AND m.to_block - 1",
+		blockArg,
+	)
+}
+
+// attributeNameID is the SQL expression that looks up the id of the attribute
+// name in the given argument. SQLite evaluates it only once per query.
+func attributeNameID(nameArg string) string {
+	return fmt.Sprintf("(SELECT n.id FROM attribute_names AS n WHERE n.name = %s)", nameArg)
+}
+
+// comparisonCondition is the condition that compares two attributes of the
+// payload with the given alias. An attribute that the entity doesn't have is
+// NULL, so the condition only holds if both attributes exist with the same
+// type.
+func (b *QueryBuilder) comparisonCondition(c *Comparison, metadataAlias string, payloadAlias string) string {
+	conditions := make([]string, 0, 2)
+	for _, numeric := range []bool{true, false} {
+		if !numeric && c.Offset != nil {
+			continue
+		}
+		if !canHaveType(c.Left, numeric) || !canHaveType(c.Right, numeric) {
+			continue
+		}
+
+		left := b.attributeValue(c.Left, numeric, metadataAlias, payloadAlias)
+		right := b.attributeValue(c.Right, numeric, metadataAlias, payloadAlias)
+		if c.Offset != nil {
+			sign := "+"
+			if c.Offset.Negative {
+				sign = "-"
+			}
+			right = fmt.Sprintf("%s %s %s", right, sign, b.PushArgument(c.Offset.Value))
+		}
+
+		conditions = append(conditions, fmt.Sprintf("%s %s %s", left, c.Operator, right))
+	}
+
+	if len(conditions) == 0 {
+		return "FALSE"
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// canHaveType returns whether the attribute can be of the given type, which
+// is fixed for the metadata attributes.
+func canHaveType(name string, numeric bool) bool {
+	if attr, ok := getMetadataAttribute(name); ok {
+		return attr.Numeric == numeric
+	}
+	return true
+}
+
+// attributeValue is the SQL expression of the value of the attribute of the
+// payload with the given alias, which is NULL if the payload doesn't have it.
+func (b *QueryBuilder) attributeValue(name string, numeric bool, metadataAlias string, payloadAlias string) string {
+	if attr, ok := getMetadataAttribute(name); ok {
+		return attr.selector(metadataAlias, payloadAlias)
+	}
+
+	tableName := "string_attributes"
+	if numeric {
+		tableName = "numeric_attributes"
+	}
+
+	nameArg := b.PushArgument(name)
+
+	return fmt.Sprintf(
+		"(SELECT a.value FROM %[1]s AS a INDEXED BY %[1]s_entity_kv_idx"+
+			" WHERE a.entity_id = %[2]s.entity_id AND a.from_block = %[2]s.from_block AND a.name_id = %[3]s)",
+		tableName,
+		payloadAlias,
+		attributeNameID(nameArg),
+	)
+}
+
 func AddPaginationArguments(b Builder) error {
 	paginationConditions := []string{}
 
@@ -86,7 +173,7 @@ func AddPaginationArguments(b Builder) error {
 				var operator string
 				if j < i {
 					operator = "="
-				} else if from.Descending {
+				} else if from.Descending != b.GetOptions().Backward {
 					operator = "<"
 				} else {
 					operator = ">"
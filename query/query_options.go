@@ -44,6 +44,16 @@ type QueryOptions struct {
 	OrderBy            []OrderBy
 	OrderByAnnotations []OrderByAnnotation
 	Cursor             []CursorValue
+	// Whether the cursor points backward, the rows before it are then
+	// returned in the reverse order
+	Backward bool
+	// The maximum number of rows the query returns, 0 for no limit
+	Limit uint64
+	// The canonical query, cursors are only valid for the query they were
+	// produced for
+	Query string
+	// The key to sign cursors with, cursors aren't signed without it
+	CursorKey []byte
 
 	// Cache the sorted list of unique columns to fetch
 	allColumnsSorted []string
@@ -57,27 +67,31 @@ func NewQueryOptions(log *slog.Logger, latestHead uint64, options *InternalQuery
 		Log:                log,
 		OrderByAnnotations: options.OrderBy,
 		IncludeData:        options.IncludeData,
+		Query:              options.Query,
+		CursorKey:          options.CursorKey,
+		// One more row than fits in a page, to know whether there is a next
+		// page
+		Limit: QueryResultCountLimit + 1,
 	}
 
 	queryOptions.Columns = []Column{}
 
 	// We always need the primary key of the payloads table because of sorting
 	queryOptions.Columns = append(queryOptions.Columns,
-		Column{
-			Name:          "from_block",
-			QualifiedName: "e.from_block",
-		},
-		Column{
-			Name:          "entity_key",
-			QualifiedName: "e.entity_key",
-			IsBytes:       true,
-		},
+		fromBlockColumn,
+		entityIDColumn,
+		entityKeyColumn,
 	)
 
 	if options.IncludeData.Payload {
 		queryOptions.Columns = append(queryOptions.Columns, Column{
 			Name:          "payload",
-			QualifiedName: "e.payload",
+			QualifiedName: "(SELECT c.payload FROM payload_contents AS c WHERE c.hash = e.payload_hash)",
+		})
+		// The payload may be compressed, the codec tells how to decompress it
+		queryOptions.Columns = append(queryOptions.Columns, Column{
+			Name:          "payload_codec",
+			QualifiedName: "(SELECT c.codec FROM payload_contents AS c WHERE c.hash = e.payload_hash)",
 		})
 	}
 	if options.IncludeData.ContentType {
@@ -97,24 +111,30 @@ func NewQueryOptions(log *slog.Logger, latestHead uint64, options *InternalQuery
 		})
 	}
 
-	for i := range options.OrderBy {
-		name := fmt.Sprintf("arkiv_annotation_sorting%d_value", i)
-		queryOptions.Columns = append(queryOptions.Columns, Column{
-			Name:          name,
-			QualifiedName: fmt.Sprintf("arkiv_annotation_sorting%d.value", i),
-		})
+	for i, o := range options.OrderBy {
+		queryOptions.Columns = append(queryOptions.Columns, sortingColumn(i, o))
 	}
 
-	if options.IncludeData.Owner {
+	// The owner and expiration aren't part of the attribute columns, so we need
+	// to fetch them separately to return them as synthetic attributes
+	syntheticAttributes := options.IncludeData.Attributes && options.IncludeData.SyntheticAttributes
+
+	if options.IncludeData.Owner || syntheticAttributes {
 		queryOptions.Columns = append(queryOptions.Columns, Column{
 			Name:          "owner",
-			QualifiedName: fmt.Sprintf("e.string_attributes ->> '$.%s'", OwnerAttributeKey),
+			QualifiedName: "m.owner",
 		})
 	}
-	if options.IncludeData.Expiration {
+	if options.IncludeData.Expiration || syntheticAttributes {
 		queryOptions.Columns = append(queryOptions.Columns, Column{
 			Name:          "expires_at",
-			QualifiedName: fmt.Sprintf("e.numeric_attributes ->> '$.%s'", ExpirationAttributeKey),
+			QualifiedName: "m.expires_at",
+		})
+	}
+	if options.IncludeData.LastMetadataChangeAtBlock {
+		queryOptions.Columns = append(queryOptions.Columns, Column{
+			Name:          "metadata_from_block",
+			QualifiedName: "m.from_block",
 		})
 	}
 	if options.IncludeData.CreatedAtBlock {
@@ -139,26 +159,18 @@ func NewQueryOptions(log *slog.Logger, latestHead uint64, options *InternalQuery
 
 	for i, o := range queryOptions.OrderByAnnotations {
 		queryOptions.OrderBy = append(queryOptions.OrderBy, OrderBy{
-			Column: Column{
-				Name:          fmt.Sprintf("arkiv_annotation_sorting%d_value", i),
-				QualifiedName: fmt.Sprintf("arkiv_annotation_sorting%d.value", i),
-			},
+			Column:     sortingColumn(i, o),
 			Descending: o.Descending,
 		})
 	}
 	queryOptions.OrderBy = append(queryOptions.OrderBy,
 		OrderBy{
-			Column: Column{
-				Name:          "from_block",
-				QualifiedName: "e.from_block",
-			},
+			Column: fromBlockColumn,
 		},
+		// Ties are broken by the id of the entity key, which follows the
+		// order of payloads_entity_key_index
 		OrderBy{
-			Column: Column{
-				Name:          "entity_key",
-				QualifiedName: "e.entity_key",
-				IsBytes:       true,
-			},
+			Column: entityIDColumn,
 		},
 	)
 
@@ -171,6 +183,7 @@ func NewQueryOptions(log *slog.Logger, latestHead uint64, options *InternalQuery
 		}
 		queryOptions.AtBlock = cursor.BlockNumber
 		queryOptions.Cursor = cursor.ColumnValues
+		queryOptions.Backward = cursor.Backward
 	}
 
 	if options.AtBlock != nil {
@@ -180,6 +193,46 @@ func NewQueryOptions(log *slog.Logger, latestHead uint64, options *InternalQuery
 	return &queryOptions, nil
 }
 
+// fromBlockColumn is the block of the latest change of the content of an
+// entity, which orders the entities by default. Changes of the owner or the
+// expiration only start a new version of the entity_metadata row, which is
+// available as the metadata_from_block column.
+var fromBlockColumn = Column{
+	Name:          "from_block",
+	QualifiedName: "e.from_block",
+}
+
+// entityIDColumn is the id of the key of an entity. The ids are never reused,
+// so they order the entities by the time their key was first seen.
+var entityIDColumn = Column{
+	Name:          "entity_id",
+	QualifiedName: "e.entity_id",
+}
+
+var entityKeyColumn = Column{
+	Name:          "entity_key",
+	QualifiedName: "(SELECT k.entity_key FROM entity_keys AS k WHERE k.id = e.entity_id)",
+	IsBytes:       true,
+}
+
+// sortingColumn is the column that holds the value of the i-th order by
+// annotation. Attributes are joined under the name arkiv_annotation_sorting<i>,
+// while the metadata attributes can be read from the entity_metadata join or
+// the payload itself.
+func sortingColumn(i int, o OrderByAnnotation) Column {
+	name := fmt.Sprintf("arkiv_annotation_sorting%d_value", i)
+	if attr, ok := getMetadataAttribute(o.Name); ok {
+		return Column{
+			Name:          name,
+			QualifiedName: attr.selector("m", "e"),
+		}
+	}
+	return Column{
+		Name:          name,
+		QualifiedName: fmt.Sprintf("arkiv_annotation_sorting%d.value", i),
+	}
+}
+
 func (opts *QueryOptions) GetColumnIndex(column string) (int, error) {
 	ix, found := slices.BinarySearchFunc(opts.Columns, column, func(a Column, b string) int {
 		return cmp.Compare(a.Name, b)
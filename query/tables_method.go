@@ -22,6 +22,14 @@ func (b *QueryBuilder) createLeafQuery(query string) string {
 }
 
 func (e TablesEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQuery, error) {
+	return e.evaluate(ast, options, func(expr *ASTExpr, b *QueryBuilder) (string, error) {
+		return e.EvaluateExpr(expr, b), nil
+	})
+}
+
+// evaluate joins the payloads with the entities that evaluateExpr selects
+// into a table of entity_id and from_block pairs.
+func (e TablesEvaluator) evaluate(ast *AST, options *QueryOptions, evaluateExpr func(*ASTExpr, *QueryBuilder) (string, error)) (*SelectQuery, error) {
 	builder := QueryBuilder{
 		options:      *options,
 		queryBuilder: &strings.Builder{},
@@ -30,14 +38,21 @@ func (e TablesEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 		needsWhere:   true,
 	}
 
+	blockArg := builder.PushArgument(builder.options.AtBlock)
+
 	if ast.Expr != nil {
+		keys, err := evaluateExpr(ast.Expr, &builder)
+		if err != nil {
+			return nil, err
+		}
+
 		builder.queryBuilder.WriteString(strings.Join(
 			[]string{
 				" SELECT",
 				builder.options.ColumnString(),
 				"FROM",
-				e.EvaluateExpr(ast.Expr, &builder),
-				"AS keys INNER JOIN payloads AS e INDEXED BY payloads_entity_key_index ON keys.entity_key = e.entity_key AND keys.from_block = e.from_block",
+				keys,
+				"AS keys INNER JOIN payloads AS e INDEXED BY payloads_entity_key_index ON keys.entity_id = e.entity_id AND keys.from_block = e.from_block",
 			},
 			" ",
 		))
@@ -52,7 +67,14 @@ func (e TablesEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 		))
 	}
 
+	builder.writeMetadataJoin(blockArg)
+
 	for i, orderBy := range builder.options.OrderByAnnotations {
+		if _, ok := getMetadataAttribute(orderBy.Name); ok {
+			// Already available through the entity_metadata join or the payload
+			continue
+		}
+
 		tableName := ""
 		switch orderBy.Type {
 		case "string":
@@ -69,13 +91,13 @@ func (e TablesEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 
 		fmt.Fprintf(builder.queryBuilder,
 			" LEFT JOIN %[1]s AS %s"+
-				" ON %[2]s.entity_key = e.entity_key"+
+				" ON %[2]s.entity_id = e.entity_id"+
 				" AND %[2]s.from_block = e.from_block"+
-				" AND %[2]s.key = %[3]s",
+				" AND %[2]s.name_id = %[3]s",
 
 			tableName,
 			sortingTable,
-			keyPlaceholder,
+			attributeNameID(keyPlaceholder),
 		)
 	}
 
@@ -91,7 +113,6 @@ func (e TablesEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 		builder.queryBuilder.WriteString(" AND ")
 	}
 
-	blockArg := builder.PushArgument(builder.options.AtBlock)
 	fmt.Fprintf(builder.queryBuilder, "%s BETWEEN e.from_block AND e.to_block - 1", blockArg)
 
 	builder.queryBuilder.WriteString(" ORDER BY ")
@@ -99,14 +120,17 @@ func (e TablesEvaluator) EvaluateAST(ast *AST, options *QueryOptions) (*SelectQu
 	orderColumns := make([]string, 0, len(builder.options.OrderBy))
 	for _, o := range builder.options.OrderBy {
 		suffix := ""
-		if o.Descending {
+		// Backward pages are read in the reverse order
+		if o.Descending != builder.options.Backward {
 			suffix = " DESC"
 		}
 		orderColumns = append(orderColumns, o.Column.Name+suffix)
 	}
 	builder.queryBuilder.WriteString(strings.Join(orderColumns, ", "))
 
-	fmt.Fprintf(builder.queryBuilder, " LIMIT %d", QueryResultCountLimit)
+	if builder.options.Limit > 0 {
+		fmt.Fprintf(builder.queryBuilder, " LIMIT %d", builder.options.Limit)
+	}
 
 	return &SelectQuery{
 		Query: builder.queryBuilder.String(),
@@ -171,7 +195,12 @@ func (e TablesEvaluator) EvaluateAnd(expr *ASTAnd, b *QueryBuilder) string {
 	return tableName
 }
 
-func (TablesEvaluator) EvaluateTerm(expr *ASTTerm, b *QueryBuilder) string {
+func (e TablesEvaluator) EvaluateTerm(expr *ASTTerm, b *QueryBuilder) string {
+	if expr.Or != nil {
+		// A nested disjunction is just another table that can be intersected
+		return e.EvaluateOr(expr.Or, b)
+	}
+
 	if expr.LessThan != nil {
 		return expr.LessThan.Evaluate(b)
 	}
@@ -200,29 +229,68 @@ func (TablesEvaluator) EvaluateTerm(expr *ASTTerm, b *QueryBuilder) string {
 		return expr.Inclusion.Evaluate(b)
 	}
 
+	if expr.Exists != nil {
+		return expr.Exists.Evaluate(b)
+	}
+
+	if expr.Between != nil {
+		return expr.Between.Evaluate(b)
+	}
+
+	if expr.Comparison != nil {
+		return expr.Comparison.Evaluate(b)
+	}
+
 	panic("This should not happen!")
 }
 
 func (b *QueryBuilder) createAnnotationQuery(
 	attributeType string,
-	whereClause string,
+	varName string,
+	operation string,
+	valueArg string,
 ) string {
 
+	blockArg := b.PushArgument(b.options.AtBlock)
+
+	if attr, ok := getMetadataAttribute(varName); ok {
+		whereClause := fmt.Sprintf("%s %s %s", attr.selector("a", "p"), operation, valueArg)
+		// An attribute with the wrong type never matches, just like for
+		// attributes that don't exist in the attribute table of that type
+		if attr.Numeric != (attributeType == "numeric") {
+			whereClause = "FALSE"
+		}
+
+		return b.createLeafQuery(
+			strings.Join(
+				[]string{
+					"SELECT p.entity_id, p.from_block FROM entity_metadata AS a",
+					"INNER JOIN payloads AS p ON p.entity_id = a.entity_id",
+					fmt.Sprintf("AND %s BETWEEN p.from_block AND p.to_block - 1", blockArg),
+					"WHERE",
+					whereClause,
+					fmt.Sprintf("AND %s BETWEEN a.from_block AND a.to_block - 1", blockArg),
+				},
+				" ",
+			),
+		)
+	}
+
 	tableName := "string_attributes"
 	if attributeType == "numeric" {
 		tableName = "numeric_attributes"
 	}
 
-	blockArg := b.PushArgument(b.options.AtBlock)
+	varArg := b.PushArgument(varName)
 
 	return b.createLeafQuery(
 		strings.Join(
 			[]string{
-				"SELECT a.entity_key, a.from_block FROM",
+				"SELECT a.entity_id, a.from_block FROM",
 				tableName,
 				"AS a",
 				"WHERE",
-				whereClause,
+				fmt.Sprintf("a.name_id = %s AND a.value %s %s", attributeNameID(varArg), operation, valueArg),
 				fmt.Sprintf("AND %s BETWEEN a.from_block AND a.to_block - 1", blockArg),
 			},
 			" ",
@@ -231,7 +299,6 @@ func (b *QueryBuilder) createAnnotationQuery(
 }
 
 func (e *Glob) Evaluate(b *QueryBuilder) string {
-	varArg := b.PushArgument(e.Var)
 	valArg := b.PushArgument(e.Value)
 
 	op := "GLOB"
@@ -239,105 +306,108 @@ func (e *Glob) Evaluate(b *QueryBuilder) string {
 		op = "NOT GLOB"
 	}
 
-	return b.createAnnotationQuery(
-		"string",
-		fmt.Sprintf("a.key = %s AND a.value %s %s", varArg, op, valArg),
-	)
+	return b.createAnnotationQuery("string", e.Var, op, valArg)
 }
 
-func (e *LessThan) Evaluate(b *QueryBuilder) string {
-	attrType := "string"
-	varArg := b.PushArgument(e.Var)
-	valArg := ""
-
-	if e.Value.String != nil {
-		valArg = b.PushArgument(*e.Value.String)
-	} else {
-		attrType = "numeric"
-		valArg = b.PushArgument(*e.Value.Number)
-	}
+// Evaluate selects the entities that have the attribute, or for the negated
+// form all live entities that have neither a string nor a numeric attribute
+// with that name.
+func (e *Exists) Evaluate(b *QueryBuilder) string {
+	blockArg := b.PushArgument(b.options.AtBlock)
 
-	return b.createAnnotationQuery(
-		attrType,
-		fmt.Sprintf("a.key = %s AND a.value < %s", varArg, valArg),
+	live := fmt.Sprintf(
+		"SELECT p.entity_id, p.from_block FROM payloads AS p WHERE %s BETWEEN p.from_block AND p.to_block - 1",
+		blockArg,
 	)
-}
 
-func (e *LessOrEqualThan) Evaluate(b *QueryBuilder) string {
-	attrType := "string"
+	if _, ok := getMetadataAttribute(e.Var); ok {
+		// Every entity has an owner, an expiration and a payload
+		if e.IsNot {
+			return b.createLeafQuery(live + " AND FALSE")
+		}
+		return b.createLeafQuery(live)
+	}
+
 	varArg := b.PushArgument(e.Var)
-	valArg := ""
 
-	if e.Value.String != nil {
-		valArg = b.PushArgument(*e.Value.String)
-	} else {
-		attrType = "numeric"
-		valArg = b.PushArgument(*e.Value.Number)
+	if e.IsNot {
+		conditions := make([]string, 0, 2)
+		for _, tableName := range []string{"string_attributes", "numeric_attributes"} {
+			conditions = append(conditions, fmt.Sprintf(
+				"NOT EXISTS (SELECT 1 FROM %s AS a WHERE a.entity_id = p.entity_id AND a.from_block = p.from_block AND a.name_id = %s)",
+				tableName,
+				attributeNameID(varArg),
+			))
+		}
+		return b.createLeafQuery(live + " AND " + strings.Join(conditions, " AND "))
 	}
 
-	return b.createAnnotationQuery(
-		attrType,
-		fmt.Sprintf("a.key = %s AND a.value <= %s", varArg, valArg),
-	)
+	queries := make([]string, 0, 2)
+	for _, tableName := range []string{"string_attributes", "numeric_attributes"} {
+		queries = append(queries, strings.Join(
+			[]string{
+				"SELECT a.entity_id, a.from_block FROM",
+				tableName,
+				"AS a",
+				"WHERE",
+				fmt.Sprintf("a.name_id = %s", attributeNameID(varArg)),
+				fmt.Sprintf("AND %s BETWEEN a.from_block AND a.to_block - 1", blockArg),
+			},
+			" ",
+		))
+	}
+	return b.createLeafQuery(strings.Join(queries, " UNION "))
 }
 
-func (e *GreaterThan) Evaluate(b *QueryBuilder) string {
-	attrType := "string"
-	varArg := b.PushArgument(e.Var)
-	valArg := ""
-
-	if e.Value.String != nil {
-		valArg = b.PushArgument(*e.Value.String)
-	} else {
-		attrType = "numeric"
-		valArg = b.PushArgument(*e.Value.Number)
-	}
+// Evaluate selects the live entities for which the comparison holds. There is
+// no index over pairs of attributes, so every live payload is checked.
+func (e *Comparison) Evaluate(b *QueryBuilder) string {
+	blockArg := b.PushArgument(b.options.AtBlock)
 
-	return b.createAnnotationQuery(
-		attrType,
-		fmt.Sprintf("a.key = %s AND a.value > %s", varArg, valArg),
+	return b.createLeafQuery(
+		strings.Join(
+			[]string{
+				"SELECT p.entity_id, p.from_block FROM payloads AS p",
+				"INNER JOIN entity_metadata AS m ON m.entity_id = p.entity_id",
+				fmt.Sprintf("AND %s BETWEEN m.from_block AND m.to_block - 1", blockArg),
+				"WHERE",
+				fmt.Sprintf("%s BETWEEN p.from_block AND p.to_block - 1", blockArg),
+				"AND",
+				b.comparisonCondition(e, "m", "p"),
+			},
+			" ",
+		),
 	)
 }
 
-func (e *GreaterOrEqualThan) Evaluate(b *QueryBuilder) string {
-	attrType := "string"
-	varArg := b.PushArgument(e.Var)
-	valArg := ""
+func (e *LessThan) Evaluate(b *QueryBuilder) string {
+	attrType, valArg := e.Value.evaluate(b)
+	return b.createAnnotationQuery(attrType, e.Var, "<", valArg)
+}
 
-	if e.Value.String != nil {
-		valArg = b.PushArgument(*e.Value.String)
-	} else {
-		attrType = "numeric"
-		valArg = b.PushArgument(*e.Value.Number)
-	}
+func (e *LessOrEqualThan) Evaluate(b *QueryBuilder) string {
+	attrType, valArg := e.Value.evaluate(b)
+	return b.createAnnotationQuery(attrType, e.Var, "<=", valArg)
+}
 
-	return b.createAnnotationQuery(
-		attrType,
-		fmt.Sprintf("a.key = %s AND a.value >= %s", varArg, valArg),
-	)
+func (e *GreaterThan) Evaluate(b *QueryBuilder) string {
+	attrType, valArg := e.Value.evaluate(b)
+	return b.createAnnotationQuery(attrType, e.Var, ">", valArg)
 }
 
-func (e *Equality) Evaluate(b *QueryBuilder) string {
-	attrType := "string"
-	varArg := b.PushArgument(e.Var)
-	valArg := ""
+func (e *GreaterOrEqualThan) Evaluate(b *QueryBuilder) string {
+	attrType, valArg := e.Value.evaluate(b)
+	return b.createAnnotationQuery(attrType, e.Var, ">=", valArg)
+}
 
+func (e *Equality) Evaluate(b *QueryBuilder) string {
 	op := "="
 	if e.IsNot {
 		op = "!="
 	}
 
-	if e.Value.String != nil {
-		valArg = b.PushArgument(*e.Value.String)
-	} else {
-		attrType = "numeric"
-		valArg = b.PushArgument(*e.Value.Number)
-	}
-
-	return b.createAnnotationQuery(
-		attrType,
-		fmt.Sprintf("a.key = %s AND a.value %s %s", varArg, op, valArg),
-	)
+	attrType, valArg := e.Value.evaluate(b)
+	return b.createAnnotationQuery(attrType, e.Var, op, valArg)
 }
 
 func (e *Inclusion) Evaluate(b *QueryBuilder) string {
@@ -347,9 +417,7 @@ func (e *Inclusion) Evaluate(b *QueryBuilder) string {
 
 		values = make([]string, 0, len(e.Values.Strings))
 		for _, value := range e.Values.Strings {
-			if e.Var == OwnerAttributeKey ||
-				e.Var == CreatorAttributeKey ||
-				e.Var == KeyAttributeKey {
+			if isHexAttribute(e.Var) {
 				values = append(values, b.PushArgument(strings.ToLower(value)))
 			} else {
 				values = append(values, b.PushArgument(value))
@@ -364,19 +432,35 @@ func (e *Inclusion) Evaluate(b *QueryBuilder) string {
 		}
 	}
 
-	paramStr := strings.Join(values, ", ")
-
-	condition := fmt.Sprintf("a.value IN (%s)", paramStr)
+	op := "IN"
 	if e.IsNot {
-		condition = fmt.Sprintf("a.value NOT IN (%s)", paramStr)
+		op = "NOT IN"
 	}
 
-	keyArg := b.PushArgument(e.Var)
-
 	return b.createAnnotationQuery(
 		attrType,
-		fmt.Sprintf("a.key = %s AND %s", keyArg,
-			condition,
-		),
+		e.Var,
+		op,
+		fmt.Sprintf("(%s)", strings.Join(values, ", ")),
 	)
 }
+
+func (e *Between) Evaluate(b *QueryBuilder) string {
+	op := "BETWEEN"
+	if e.IsNot {
+		op = "NOT BETWEEN"
+	}
+
+	attrType, lowArg := e.Low.evaluate(b)
+	_, highArg := e.High.evaluate(b)
+	return b.createAnnotationQuery(attrType, e.Var, op, lowArg+" AND "+highArg)
+}
+
+// evaluate pushes the value as an argument and returns the type of the
+// attribute table it needs to be compared against.
+func (v Value) evaluate(b *QueryBuilder) (string, string) {
+	if v.String != nil {
+		return "string", b.PushArgument(*v.String)
+	}
+	return "numeric", b.PushArgument(*v.Number)
+}
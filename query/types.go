@@ -2,6 +2,7 @@ package query
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -13,6 +14,63 @@ var OwnerAttributeKey = "$owner"
 var ExpirationAttributeKey = "$expiration"
 var CreatedAtBlockKey = "$createdAtBlock"
 var SequenceAttributeKey = "$sequence"
+var TxIndexAttributeKey = "$txIndex"
+var OpIndexAttributeKey = "$opIndex"
+var ContentTypeAttributeKey = "$contentType"
+var PayloadSizeAttributeKey = "$payloadSize"
+
+// metadataAttribute is a synthetic attribute that is not stored in the
+// attribute tables. The owner and expiration are versioned separately from the
+// content of the entity in the entity_metadata table, while the content type
+// and payload size are part of the payload version.
+type metadataAttribute struct {
+	Column  string
+	Numeric bool
+	// The column is in the payloads table instead of entity_metadata
+	Payload bool
+	// The column is in the payload_contents table that the payload refers to
+	Content bool
+}
+
+func getMetadataAttribute(name string) (metadataAttribute, bool) {
+	switch name {
+	case OwnerAttributeKey:
+		return metadataAttribute{Column: "owner"}, true
+	case ExpirationAttributeKey:
+		return metadataAttribute{Column: "expires_at", Numeric: true}, true
+	case ContentTypeAttributeKey:
+		return metadataAttribute{Column: "content_type", Payload: true}, true
+	case PayloadSizeAttributeKey:
+		return metadataAttribute{Column: "size", Numeric: true, Content: true}, true
+	default:
+		return metadataAttribute{}, false
+	}
+}
+
+// MetadataAttributeSelector returns the SQL expression of a synthetic
+// attribute that is not stored in the attribute tables, like $owner, given the
+// aliases of the entity_metadata and payloads tables. It returns false for all
+// other attributes.
+func MetadataAttributeSelector(name string, metadataAlias string, payloadAlias string) (selector string, numeric bool, ok bool) {
+	attr, ok := getMetadataAttribute(name)
+	if !ok {
+		return "", false, false
+	}
+	return attr.selector(metadataAlias, payloadAlias), attr.Numeric, true
+}
+
+// selector is the SQL expression of the attribute, given the aliases of the
+// entity_metadata and payloads tables.
+func (a metadataAttribute) selector(metadataAlias string, payloadAlias string) string {
+	switch {
+	case a.Content:
+		return fmt.Sprintf("(SELECT c.%s FROM payload_contents AS c WHERE c.hash = %s.payload_hash)", a.Column, payloadAlias)
+	case a.Payload:
+		return payloadAlias + "." + a.Column
+	default:
+		return metadataAlias + "." + a.Column
+	}
+}
 
 type OrderByAnnotation struct {
 	Name       string `json:"name"`
@@ -24,11 +82,15 @@ type QueryResponse struct {
 	Data        []json.RawMessage `json:"data"`
 	BlockNumber uint64            `json:"blockNumber"`
 	Cursor      *string           `json:"cursor,omitempty"`
+	// The cursor of the previous page, if there is one
+	PreviousCursor *string `json:"previousCursor,omitempty"`
 }
 
 type Cursor struct {
 	BlockNumber  uint64        `json:"blockNumber"`
 	ColumnValues []CursorValue `json:"columnValues"`
+	// Whether the cursor points to the rows before it instead of after it
+	Backward bool `json:"backward,omitempty"`
 }
 
 type CursorValue struct {
@@ -48,15 +110,17 @@ type NumericAnnotation struct {
 }
 
 type EntityData struct {
-	Key                         *common.Hash    `json:"key,omitempty"`
-	Value                       hexutil.Bytes   `json:"value,omitempty"`
-	ContentType                 *string         `json:"contentType,omitempty"`
-	ExpiresAt                   *uint64         `json:"expiresAt,omitempty"`
-	Owner                       *common.Address `json:"owner,omitempty"`
-	CreatedAtBlock              *uint64         `json:"createdAtBlock,omitempty"`
-	LastModifiedAtBlock         *uint64         `json:"lastModifiedAtBlock,omitempty"`
-	TransactionIndexInBlock     *uint64         `json:"transactionIndexInBlock,omitempty"`
-	OperationIndexInTransaction *uint64         `json:"operationIndexInTransaction,omitempty"`
+	Key                 *common.Hash    `json:"key,omitempty"`
+	Value               hexutil.Bytes   `json:"value,omitempty"`
+	ContentType         *string         `json:"contentType,omitempty"`
+	ExpiresAt           *uint64         `json:"expiresAt,omitempty"`
+	Owner               *common.Address `json:"owner,omitempty"`
+	CreatedAtBlock      *uint64         `json:"createdAtBlock,omitempty"`
+	LastModifiedAtBlock *uint64         `json:"lastModifiedAtBlock,omitempty"`
+	// The block of the latest change of the owner or the expiration
+	LastMetadataChangeAtBlock   *uint64 `json:"lastMetadataChangeAtBlock,omitempty"`
+	TransactionIndexInBlock     *uint64 `json:"transactionIndexInBlock,omitempty"`
+	OperationIndexInTransaction *uint64 `json:"operationIndexInTransaction,omitempty"`
 
 	StringAttributes  []StringAnnotation  `json:"stringAttributes,omitempty"`
 	NumericAttributes []NumericAnnotation `json:"numericAttributes,omitempty"`
@@ -72,6 +136,7 @@ type IncludeData struct {
 	Owner                       bool `json:"owner"`
 	CreatedAtBlock              bool `json:"createdAtBlock"`
 	LastModifiedAtBlock         bool `json:"lastModifiedAtBlock"`
+	LastMetadataChangeAtBlock   bool `json:"lastMetadataChangeAtBlock"`
 	TransactionIndexInBlock     bool `json:"transactionIndexInBlock"`
 	OperationIndexInTransaction bool `json:"operationIndexInTransaction"`
 }
@@ -82,6 +147,11 @@ type Options struct {
 	OrderBy        []OrderByAnnotation `json:"orderBy"`
 	ResultsPerPage uint64              `json:"resultsPerPage"`
 	Cursor         string              `json:"cursor"`
+	// Evaluator forces the use of one of the evaluators, for debugging. By
+	// default the planner chooses one per query.
+	Evaluator string `json:"evaluator,omitempty"`
+	// Arguments are bound to the placeholders of the query, the first one to $1
+	Arguments []Argument `json:"arguments,omitempty"`
 }
 
 func (options *Options) ToInternalQueryOptions() (*InternalQueryOptions, error) {
@@ -104,6 +174,7 @@ func (options *Options) ToInternalQueryOptions() (*InternalQueryOptions, error)
 			OrderBy:     options.OrderBy,
 			AtBlock:     options.AtBlock,
 			Cursor:      options.Cursor,
+			Evaluator:   options.Evaluator,
 		}, nil
 	default:
 		iq := InternalQueryOptions{
@@ -111,6 +182,7 @@ func (options *Options) ToInternalQueryOptions() (*InternalQueryOptions, error)
 			AtBlock:     options.AtBlock,
 			Cursor:      options.Cursor,
 			IncludeData: options.IncludeData,
+			Evaluator:   options.Evaluator,
 		}
 		return &iq, nil
 	}
@@ -121,4 +193,8 @@ type InternalQueryOptions struct {
 	IncludeData *IncludeData        `json:"includeData"`
 	OrderBy     []OrderByAnnotation `json:"orderBy"`
 	Cursor      string              `json:"cursor"`
+	Evaluator   string              `json:"evaluator,omitempty"`
+	// Set by the store to bind and sign the cursors
+	Query     string `json:"-"`
+	CursorKey []byte `json:"-"`
 }
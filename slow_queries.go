@@ -0,0 +1,99 @@
+package sqlitestore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+)
+
+// DefaultSlowQueryThreshold is how long a query needs to run to be recorded
+// in the slow-query log, unless configured with WithSlowQueryLog.
+const DefaultSlowQueryThreshold = time.Second
+
+// DefaultSlowQueryLogSize is the number of slow queries that are kept, unless
+// configured with WithSlowQueryLog.
+const DefaultSlowQueryLogSize = 100
+
+// SlowQuery is a query that ran for longer than the slow-query threshold.
+type SlowQuery struct {
+	Query       string                    `json:"query"`
+	AtBlock     uint64                    `json:"atBlock"`
+	OrderBy     []query.OrderByAnnotation `json:"orderBy,omitempty"`
+	IncludeData *query.IncludeData        `json:"includeData,omitempty"`
+	SQL         string                    `json:"sql"`
+	Args        []any                     `json:"args"`
+	StartedAt   time.Time                 `json:"startedAt"`
+	Duration    time.Duration             `json:"duration"`
+	// The number of entities that were handed to the caller before the query
+	// finished or the caller stopped the iteration
+	Rows uint64 `json:"rows"`
+	// The error the query failed with, if any
+	Error string `json:"error,omitempty"`
+	// The query plan, if it could be determined
+	Plan []*QueryPlanStep `json:"plan,omitempty"`
+}
+
+// slowQueryLog keeps the latest slow queries in a ring buffer.
+type slowQueryLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	entries []SlowQuery
+	// The position of the next entry once the buffer is full
+	next int
+}
+
+func newSlowQueryLog(threshold time.Duration, size int) *slowQueryLog {
+	// A size of 0 or less turns the log off
+	return &slowQueryLog{
+		threshold: threshold,
+		entries:   make([]SlowQuery, 0, max(size, 0)),
+	}
+}
+
+func (l *slowQueryLog) isSlow(duration time.Duration) bool {
+	return cap(l.entries) > 0 && duration >= l.threshold
+}
+
+func (l *slowQueryLog) add(entry SlowQuery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+		return
+	}
+
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+func (l *slowQueryLog) list() []SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]SlowQuery, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+	entries = append(entries, l.entries[:l.next]...)
+
+	return entries
+}
+
+func (l *slowQueryLog) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// SlowQueries returns the recorded slow queries, the oldest first.
+func (s *SQLiteStore) SlowQueries() []SlowQuery {
+	return s.slowQueries.list()
+}
+
+// ClearSlowQueries removes all recorded slow queries.
+func (s *SQLiteStore) ClearSlowQueries() {
+	s.slowQueries.clear()
+}
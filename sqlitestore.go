@@ -7,54 +7,101 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/sqlite3"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
-	_ "github.com/mattn/go-sqlite3"
+	gosqlite3 "github.com/mattn/go-sqlite3"
 
 	arkivevents "github.com/Arkiv-Network/arkiv-events"
-	"github.com/Arkiv-Network/arkiv-events/events"
 	"github.com/Arkiv-Network/sqlite-store/query"
 	"github.com/Arkiv-Network/sqlite-store/store"
 )
 
 var ErrStopIteration = errors.New("stop iteration")
 
+// errPageFull stops the iteration at a row that doesn't fit in the page, the
+// row only shows that there is a next page and isn't handed to the caller.
+var errPageFull = errors.New("page full")
+
+// driverName is the go-sqlite3 driver with the functions that the schema
+// migrations and queries rely on registered on every connection.
+const driverName = "sqlite3_arkiv"
+
+func init() {
+	sql.Register(driverName, &gosqlite3.SQLiteDriver{
+		ConnectHook: func(conn *gosqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("keccak256", func(data []byte) []byte {
+				return crypto.Keccak256(data)
+			}, true)
+		},
+	})
+}
+
 type SQLiteStore struct {
 	writePool *sql.DB
 	readPool  *sql.DB
 	log       *slog.Logger
+
+	compression  *CompressionPolicy
+	parseOptions query.ParseOptions
+	slowQueries  *slowQueryLog
+	admission    *admission
+
+	// How far ahead of the head and how long queries wait for a block, no
+	// limit if 0
+	maxBlocksAhead uint64
+	maxBlockWait   time.Duration
+
+	// The key that cursors are signed with, if any
+	cursorKey []byte
+
+	// The latest statistics used by the query planner
+	statisticsMu sync.Mutex
+	statistics   *plannerStatistics
+
+	// The work that outlives the queries, like recording slow queries
+	background sync.WaitGroup
 }
 
 func NewSQLiteStore(
 	log *slog.Logger,
 	dbPath string,
 	numberOfReadThreads int,
+	options ...Option,
 ) (*SQLiteStore, error) {
 
 	log.Info("Creating SQLiteStore", "dbpath", dbPath)
 
-	err := os.MkdirAll(filepath.Dir(dbPath), 0755)
+	// Needs to be registered before the connections are opened
+	err := registerProgressHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dbPath), 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	writeURL := fmt.Sprintf("file:%s?mode=rwc&_busy_timeout=11000&_journal_mode=WAL&_auto_vacuum=incremental&_foreign_keys=true&_txlock=immediate&_cache_size=65536", dbPath)
 
-	writePool, err := sql.Open("sqlite3", writeURL)
+	writePool, err := sql.Open(driverName, writeURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open write pool: %w", err)
 	}
 
 	readURL := fmt.Sprintf("file:%s?_query_only=true&_busy_timeout=11000&_journal_mode=WAL&_auto_vacuum=incremental&_foreign_keys=true&_txlock=deferred&_cache_size=65536", dbPath)
-	readPool, err := sql.Open("sqlite3", readURL)
+	readPool, err := sql.Open(driverName, readURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open read pool: %w", err)
 	}
@@ -72,7 +119,18 @@ func NewSQLiteStore(
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
-	return &SQLiteStore{writePool: writePool, readPool: readPool, log: log}, nil
+	s := &SQLiteStore{
+		writePool:   writePool,
+		readPool:    readPool,
+		log:         log,
+		slowQueries: newSlowQueryLog(DefaultSlowQueryThreshold, DefaultSlowQueryLogSize),
+		admission:   newAdmission(QueryLimits{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	return s, nil
 }
 
 func runMigrations(db *sql.DB) error {
@@ -98,8 +156,11 @@ func runMigrations(db *sql.DB) error {
 	return nil
 }
 
+// Close waits for the slow queries whose plans are still being recorded and
+// closes both connection pools.
 func (s *SQLiteStore) Close() error {
-	return s.writePool.Close()
+	s.background.Wait()
+	return errors.Join(s.readPool.Close(), s.writePool.Close())
 }
 
 func (s *SQLiteStore) GetLastBlock(ctx context.Context) (int64, error) {
@@ -108,9 +169,19 @@ func (s *SQLiteStore) GetLastBlock(ctx context.Context) (int64, error) {
 
 func (s *SQLiteStore) FollowEvents(ctx context.Context, iterator arkivevents.BatchIterator) error {
 
-	for batch := range iterator {
-		if batch.Error != nil {
-			return fmt.Errorf("failed to follow events: %w", batch.Error)
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Batches are decoded and marshalled by prepareBatches in the background,
+	// while the loop below applies them one at a time in iterator order.
+	// On errors FollowEvents returns right away, the background goroutine
+	// stops once the iterator yields its next batch. The iterator can block
+	// for any time while it waits for new blocks.
+	batches, done := prepareBatches(ctx, iterator, s.compression)
+	defer cancel()
+
+	for prepared := range batches {
+		if prepared.err != nil {
+			return fmt.Errorf("failed to follow events: %w", prepared.err)
 		}
 
 		err := func() error {
@@ -125,9 +196,11 @@ func (s *SQLiteStore) FollowEvents(ctx context.Context, iterator arkivevents.Bat
 			defer tx.Rollback()
 
 			st := store.New(tx)
+			names := newAttributeNames(st)
 
-			firstBlock := batch.Batch.Blocks[0].Number
-			lastBlock := batch.Batch.Blocks[len(batch.Batch.Blocks)-1].Number
+			batch := prepared.batch
+			firstBlock := batch.firstBlock
+			lastBlock := batch.lastBlock
 			s.log.Info("new batch", "firstBlock", firstBlock, "lastBlock", lastBlock)
 
 			lastBlockFromDB, err := st.GetLastBlock(ctx)
@@ -136,460 +209,303 @@ func (s *SQLiteStore) FollowEvents(ctx context.Context, iterator arkivevents.Bat
 			}
 
 		mainLoop:
-			for _, block := range batch.Batch.Blocks {
+			for _, block := range batch.blocks {
 
-				if block.Number <= uint64(lastBlockFromDB) {
-					s.log.Info("skipping block", "block", block.Number, "lastBlockFromDB", lastBlockFromDB)
+				if block.number <= uint64(lastBlockFromDB) {
+					s.log.Info("skipping block", "block", block.number, "lastBlockFromDB", lastBlockFromDB)
 					continue mainLoop
 				}
 
-				updatesMap := map[common.Hash][]*events.OPUpdate{}
+				for _, prepared := range block.operations {
+
+					operation := prepared.operation
 
-				for _, operation := range block.Operations {
-					if operation.Update != nil {
-						currentUpdates := updatesMap[operation.Update.Key]
-						currentUpdates = append(currentUpdates, operation.Update)
-						updatesMap[operation.Update.Key] = currentUpdates
+					// Only the last update of an entity in a block is applied,
+					// together with the rest of the block
+					if prepared.superseded {
+						continue mainLoop
 					}
-				}
 
-				// blockNumber := block.Number
-				for _, operation := range block.Operations {
+					entityID, err := st.UpsertEntityKey(ctx, prepared.key)
+					if err != nil {
+						return fmt.Errorf("failed to get id of entity 0x%x at block %d txIndex %d opIndex %d: %w", prepared.key, block.number, operation.TxIndex, operation.OpIndex, err)
+					}
 
 					switch {
 
 					case operation.Create != nil:
-						// expiresAtBlock := blockNumber + operation.Create.BTL
-
 						key := operation.Create.Key
+						untilBlock := block.number + operation.Create.BTL
 
-						stringAttributes := maps.Clone(operation.Create.StringAttributes)
-
-						stringAttributes["$owner"] = strings.ToLower(operation.Create.Owner.Hex())
-						stringAttributes["$creator"] = strings.ToLower(operation.Create.Owner.Hex())
-						stringAttributes["$key"] = strings.ToLower(key.Hex())
-
-						stringAttributesBytes, err := json.Marshal(stringAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to marshal string attributes: %w", err)
-						}
-
-						untilBlock := block.Number + operation.Create.BTL
-						numericAttributes := maps.Clone(operation.Create.NumericAttributes)
-						numericAttributes["$expiration"] = uint64(untilBlock)
-						numericAttributes["$createdAtBlock"] = uint64(block.Number)
-
-						sequence := block.Number<<32 | operation.TxIndex<<16 | operation.OpIndex
-						numericAttributes["$sequence"] = sequence
-						numericAttributes["$txIndex"] = uint64(operation.TxIndex)
-						numericAttributes["$opIndex"] = uint64(operation.OpIndex)
-
-						numericAttributesBytes, err := json.Marshal(numericAttributes)
+						err = st.InsertPayloadContent(ctx, store.InsertPayloadContentParams{
+							Hash:    prepared.payloadHash,
+							Payload: prepared.payload,
+							Codec:   string(prepared.codec),
+							Size:    int64(len(operation.Create.Content)),
+						})
 						if err != nil {
-							return fmt.Errorf("failed to marshal numeric attributes: %w", err)
+							return fmt.Errorf("failed to insert payload content %s at block %d txIndex %d opIndex %d: %w", key.Hex(), block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
 						err = st.InsertPayload(
 							ctx,
 							store.InsertPayloadParams{
-								EntityKey:         operation.Create.Key.Bytes(),
-								FromBlock:         store.Uint64(block.Number),
-								ToBlock:           store.Uint64(untilBlock),
-								Payload:           operation.Create.Content,
+								EntityID:          entityID,
+								FromBlock:         store.Uint64(block.number),
+								ToBlock:           openToBlock,
+								PayloadHash:       prepared.payloadHash,
 								ContentType:       operation.Create.ContentType,
-								StringAttributes:  string(stringAttributesBytes),
-								NumericAttributes: string(numericAttributesBytes),
+								StringAttributes:  prepared.stringAttributesJSON,
+								NumericAttributes: prepared.numericAttributesJSON,
 							},
 						)
 						if err != nil {
-							return fmt.Errorf("failed to insert payload %s at block %d txIndex %d opIndex %d: %w", key.Hex(), block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to insert payload %s at block %d txIndex %d opIndex %d: %w", key.Hex(), block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						for k, v := range stringAttributes {
+						for k, v := range prepared.stringAttributes {
+							nameID, err := names.id(ctx, k)
+							if err != nil {
+								return err
+							}
 							err = st.InsertStringAttribute(ctx, store.InsertStringAttributeParams{
-								EntityKey: operation.Create.Key.Bytes(),
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(block.Number + operation.Create.BTL),
-								Key:       k,
+								EntityID:  entityID,
+								FromBlock: store.Uint64(block.number),
+								ToBlock:   openToBlock,
+								NameID:    nameID,
 								Value:     v,
 							})
 							if err != nil {
-								return fmt.Errorf("failed to insert string attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
+								return fmt.Errorf("failed to insert string attribute %s at block %d txIndex %d opIndex %d: %w", k, block.number, operation.TxIndex, operation.OpIndex, err)
 							}
 						}
 
-						for k, v := range numericAttributes {
+						for k, v := range prepared.numericAttributes {
+							nameID, err := names.id(ctx, k)
+							if err != nil {
+								return err
+							}
 							err = st.InsertNumericAttribute(ctx, store.InsertNumericAttributeParams{
-								EntityKey: operation.Create.Key.Bytes(),
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(block.Number + operation.Create.BTL),
-								Key:       k,
+								EntityID:  entityID,
+								FromBlock: store.Uint64(block.number),
+								ToBlock:   openToBlock,
+								NameID:    nameID,
 								Value:     store.Uint64(v),
 							})
 							if err != nil {
-								return fmt.Errorf("failed to insert numeric attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
+								return fmt.Errorf("failed to insert numeric attribute %s at block %d txIndex %d opIndex %d: %w", k, block.number, operation.TxIndex, operation.OpIndex, err)
 							}
 						}
-					case operation.Update != nil:
-
-						updates := updatesMap[operation.Update.Key]
-						lastUpdate := updates[len(updates)-1]
 
-						if operation.Update != lastUpdate {
-							continue mainLoop
+						err = st.InsertEntityMetadata(ctx, store.InsertEntityMetadataParams{
+							EntityID:  entityID,
+							FromBlock: store.Uint64(block.number),
+							ToBlock:   store.Uint64(untilBlock),
+							Owner:     prepared.owner,
+							ExpiresAt: store.Uint64(untilBlock),
+						})
+						if err != nil {
+							return fmt.Errorf("failed to insert entity metadata %s at block %d txIndex %d opIndex %d: %w", key.Hex(), block.number, operation.TxIndex, operation.OpIndex, err)
 						}
+					case operation.Update != nil:
 
-						key := operation.Update.Key.Bytes()
+						key := prepared.key
 
 						s.log.Info("update", "key", common.BytesToHash(key).Hex())
 
-						latestPayload, err := st.GetLatestPayload(ctx, key)
+						latestPayload, err := st.GetLatestPayload(ctx, entityID)
 						if err != nil {
 							return fmt.Errorf("failed to get latest payload: %w", err)
 						}
 
-						oldStringAttributes := map[string]string{}
-
-						err = json.Unmarshal([]byte(latestPayload.StringAttributes), &oldStringAttributes)
+						err = s.terminateContentAtBlock(ctx, st, entityID, latestPayload.FromBlock, block.number)
 						if err != nil {
-							return fmt.Errorf("failed to unmarshal string attributes: %w", err)
+							return fmt.Errorf("failed to terminate content at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						oldNumericAttributes := map[string]uint64{}
-						err = json.Unmarshal([]byte(latestPayload.NumericAttributes), &oldNumericAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to unmarshal numeric attributes: %w", err)
-						}
-
-						latestFromBlock := latestPayload.FromBlock
-
-						err = st.TerminateNumericAttributesAtBlock(ctx, store.TerminateNumericAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestFromBlock,
-						})
+						err = s.terminateMetadataAtBlock(ctx, st, entityID, block.number)
 						if err != nil {
-							return fmt.Errorf("failed to terminate numeric attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to terminate entity metadata at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.TerminateStringAttributesAtBlock(ctx, store.TerminateStringAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestFromBlock,
-						})
-						if err != nil {
-							return fmt.Errorf("failed to terminate string attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
-						}
+						untilBlock := block.number + operation.Update.BTL
 
-						err = st.TerminatePayloadsAtBlock(ctx, store.TerminatePayloadsAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestFromBlock,
+						err = st.InsertPayloadContent(ctx, store.InsertPayloadContentParams{
+							Hash:    prepared.payloadHash,
+							Payload: prepared.payload,
+							Codec:   string(prepared.codec),
+							Size:    int64(len(operation.Update.Content)),
 						})
 						if err != nil {
-							return fmt.Errorf("failed to terminate payloads at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
-						}
-
-						stringAttributes := maps.Clone(operation.Update.StringAttributes)
-
-						stringAttributes["$owner"] = strings.ToLower(operation.Update.Owner.Hex())
-						stringAttributes["$creator"] = oldStringAttributes["$creator"]
-						stringAttributes["$key"] = strings.ToLower(operation.Update.Key.Hex())
-
-						stringAttributesBytes, err := json.Marshal(stringAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to marshal string attributes: %w", err)
-						}
-
-						untilBlock := block.Number + operation.Update.BTL
-						numericAttributes := maps.Clone(operation.Update.NumericAttributes)
-						numericAttributes["$expiration"] = uint64(untilBlock)
-						numericAttributes["$createdAtBlock"] = oldNumericAttributes["$createdAtBlock"]
-
-						numericAttributes["$sequence"] = oldNumericAttributes["$sequence"]
-						numericAttributes["$txIndex"] = oldNumericAttributes["$txIndex"]
-						numericAttributes["$opIndex"] = oldNumericAttributes["$opIndex"]
-
-						numericAttributesBytes, err := json.Marshal(numericAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to marshal numeric attributes: %w", err)
+							return fmt.Errorf("failed to insert payload content 0x%x at block %d txIndex %d opIndex %d: %w", key, block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.InsertPayload(
+						// The attributes that are carried over from the creation of the
+						// entity are copied from the previous version, the rest was
+						// prepared upfront.
+						err = st.InsertUpdatedPayload(
 							ctx,
-							store.InsertPayloadParams{
-								EntityKey:         key,
-								FromBlock:         store.Uint64(block.Number),
-								ToBlock:           store.Uint64(untilBlock),
-								Payload:           operation.Update.Content,
+							store.InsertUpdatedPayloadParams{
+								EntityID:          entityID,
+								FromBlock:         store.Uint64(block.number),
+								ToBlock:           openToBlock,
+								PayloadHash:       prepared.payloadHash,
 								ContentType:       operation.Update.ContentType,
-								StringAttributes:  string(stringAttributesBytes),
-								NumericAttributes: string(numericAttributesBytes),
+								StringAttributes:  prepared.stringAttributesJSON,
+								NumericAttributes: prepared.numericAttributesJSON,
+								PreviousFromBlock: latestPayload.FromBlock,
 							},
 						)
 						if err != nil {
-							return fmt.Errorf("failed to insert payload 0x%x at block %d txIndex %d opIndex %d: %w", key, block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to insert payload 0x%x at block %d txIndex %d opIndex %d: %w", key, block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						for k, v := range stringAttributes {
+						for k, v := range prepared.stringAttributes {
+							nameID, err := names.id(ctx, k)
+							if err != nil {
+								return err
+							}
 							err = st.InsertStringAttribute(ctx, store.InsertStringAttributeParams{
-								EntityKey: key,
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(block.Number + operation.Update.BTL),
-								Key:       k,
+								EntityID:  entityID,
+								FromBlock: store.Uint64(block.number),
+								ToBlock:   openToBlock,
+								NameID:    nameID,
 								Value:     v,
 							})
 							if err != nil {
-								return fmt.Errorf("failed to insert string attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
+								return fmt.Errorf("failed to insert string attribute %s at block %d txIndex %d opIndex %d: %w", k, block.number, operation.TxIndex, operation.OpIndex, err)
 							}
 						}
 
-						for k, v := range numericAttributes {
+						for k, v := range prepared.numericAttributes {
+							nameID, err := names.id(ctx, k)
+							if err != nil {
+								return err
+							}
 							err = st.InsertNumericAttribute(ctx, store.InsertNumericAttributeParams{
-								EntityKey: key,
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(block.Number + operation.Update.BTL),
-								Key:       k,
+								EntityID:  entityID,
+								FromBlock: store.Uint64(block.number),
+								ToBlock:   openToBlock,
+								NameID:    nameID,
 								Value:     store.Uint64(v),
 							})
 							if err != nil {
-								return fmt.Errorf("failed to insert numeric attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
+								return fmt.Errorf("failed to insert numeric attribute %s at block %d txIndex %d opIndex %d: %w", k, block.number, operation.TxIndex, operation.OpIndex, err)
 							}
 						}
 
-					case operation.Delete != nil || operation.Expire != nil:
-
-						var key []byte
-						if operation.Delete != nil {
-							key = common.Hash(*operation.Delete).Bytes()
-						} else {
-							key = common.Hash(*operation.Expire).Bytes()
-						}
-
-						s.log.Info("delete or expire", "key", common.BytesToHash(key).Hex())
-
-						latestPayload, err := st.GetLatestPayload(ctx, key)
-						if err != nil {
-							return fmt.Errorf("failed to get latest payload: %w", err)
-						}
-
-						err = st.TerminatePayloadsAtBlock(ctx, store.TerminatePayloadsAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
+						err = st.CopyCreationStringAttributes(ctx, store.CopyCreationStringAttributesParams{
+							EntityID:          entityID,
+							FromBlock:         store.Uint64(block.number),
+							ToBlock:           openToBlock,
+							PreviousFromBlock: latestPayload.FromBlock,
 						})
 						if err != nil {
-							return fmt.Errorf("failed to terminate payloads at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to copy string attributes at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.TerminateStringAttributesAtBlock(ctx, store.TerminateStringAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
+						err = st.CopyCreationNumericAttributes(ctx, store.CopyCreationNumericAttributesParams{
+							EntityID:          entityID,
+							FromBlock:         store.Uint64(block.number),
+							ToBlock:           openToBlock,
+							PreviousFromBlock: latestPayload.FromBlock,
 						})
 						if err != nil {
-							return fmt.Errorf("failed to terminate string attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to copy numeric attributes at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.TerminateNumericAttributesAtBlock(ctx, store.TerminateNumericAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
+						err = st.InsertEntityMetadata(ctx, store.InsertEntityMetadataParams{
+							EntityID:  entityID,
+							FromBlock: store.Uint64(block.number),
+							ToBlock:   store.Uint64(untilBlock),
+							Owner:     prepared.owner,
+							ExpiresAt: store.Uint64(untilBlock),
 						})
 						if err != nil {
-							return fmt.Errorf("failed to terminate numeric attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to insert entity metadata 0x%x at block %d txIndex %d opIndex %d: %w", key, block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-					case operation.ExtendBTL != nil:
+					case operation.Delete != nil || operation.Expire != nil:
 
-						key := operation.ExtendBTL.Key.Bytes()
+						key := prepared.key
 
-						s.log.Info("extend BTL", "key", common.BytesToHash(key).Hex())
+						s.log.Info("delete or expire", "key", common.BytesToHash(key).Hex())
 
-						latestPayload, err := st.GetLatestPayload(ctx, key)
+						latestPayload, err := st.GetLatestPayload(ctx, entityID)
 						if err != nil {
 							return fmt.Errorf("failed to get latest payload: %w", err)
 						}
 
-						err = st.TerminatePayloadsAtBlock(ctx, store.TerminatePayloadsAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
-						})
+						err = s.terminateContentAtBlock(ctx, st, entityID, latestPayload.FromBlock, block.number)
 						if err != nil {
-							return fmt.Errorf("failed to terminate payloads at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to terminate content at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.TerminateStringAttributesAtBlock(ctx, store.TerminateStringAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
-						})
+						err = s.terminateMetadataAtBlock(ctx, st, entityID, block.number)
 						if err != nil {
-							return fmt.Errorf("failed to terminate string attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to terminate entity metadata at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.TerminateNumericAttributesAtBlock(ctx, store.TerminateNumericAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
-						})
-						if err != nil {
-							return fmt.Errorf("failed to terminate numeric attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
-						}
+					case operation.ExtendBTL != nil:
 
-						oldNumericAttributes := map[string]uint64{}
-						err = json.Unmarshal([]byte(latestPayload.NumericAttributes), &oldNumericAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to unmarshal numeric attributes: %w", err)
-						}
+						key := prepared.key
 
-						newToBlock := block.Number + operation.ExtendBTL.BTL
+						s.log.Info("extend BTL", "key", common.BytesToHash(key).Hex())
 
-						numericAttributes := maps.Clone(oldNumericAttributes)
-						numericAttributes["$expiration"] = uint64(newToBlock)
-						numericAttributesBytes, err := json.Marshal(numericAttributes)
+						latestMetadata, err := st.GetLatestEntityMetadata(ctx, entityID)
 						if err != nil {
-							return fmt.Errorf("failed to marshal numeric attributes: %w", err)
+							return fmt.Errorf("failed to get latest entity metadata: %w", err)
 						}
 
-						err = st.InsertPayload(ctx, store.InsertPayloadParams{
-							EntityKey:         key,
-							FromBlock:         store.Uint64(block.Number),
-							ToBlock:           store.Uint64(newToBlock),
-							Payload:           latestPayload.Payload,
-							ContentType:       latestPayload.ContentType,
-							StringAttributes:  latestPayload.StringAttributes,
-							NumericAttributes: string(numericAttributesBytes),
+						err = st.TerminateEntityMetadataAtBlock(ctx, store.TerminateEntityMetadataAtBlockParams{
+							EntityID:  entityID,
+							ToBlock:   store.Uint64(block.number),
+							FromBlock: latestMetadata.FromBlock,
 						})
 						if err != nil {
-							return fmt.Errorf("failed to insert payload at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to terminate entity metadata at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						for k, v := range numericAttributes {
-							err = st.InsertNumericAttribute(ctx, store.InsertNumericAttributeParams{
-								EntityKey: key,
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(newToBlock),
-								Key:       k,
-								Value:     store.Uint64(v),
-							})
-							if err != nil {
-								return fmt.Errorf("failed to insert numeric attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
-							}
-						}
+						newToBlock := block.number + operation.ExtendBTL.BTL
 
-						stringAttributes := map[string]string{}
-						err = json.Unmarshal([]byte(latestPayload.StringAttributes), &stringAttributes)
+						err = st.InsertEntityMetadata(ctx, store.InsertEntityMetadataParams{
+							EntityID:  entityID,
+							FromBlock: store.Uint64(block.number),
+							ToBlock:   store.Uint64(newToBlock),
+							Owner:     latestMetadata.Owner,
+							ExpiresAt: store.Uint64(newToBlock),
+						})
 						if err != nil {
-							return fmt.Errorf("failed to unmarshal string attributes: %w", err)
-						}
-
-						for k, v := range stringAttributes {
-							err = st.InsertStringAttribute(ctx, store.InsertStringAttributeParams{
-								EntityKey: key,
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(newToBlock),
-								Key:       k,
-								Value:     v,
-							})
-							if err != nil {
-								return fmt.Errorf("failed to insert string attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
-							}
+							return fmt.Errorf("failed to insert entity metadata at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
 					case operation.ChangeOwner != nil:
-						key := operation.ChangeOwner.Key.Bytes()
+						key := prepared.key
 						s.log.Info("change owner", "key", common.BytesToHash(key).Hex())
 
-						latestPayload, err := st.GetLatestPayload(ctx, key)
-						if err != nil {
-							return fmt.Errorf("failed to get latest payload: %w", err)
-						}
-
-						err = st.TerminatePayloadsAtBlock(ctx, store.TerminatePayloadsAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
-						})
-						if err != nil {
-							return fmt.Errorf("failed to terminate payloads at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
-						}
-
-						err = st.TerminateStringAttributesAtBlock(ctx, store.TerminateStringAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
-						})
+						latestMetadata, err := st.GetLatestEntityMetadata(ctx, entityID)
 						if err != nil {
-							return fmt.Errorf("failed to terminate string attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
+							return fmt.Errorf("failed to get latest entity metadata: %w", err)
 						}
 
-						err = st.TerminateNumericAttributesAtBlock(ctx, store.TerminateNumericAttributesAtBlockParams{
-							EntityKey: key,
-							ToBlock:   store.Uint64(block.Number),
-							FromBlock: latestPayload.FromBlock,
+						err = st.TerminateEntityMetadataAtBlock(ctx, store.TerminateEntityMetadataAtBlockParams{
+							EntityID:  entityID,
+							ToBlock:   store.Uint64(block.number),
+							FromBlock: latestMetadata.FromBlock,
 						})
 						if err != nil {
-							return fmt.Errorf("failed to terminate numeric attributes at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
-						}
-
-						stringAttributes := map[string]string{}
-						err = json.Unmarshal([]byte(latestPayload.StringAttributes), &stringAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to unmarshal string attributes: %w", err)
-						}
-
-						stringAttributes["$owner"] = strings.ToLower(operation.ChangeOwner.Owner.Hex())
-						stringAttributesBytes, err := json.Marshal(stringAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to marshal string attributes: %w", err)
+							return fmt.Errorf("failed to terminate entity metadata at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 
-						err = st.InsertPayload(ctx, store.InsertPayloadParams{
-							EntityKey:         key,
-							FromBlock:         store.Uint64(block.Number),
-							ToBlock:           store.Uint64(latestPayload.OldToBlock),
-							Payload:           latestPayload.Payload,
-							ContentType:       latestPayload.ContentType,
-							StringAttributes:  string(stringAttributesBytes),
-							NumericAttributes: latestPayload.NumericAttributes,
+						err = st.InsertEntityMetadata(ctx, store.InsertEntityMetadataParams{
+							EntityID:  entityID,
+							FromBlock: store.Uint64(block.number),
+							ToBlock:   latestMetadata.ExpiresAt,
+							Owner:     prepared.owner,
+							ExpiresAt: latestMetadata.ExpiresAt,
 						})
 						if err != nil {
-							return fmt.Errorf("failed to insert payload at block %d txIndex %d opIndex %d: %w", block.Number, operation.TxIndex, operation.OpIndex, err)
-						}
-
-						for k, v := range stringAttributes {
-							err = st.InsertStringAttribute(ctx, store.InsertStringAttributeParams{
-								EntityKey: key,
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(latestPayload.OldToBlock),
-								Key:       k,
-								Value:     v,
-							})
-
-							if err != nil {
-								return fmt.Errorf("failed to insert string attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
-							}
-						}
-
-						numericAttributes := map[string]uint64{}
-						err = json.Unmarshal([]byte(latestPayload.NumericAttributes), &numericAttributes)
-						if err != nil {
-							return fmt.Errorf("failed to unmarshal numeric attributes: %w", err)
-						}
-
-						for k, v := range numericAttributes {
-							err = st.InsertNumericAttribute(ctx, store.InsertNumericAttributeParams{
-								EntityKey: key,
-								FromBlock: store.Uint64(block.Number),
-								ToBlock:   store.Uint64(latestPayload.OldToBlock),
-								Key:       k,
-								Value:     store.Uint64(v),
-							})
-							if err != nil {
-								return fmt.Errorf("failed to insert numeric attribute %s at block %d txIndex %d opIndex %d: %w", k, block.Number, operation.TxIndex, operation.OpIndex, err)
-							}
+							return fmt.Errorf("failed to insert entity metadata at block %d txIndex %d opIndex %d: %w", block.number, operation.TxIndex, operation.OpIndex, err)
 						}
 					default:
 						return fmt.Errorf("unknown operation: %v", operation)
@@ -599,6 +515,13 @@ func (s *SQLiteStore) FollowEvents(ctx context.Context, iterator arkivevents.Bat
 
 			}
 
+			if lastBlock > uint64(lastBlockFromDB) {
+				err = s.closeExpiredContent(ctx, st, uint64(lastBlockFromDB), lastBlock)
+				if err != nil {
+					return fmt.Errorf("failed to close content of expired entities: %w", err)
+				}
+			}
+
 			err = st.UpsertLastBlock(ctx, int64(lastBlock))
 			if err != nil {
 				return fmt.Errorf("failed to upsert last block: %w", err)
@@ -616,6 +539,175 @@ func (s *SQLiteStore) FollowEvents(ctx context.Context, iterator arkivevents.Bat
 		}
 	}
 
+	// The iterator is done, wait until the goroutine let go of it
+	<-done
+
+	return nil
+}
+
+// openToBlock is the to_block of the content rows of live entities, which are
+// only closed once the entity is updated, deleted or expires. How long the
+// entity lives is tracked in entity_metadata.
+const openToBlock = store.Uint64(math.MaxInt64)
+
+// attributeNames resolves attribute names to their ids within a single write
+// transaction. The ids are cached for the rest of the transaction, since the
+// same few names are used by most entities.
+type attributeNames struct {
+	st  *store.Queries
+	ids map[string]int64
+}
+
+func newAttributeNames(st *store.Queries) *attributeNames {
+	return &attributeNames{st: st, ids: map[string]int64{}}
+}
+
+func (n *attributeNames) id(ctx context.Context, name string) (int64, error) {
+	if id, ok := n.ids[name]; ok {
+		return id, nil
+	}
+
+	id, err := n.st.UpsertAttributeName(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get id of attribute %s: %w", name, err)
+	}
+	n.ids[name] = id
+
+	return id, nil
+}
+
+// terminateContentAtBlock ends the content version of an entity that started
+// at fromBlock, meaning the payload and all of its attributes.
+func (s *SQLiteStore) terminateContentAtBlock(ctx context.Context, st *store.Queries, entityID int64, fromBlock store.Uint64, block uint64) error {
+	err := st.TerminatePayloadsAtBlock(ctx, store.TerminatePayloadsAtBlockParams{
+		EntityID:  entityID,
+		ToBlock:   store.Uint64(block),
+		FromBlock: fromBlock,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate payloads: %w", err)
+	}
+
+	err = st.TerminateStringAttributesAtBlock(ctx, store.TerminateStringAttributesAtBlockParams{
+		EntityID:  entityID,
+		ToBlock:   store.Uint64(block),
+		FromBlock: fromBlock,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate string attributes: %w", err)
+	}
+
+	err = st.TerminateNumericAttributesAtBlock(ctx, store.TerminateNumericAttributesAtBlockParams{
+		EntityID:  entityID,
+		ToBlock:   store.Uint64(block),
+		FromBlock: fromBlock,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate numeric attributes: %w", err)
+	}
+
+	return nil
+}
+
+// closeExpiredContent ends the content of the entities that expired after
+// afterBlock and up to untilBlock without an Expire operation, at the block
+// they expired at. The metadata rows already end there.
+func (s *SQLiteStore) closeExpiredContent(ctx context.Context, st *store.Queries, afterBlock uint64, untilBlock uint64) error {
+	expiring, err := st.ListExpiringEntities(ctx, store.ListExpiringEntitiesParams{
+		AfterBlock: store.Uint64(afterBlock),
+		UntilBlock: store.Uint64(untilBlock),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list expiring entities: %w", err)
+	}
+
+	for _, entity := range expiring {
+		latestPayload, err := st.GetLatestPayload(ctx, entity.EntityID)
+		if err != nil {
+			return fmt.Errorf("failed to get latest payload: %w", err)
+		}
+
+		// Expire operations at the block of the expiration already ended it
+		if latestPayload.OldToBlock != openToBlock {
+			continue
+		}
+
+		err = s.terminateContentAtBlock(ctx, st, entity.EntityID, latestPayload.FromBlock, uint64(entity.ExpiresAt))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// terminateMetadataAtBlock ends the current owner and expiration of an entity.
+func (s *SQLiteStore) terminateMetadataAtBlock(ctx context.Context, st *store.Queries, entityID int64, block uint64) error {
+	latestMetadata, err := st.GetLatestEntityMetadata(ctx, entityID)
+	if err != nil {
+		return fmt.Errorf("failed to get latest entity metadata: %w", err)
+	}
+
+	err = st.TerminateEntityMetadataAtBlock(ctx, store.TerminateEntityMetadataAtBlockParams{
+		EntityID:  entityID,
+		ToBlock:   store.Uint64(block),
+		FromBlock: latestMetadata.FromBlock,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate entity metadata: %w", err)
+	}
+
+	return nil
+}
+
+// PruneHistory removes all versions of entities that ended at or before the
+// given block. Queries at that block or later are not affected, while queries
+// at earlier blocks will no longer see the pruned versions. Payload content is
+// deleted together with the last version that refers to it.
+func (s *SQLiteStore) PruneHistory(ctx context.Context, block uint64) error {
+	tx, err := s.writePool.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	st := store.New(tx)
+
+	s.log.Info("pruning history", "block", block)
+
+	err = st.DeletePayloadsEndedByBlock(ctx, store.Uint64(block))
+	if err != nil {
+		return fmt.Errorf("failed to delete payloads before block %d: %w", block, err)
+	}
+
+	err = st.DeleteStringAttributesEndedByBlock(ctx, store.Uint64(block))
+	if err != nil {
+		return fmt.Errorf("failed to delete string attributes before block %d: %w", block, err)
+	}
+
+	err = st.DeleteNumericAttributesEndedByBlock(ctx, store.Uint64(block))
+	if err != nil {
+		return fmt.Errorf("failed to delete numeric attributes before block %d: %w", block, err)
+	}
+
+	err = st.DeleteEntityMetadataEndedByBlock(ctx, store.Uint64(block))
+	if err != nil {
+		return fmt.Errorf("failed to delete entity metadata before block %d: %w", block, err)
+	}
+
+	err = st.DeleteUnusedEntityKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete unused entity keys: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
 	return nil
 }
 
@@ -631,8 +723,37 @@ func (s *SQLiteStore) GetLatestHead(ctx context.Context) (uint64, error) {
 
 const cadence = 2 * time.Second
 
+// ErrBlockNotYetAvailable is returned when a block is requested that the store
+// hasn't processed yet and that it can't wait for, see WithBlockWait.
+var ErrBlockNotYetAvailable = errors.New("block not yet available")
+
+// BlockNotYetAvailableError reports the head of the store when the requested
+// block is not yet available, it matches ErrBlockNotYetAvailable.
+type BlockNotYetAvailableError struct {
+	Block uint64
+	Head  uint64
+}
+
+func (e *BlockNotYetAvailableError) Error() string {
+	return fmt.Sprintf("block %d not yet available, the latest block is %d", e.Block, e.Head)
+}
+
+func (e *BlockNotYetAvailableError) Is(target error) bool {
+	return target == ErrBlockNotYetAvailable
+}
+
+// EnsureBlockPresent waits until the store has processed the block. It returns
+// a BlockNotYetAvailableError if the block is too far ahead of the head, or
+// if it isn't processed in time.
 func (s *SQLiteStore) EnsureBlockPresent(ctx context.Context, block uint64) error {
 
+	var deadline <-chan time.Time
+	if s.maxBlockWait > 0 {
+		timer := time.NewTimer(s.maxBlockWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
 	for {
 
 		latestHead, err := s.GetLatestHead(ctx)
@@ -644,9 +765,15 @@ func (s *SQLiteStore) EnsureBlockPresent(ctx context.Context, block uint64) erro
 			return nil
 		}
 
+		if s.maxBlocksAhead > 0 && block-latestHead > s.maxBlocksAhead {
+			return &BlockNotYetAvailableError{Block: block, Head: latestHead}
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-deadline:
+			return &BlockNotYetAvailableError{Block: block, Head: latestHead}
 			// wait 1/4 of the cadence - making sure we don't spin too fast but still not too slow
 		case <-time.After(cadence / 4):
 			// continue processing
@@ -660,6 +787,42 @@ func (s *SQLiteStore) QueryEntities(
 	req string,
 	op *query.Options,
 ) (*query.QueryResponse, error) {
+	ast, err := query.ParseWithOptions(req, s.log, s.parseOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	return s.queryEntities(ctx, req, ast, op)
+}
+
+// QueryEntitiesAST is like QueryEntities, but takes a query that was already
+// parsed or built with query.Build.
+func (s *SQLiteStore) QueryEntitiesAST(
+	ctx context.Context,
+	ast *query.AST,
+	op *query.Options,
+) (*query.QueryResponse, error) {
+	return s.queryEntities(ctx, ast.String(), ast, op)
+}
+
+// preparedQuery is a query that was bound and translated to SQL, but not run
+// yet.
+type preparedQuery struct {
+	ast         *query.AST
+	evaluator   query.QueryEvaluator
+	selectivity float64
+	options     *query.QueryOptions
+	query       *query.SelectQuery
+}
+
+// prepareQuery translates the query to SQL that returns at most limit rows,
+// or all rows if limit is 0.
+func (s *SQLiteStore) prepareQuery(
+	ctx context.Context,
+	ast *query.AST,
+	op *query.Options,
+	limit uint64,
+) (*preparedQuery, error) {
 
 	if op != nil {
 		s.log.Info("query options", "options", *op)
@@ -668,15 +831,21 @@ func (s *SQLiteStore) QueryEntities(
 		}
 	}
 
-	ast, err := query.Parse(req, s.log)
+	var arguments []query.Argument
+	if op != nil {
+		arguments = op.Arguments
+	}
+	ast, err := ast.Bind(arguments)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse query: %w", err)
+		return nil, fmt.Errorf("failed to bind query arguments: %w", err)
 	}
 
 	options, err := op.ToInternalQueryOptions()
 	if err != nil {
 		return nil, err
 	}
+	options.Query = ast.String()
+	options.CursorKey = s.cursorKey
 	s.log.Info("internal query options", "options", *options)
 
 	latestHead, err := s.GetLatestHead(ctx)
@@ -688,17 +857,63 @@ func (s *SQLiteStore) QueryEntities(
 	if err != nil {
 		return nil, err
 	}
+	queryOptions.Limit = limit
 
 	s.log.Info("final query options", "options", queryOptions)
 
-	evaluatedQuery, err := query.ExistsEvaluator{}.EvaluateAST(ast, queryOptions)
+	statistics, err := s.plannerStatisticsAt(ctx, latestHead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get statistics: %w", err)
+	}
+
+	planner := query.Planner{Statistics: statistics}
+	evaluator, err := planner.Evaluator(ast, options.Evaluator)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluatedQuery, err := evaluator.EvaluateAST(ast, queryOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	s.log.Info("evaluated query")
+	s.log.Info("evaluated query", "evaluator", fmt.Sprintf("%T", evaluator))
+
+	return &preparedQuery{
+		ast:         ast,
+		evaluator:   evaluator,
+		selectivity: planner.Selectivity(ast),
+		options:     queryOptions,
+		query:       evaluatedQuery,
+	}, nil
+}
+
+// resultsPerPage is the page size of the options, at most
+// query.QueryResultCountLimit.
+func resultsPerPage(op *query.Options) uint64 {
+	if op != nil && op.ResultsPerPage > 0 && op.ResultsPerPage < query.QueryResultCountLimit {
+		return op.ResultsPerPage
+	}
+	return query.QueryResultCountLimit
+}
+
+func (s *SQLiteStore) queryEntities(
+	ctx context.Context,
+	req string,
+	ast *query.AST,
+	op *query.Options,
+) (*query.QueryResponse, error) {
+	maxResultsPerPage := resultsPerPage(op)
+	s.log.Info("query max results per page", "value", maxResultsPerPage)
+
+	// One more row than fits in the page, to know whether there is a next page
+	prepared, err := s.prepareQuery(ctx, ast, op, maxResultsPerPage+1)
+	if err != nil {
+		return nil, err
+	}
+	queryOptions, evaluatedQuery := prepared.options, prepared.query
 
-	latestCursor := &query.Cursor{}
+	var firstCursor, latestCursor *query.Cursor
 	response := &query.QueryResponse{
 		BlockNumber: queryOptions.AtBlock,
 		Data:        make([]json.RawMessage, 0),
@@ -709,12 +924,6 @@ func (s *SQLiteStore) QueryEntities(
 		return nil, err
 	}
 
-	maxResultsPerPage := query.QueryResultCountLimit
-	if op != nil && op.ResultsPerPage > 0 && op.ResultsPerPage < query.QueryResultCountLimit {
-		maxResultsPerPage = op.ResultsPerPage
-	}
-	s.log.Info("query max results per page", "value", maxResultsPerPage)
-
 	needsCursor := false
 
 	err = s.QueryEntitiesInternalIterator(
@@ -724,6 +933,12 @@ func (s *SQLiteStore) QueryEntities(
 		queryOptions,
 		func(entity *query.EntityData, cursor *query.Cursor) error {
 
+			// The page is full, and this row shows that there is a next one
+			if uint64(len(response.Data)) >= maxResultsPerPage {
+				needsCursor = true
+				return errPageFull
+			}
+
 			ed, err := json.Marshal(entity)
 			if err != nil {
 				return fmt.Errorf("failed to marshal entity: %w", err)
@@ -732,9 +947,12 @@ func (s *SQLiteStore) QueryEntities(
 			// We always add the last obtained result, and set the latest obtained cursor value
 			response.Data = append(response.Data, ed)
 			latestCursor = cursor
+			if firstCursor == nil {
+				firstCursor = cursor
+			}
 
 			newLen := query.ResponseSize + len(ed) + 1
-			if newLen > query.MaxResponseSize || uint64(len(response.Data)) >= maxResultsPerPage {
+			if newLen > query.MaxResponseSize {
 				needsCursor = true
 				return ErrStopIteration
 			}
@@ -746,13 +964,44 @@ func (s *SQLiteStore) QueryEntities(
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
 
+	// The last row that was read is where the next page starts, in the same
+	// direction, and the first row is where the page in the other direction
+	// starts. There is a page in the other direction if the request had a
+	// cursor, but an empty page has no row to start it from.
+	var next, previous *query.Cursor
 	if needsCursor {
-		cursor, err := queryOptions.EncodeCursor(latestCursor)
+		next = &query.Cursor{BlockNumber: latestCursor.BlockNumber, ColumnValues: latestCursor.ColumnValues}
+	}
+	if len(queryOptions.Cursor) > 0 && firstCursor != nil {
+		previous = &query.Cursor{BlockNumber: firstCursor.BlockNumber, ColumnValues: firstCursor.ColumnValues, Backward: true}
+	}
+
+	// Backward pages are read in the reverse order
+	if queryOptions.Backward {
+		slices.Reverse(response.Data)
+		next, previous = previous, next
+		if next != nil {
+			next.Backward = false
+		}
+		if previous != nil {
+			previous.Backward = true
+		}
+	}
+
+	if next != nil {
+		cursor, err := queryOptions.EncodeCursor(next)
 		if err != nil {
 			return nil, fmt.Errorf("could not encode cursor: %w", err)
 		}
 		response.Cursor = &cursor
 	}
+	if previous != nil {
+		cursor, err := queryOptions.EncodeCursor(previous)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode cursor: %w", err)
+		}
+		response.PreviousCursor = &cursor
+	}
 
 	s.log.Info("query number of results", "value", len(response.Data))
 	return response, nil
@@ -764,7 +1013,7 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 	evaluatedQuery *query.SelectQuery,
 	options *query.QueryOptions,
 	iterator func(*query.EntityData, *query.Cursor) error,
-) error {
+) (err error) {
 	s.log.Info(
 		"Executing query",
 		"query", originalQuery,
@@ -772,55 +1021,59 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 		"args", evaluatedQuery.Args,
 	)
 
+	var rowCount uint64
 	startTime := time.Now()
 	defer func() {
 		elapsed := time.Since(startTime)
 		s.log.Info("query execution time", "seconds", elapsed.Seconds(), "query", originalQuery)
 
-		if elapsed.Seconds() > 1 {
-			rows, err := s.readPool.QueryContext(
-				ctx,
-				fmt.Sprintf("explain query plan %s", evaluatedQuery.Query),
-				evaluatedQuery.Args...,
-			)
-			if err != nil {
-				s.log.Error("failed to get query plan", "err", err)
-			}
-
-			defer rows.Close()
+		if !s.slowQueries.isSlow(elapsed) {
+			return
+		}
 
-			var (
-				id      int
-				parent  int
-				notUsed int
-				detail  string
-			)
+		entry := SlowQuery{
+			Query:       originalQuery,
+			AtBlock:     options.AtBlock,
+			OrderBy:     options.OrderByAnnotations,
+			IncludeData: options.IncludeData,
+			SQL:         evaluatedQuery.Query,
+			Args:        evaluatedQuery.Args,
+			StartedAt:   startTime,
+			Duration:    elapsed,
+			Rows:        rowCount,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
 
-			b := strings.Builder{}
-			for rows.Next() {
-				err := rows.Err()
-				if err != nil {
-					s.log.Error("failed to get query plan", "err", err)
-				}
+		s.log.Warn("slow query", "seconds", elapsed.Seconds(), "query", originalQuery, "rows", rowCount)
 
-				err = rows.Scan(&id, &parent, &notUsed, &detail)
-				if err != nil {
-					s.log.Error("failed to get query plan", "err", err)
-				}
-				fmt.Fprintf(&b, "id=%d parent=%d %s\n", id, parent, detail)
+		// The plan is determined in the background, under the same limits as
+		// the queries, and is still wanted if the query was cancelled
+		planCtx := context.WithoutCancel(ctx)
+		s.background.Go(func() {
+			plan, planErr := s.queryPlan(planCtx, evaluatedQuery)
+			if planErr != nil {
+				s.log.Error("failed to get query plan", "err", planErr)
 			}
-			s.log.Info("query plan", "plan", b.String())
-		}
+			entry.Plan = plan
+			s.slowQueries.add(entry)
+		})
 	}()
 
-	rows, err := s.readPool.QueryContext(ctx, evaluatedQuery.Query, evaluatedQuery.Args...)
+	queryCtx, conn, finish, err := s.startQuery(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { err = finish(err) }()
+
+	rows, err := conn.QueryContext(queryCtx, evaluatedQuery.Query, evaluatedQuery.Args...)
 	if err != nil {
 		return fmt.Errorf("failed to get entities for query: %s: %w", originalQuery, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-
 		err := rows.Err()
 		if err != nil {
 			return fmt.Errorf("failed to get entities for query: %s: %w", originalQuery, err)
@@ -829,7 +1082,9 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 		var (
 			key            *[]byte
 			payload        *[]byte
+			payloadCodec   *string
 			fromBlock      *uint64
+			metadataBlock  *uint64
 			owner          *string
 			contentType    *string
 			expiresAt      *uint64
@@ -848,9 +1103,15 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 			case "from_block":
 				dest = append(dest, &fromBlock)
 				columns[column.Name] = &fromBlock
+			case "metadata_from_block":
+				dest = append(dest, &metadataBlock)
+				columns[column.Name] = &metadataBlock
 			case "payload":
 				dest = append(dest, &payload)
 				columns[column.Name] = &payload
+			case "payload_codec":
+				dest = append(dest, &payloadCodec)
+				columns[column.Name] = &payloadCodec
 			case "owner":
 				dest = append(dest, &owner)
 				columns[column.Name] = &owner
@@ -890,7 +1151,14 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 		}
 		var value []byte
 		if payload != nil {
-			value = *payload
+			codec := CodecNone
+			if payloadCodec != nil {
+				codec = Codec(*payloadCodec)
+			}
+			value, err = decompressPayload(codec, *payload)
+			if err != nil {
+				return fmt.Errorf("failed to decompress payload of entity %s: %w", keyHash, err)
+			}
 		}
 		var ownerAddress *common.Address
 		if owner != nil {
@@ -901,8 +1169,15 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 		r := query.EntityData{
 			Value:       value,
 			ContentType: contentType,
-			Owner:       ownerAddress,
-			ExpiresAt:   expiresAt,
+		}
+
+		// The owner and expiration can also be fetched to be included in the
+		// synthetic attributes, so we need to check whether they were requested
+		if options.IncludeData.Owner {
+			r.Owner = ownerAddress
+		}
+		if options.IncludeData.Expiration {
+			r.ExpiresAt = expiresAt
 		}
 
 		// We check whether the key was actually requested, since it's always included
@@ -916,6 +1191,9 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 			val := *sequence >> 32
 			r.LastModifiedAtBlock = &val
 		}
+		if options.IncludeData.LastMetadataChangeAtBlock {
+			r.LastMetadataChangeAtBlock = metadataBlock
+		}
 		if options.IncludeData.TransactionIndexInBlock && sequence != nil {
 			// we need bits 16 to 32, so we shift right by 16 and then mask with
 			// a bit string of 16 ones (subtract one from 2^17)
@@ -935,6 +1213,9 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 				if err != nil {
 					return fmt.Errorf("error unmarshalling string attributes: %w", err)
 				}
+				if options.IncludeData.SyntheticAttributes && owner != nil {
+					attrs[query.OwnerAttributeKey] = *owner
+				}
 				r.StringAttributes = make([]query.StringAnnotation, 0, len(attrs))
 				for k, v := range attrs {
 					if options.IncludeData.SyntheticAttributes || !strings.HasPrefix(k, "$") {
@@ -951,6 +1232,9 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 				if err != nil {
 					return fmt.Errorf("error unmarshalling string attributes: %w", err)
 				}
+				if options.IncludeData.SyntheticAttributes && expiresAt != nil {
+					attrs[query.ExpirationAttributeKey] = *expiresAt
+				}
 				r.NumericAttributes = make([]query.NumericAnnotation, 0, len(attrs))
 				for k, v := range attrs {
 					if options.IncludeData.SyntheticAttributes || !strings.HasPrefix(k, "$") {
@@ -977,12 +1261,23 @@ func (s *SQLiteStore) QueryEntitiesInternalIterator(
 		}
 
 		err = iterator(&r, &cursor)
+		if errors.Is(err, errPageFull) {
+			return nil
+		}
+		if err == nil || errors.Is(err, ErrStopIteration) {
+			rowCount++
+		}
 		if errors.Is(err, ErrStopIteration) {
-			break
+			return nil
 		} else if err != nil {
 			return fmt.Errorf("error during query execution: %w", err)
 		}
 	}
 
+	// An interrupted query stops early, this isn't the end of the results
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get entities for query: %s: %w", originalQuery, err)
+	}
+
 	return nil
 }
@@ -1,10 +1,31 @@
 package sqlitestore
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"math/big"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/Arkiv-Network/sqlite-store/query"
+	"github.com/Arkiv-Network/sqlite-store/store"
 )
 
 func TestNewSQLiteStore_RunsMigrations(t *testing.T) {
@@ -103,3 +124,2086 @@ func TestNewSQLiteStore_FileCreated(t *testing.T) {
 		t.Error("database file should exist after NewSQLiteStore")
 	}
 }
+
+func newTestStore(t *testing.T, options ...Option) *SQLiteStore {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	store, err := NewSQLiteStore(logger, dbPath, 3, options...)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore failed: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store
+}
+
+func iterateBatches(batches ...arkivevents.BatchOrError) arkivevents.BatchIterator {
+	return func(yield func(arkivevents.BatchOrError) bool) {
+		for _, batch := range batches {
+			if !yield(batch) {
+				return
+			}
+		}
+	}
+}
+
+func batchOf(blocks ...events.Block) arkivevents.BatchOrError {
+	return arkivevents.BatchOrError{
+		Batch: events.BlockBatch{Blocks: blocks},
+	}
+}
+
+func createOp(key common.Hash, owner common.Address, btl uint64, content string, strs map[string]string, nums map[string]uint64) events.Operation {
+	return events.Operation{
+		Create: &events.OPCreate{
+			Key:               key,
+			ContentType:       "text/plain",
+			BTL:               btl,
+			Owner:             owner,
+			Content:           []byte(content),
+			StringAttributes:  strs,
+			NumericAttributes: nums,
+		},
+	}
+}
+
+func queryKeys(t *testing.T, s *SQLiteStore, q string, atBlock *uint64) map[common.Hash]query.EntityData {
+	t.Helper()
+
+	response, err := s.QueryEntities(context.Background(), q, &query.Options{
+		AtBlock: atBlock,
+		IncludeData: &query.IncludeData{
+			Key:                 true,
+			Payload:             true,
+			Owner:               true,
+			Expiration:          true,
+			Attributes:          true,
+			SyntheticAttributes: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("QueryEntities(%q) failed: %v", q, err)
+	}
+
+	result := map[common.Hash]query.EntityData{}
+	for _, raw := range response.Data {
+		entity := query.EntityData{}
+		if err := json.Unmarshal(raw, &entity); err != nil {
+			t.Fatalf("failed to unmarshal entity: %v", err)
+		}
+		result[*entity.Key] = entity
+	}
+	return result
+}
+
+// expectMatches checks that both evaluators match exactly the expected keys,
+// which need to be sorted.
+func expectMatches(t *testing.T, s *SQLiteStore, q string, expected []common.Hash) {
+	t.Helper()
+
+	for _, evaluator := range []string{query.EvaluatorExists, query.EvaluatorTables} {
+		response, err := s.QueryEntities(context.Background(), q, &query.Options{
+			Evaluator:   evaluator,
+			IncludeData: &query.IncludeData{Key: true},
+		})
+		if err != nil {
+			t.Fatalf("QueryEntities(%q) with the %s evaluator failed: %v", q, evaluator, err)
+		}
+
+		got := []common.Hash{}
+		for _, raw := range response.Data {
+			entity := query.EntityData{}
+			if err := json.Unmarshal(raw, &entity); err != nil {
+				t.Fatalf("failed to unmarshal entity: %v", err)
+			}
+			got = append(got, *entity.Key)
+		}
+		slices.SortFunc(got, func(a, b common.Hash) int { return a.Cmp(b) })
+
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("%q with the %s evaluator matched %v, expected %v", q, evaluator, got, expected)
+		}
+	}
+}
+
+func TestFollowEvents_AppliesBatchesInOrder(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	newOwner := common.HexToAddress("0x2")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "one", map[string]string{"type": "a"}, map[string]uint64{"n": 1}),
+				createOp(key2, owner, 100, "two", map[string]string{"type": "b"}, nil),
+			}},
+		),
+		batchOf(
+			events.Block{Number: 2, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: key1, Owner: owner, BTL: 50, Content: []byte("second"), StringAttributes: map[string]string{"type": "d"}}},
+				{ChangeOwner: &events.OPChangeOwner{Key: key2, Owner: newOwner}},
+			}},
+			events.Block{Number: 3, Operations: []events.Operation{
+				{ExtendBTL: &events.OPExtendBTL{Key: key2, BTL: 200}},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	head, err := s.GetLatestHead(context.Background())
+	if err != nil {
+		t.Fatalf("GetLatestHead failed: %v", err)
+	}
+	if head != 3 {
+		t.Fatalf("expected head 3, got %d", head)
+	}
+
+	entities := queryKeys(t, s, `$all`, nil)
+	if len(entities) != 2 {
+		t.Fatalf("expected 2 entities, got %d", len(entities))
+	}
+	if got := string(entities[key1].Value); got != "second" {
+		t.Errorf("expected the updated payload, got %q", got)
+	}
+	createdAtBlock := slices.IndexFunc(entities[key1].NumericAttributes, func(a query.NumericAnnotation) bool {
+		return a.Key == "$createdAtBlock" && a.Value == 1
+	})
+	if createdAtBlock < 0 {
+		t.Errorf("expected the update to keep $createdAtBlock 1, got %v", entities[key1].NumericAttributes)
+	}
+	if got := *entities[key2].Owner; got != newOwner {
+		t.Errorf("expected owner %s, got %s", newOwner, got)
+	}
+	if got := *entities[key2].ExpiresAt; got != 203 {
+		t.Errorf("expected expiration 203, got %d", got)
+	}
+
+	if got := queryKeys(t, s, `type = "d"`, nil); len(got) != 1 {
+		t.Errorf("expected 1 entity with type d, got %d", len(got))
+	}
+
+	// The update keeps the attributes from the creation of the entity
+	if got := queryKeys(t, s, `$createdAtBlock = 1 && $creator = "`+strings.ToLower(owner.Hex())+`"`, nil); len(got) != 2 {
+		t.Errorf("expected 2 entities created at block 1, got %d", len(got))
+	}
+
+	// Historical queries see the state before the later batches
+	atBlock := uint64(1)
+	historical := queryKeys(t, s, `type = "a"`, &atBlock)
+	if len(historical) != 1 {
+		t.Fatalf("expected 1 entity with type a at block 1, got %d", len(historical))
+	}
+	if got := *historical[key1].ExpiresAt; got != 101 {
+		t.Errorf("expected expiration 101 at block 1, got %d", got)
+	}
+}
+
+func TestFollowEvents_FailedBatchIsNotCommitted(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+
+	stopped := make(chan struct{})
+	batches := iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "one", nil, nil),
+			}},
+		),
+		batchOf(
+			events.Block{Number: 2, Operations: []events.Operation{
+				createOp(key2, owner, 100, "two", nil, nil),
+			}},
+			// Updating an unknown entity fails the whole batch
+			events.Block{Number: 3, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: common.HexToHash("0x3"), Owner: owner, BTL: 10}},
+			}},
+		),
+		batchOf(
+			events.Block{Number: 4, Operations: []events.Operation{
+				createOp(common.HexToHash("0x4"), owner, 100, "four", nil, nil),
+			}},
+		),
+	)
+
+	err := s.FollowEvents(context.Background(), func(yield func(arkivevents.BatchOrError) bool) {
+		defer close(stopped)
+		for batch := range batches {
+			if !yield(batch) {
+				return
+			}
+			// Give the writer time to fail while the iterator is still busy
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	if err == nil {
+		t.Fatal("expected FollowEvents to fail")
+	}
+
+	// The batches are read in the background, which stops reading from the
+	// iterator once it yields the next batch
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("expected the iterator to be stopped")
+	}
+
+	head, err := s.GetLatestHead(context.Background())
+	if err != nil {
+		t.Fatalf("GetLatestHead failed: %v", err)
+	}
+	if head != 1 {
+		t.Fatalf("expected head 1, got %d", head)
+	}
+
+	entities := queryKeys(t, s, `$all`, nil)
+	if len(entities) != 1 {
+		t.Fatalf("expected 1 entity, got %d", len(entities))
+	}
+	if _, ok := entities[key1]; !ok {
+		t.Errorf("expected entity %s to be present", key1)
+	}
+}
+
+func countRows(t *testing.T, s *SQLiteStore, table string) int {
+	t.Helper()
+
+	var count int
+	err := s.writePool.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to count rows of %s: %v", table, err)
+	}
+	return count
+}
+
+func TestFollowEvents_FailsWhileTheIteratorBlocks(t *testing.T) {
+	s := newTestStore(t)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	batches := iterateBatches(
+		batchOf(
+			// Updating an unknown entity fails the batch
+			events.Block{Number: 1, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: common.HexToHash("0x1"), Owner: common.HexToAddress("0x1"), BTL: 10}},
+			}},
+		),
+	)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- s.FollowEvents(context.Background(), func(yield func(arkivevents.BatchOrError) bool) {
+			for batch := range batches {
+				if !yield(batch) {
+					return
+				}
+			}
+			// Like an iterator that waits for the next block
+			<-release
+		})
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected FollowEvents to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected FollowEvents to fail while the iterator blocks")
+	}
+}
+
+func TestFollowEvents_MetadataChangesDoNotCopyContent(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	newOwner := common.HexToAddress("0x2")
+	key := common.HexToHash("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key, owner, 10, "content", map[string]string{"type": "a"}, map[string]uint64{"n": 1}),
+			}},
+			events.Block{Number: 2, Operations: []events.Operation{
+				{ExtendBTL: &events.OPExtendBTL{Key: key, BTL: 100}},
+			}},
+			events.Block{Number: 3, Operations: []events.Operation{
+				{ChangeOwner: &events.OPChangeOwner{Key: key, Owner: newOwner}},
+			}},
+			events.Block{Number: 20},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	for table, expected := range map[string]int{
+		"payloads":           1,
+		"string_attributes":  3,
+		"numeric_attributes": 5,
+		"entity_metadata":    3,
+	} {
+		if got := countRows(t, s, table); got != expected {
+			t.Errorf("expected %d rows in %s, got %d", expected, table, got)
+		}
+	}
+
+	ownerQuery := func(address common.Address) string {
+		return fmt.Sprintf(`$owner = %s`, address.Hex())
+	}
+
+	for _, tc := range []struct {
+		atBlock    uint64
+		owner      common.Address
+		expiration uint64
+	}{
+		{atBlock: 1, owner: owner, expiration: 11},
+		{atBlock: 2, owner: owner, expiration: 102},
+		{atBlock: 3, owner: newOwner, expiration: 102},
+		{atBlock: 20, owner: newOwner, expiration: 102},
+	} {
+		entities := queryKeys(t, s, ownerQuery(tc.owner), &tc.atBlock)
+		if len(entities) != 1 {
+			t.Fatalf("expected 1 entity owned by %s at block %d, got %d", tc.owner, tc.atBlock, len(entities))
+		}
+		entity := entities[key]
+		if *entity.ExpiresAt != tc.expiration {
+			t.Errorf("expected expiration %d at block %d, got %d", tc.expiration, tc.atBlock, *entity.ExpiresAt)
+		}
+		if string(entity.Value) != "content" {
+			t.Errorf("expected payload to be unchanged at block %d, got %q", tc.atBlock, entity.Value)
+		}
+
+		synthetic := map[string]bool{}
+		for _, a := range entity.StringAttributes {
+			synthetic[a.Key] = true
+		}
+		for _, a := range entity.NumericAttributes {
+			synthetic[a.Key] = true
+		}
+		if !synthetic["$owner"] || !synthetic["$expiration"] {
+			t.Errorf("expected $owner and $expiration in the synthetic attributes at block %d", tc.atBlock)
+		}
+	}
+
+	// The original BTL would have expired the entity at block 11
+	atBlock := uint64(15)
+	if got := queryKeys(t, s, `$expiration = 102 && type = "a"`, &atBlock); len(got) != 1 {
+		t.Errorf("expected the extended entity to be alive at block %d, got %d entities", atBlock, len(got))
+	}
+	if got := queryKeys(t, s, ownerQuery(owner), nil); len(got) != 0 {
+		t.Errorf("expected no entities for the previous owner, got %d", len(got))
+	}
+}
+
+func TestNewSQLiteStore_MigratesEntityMetadata(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	// Create a database with the schema from before entity_metadata existed
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc", dbPath))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	sourceDriver, err := iofs.New(store.Migrations, "schema")
+	if err != nil {
+		t.Fatalf("failed to create migration source: %v", err)
+	}
+	dbDriver, err := sqlite3.WithInstance(db, &sqlite3.Config{})
+	if err != nil {
+		t.Fatalf("failed to create database driver: %v", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", sourceDriver, "sqlite3", dbDriver)
+	if err != nil {
+		t.Fatalf("failed to create migrate instance: %v", err)
+	}
+	if err := m.Migrate(2); err != nil {
+		t.Fatalf("failed to migrate to version 2: %v", err)
+	}
+
+	key := common.HexToHash("0x1").Bytes()
+	statements := []string{
+		// An entity created at block 1 and extended at block 5
+		`INSERT INTO payloads VALUES (?1, 1, 5, 'data', 'text/plain', '{"$owner":"0xowner","type":"a"}', '{"$expiration":10}')`,
+		`INSERT INTO payloads VALUES (?1, 5, 20, 'data', 'text/plain', '{"$owner":"0xowner","type":"a"}', '{"$expiration":20}')`,
+		`INSERT INTO string_attributes VALUES (?1, 1, 5, '$owner', '0xowner'), (?1, 1, 5, 'type', 'a')`,
+		`INSERT INTO string_attributes VALUES (?1, 5, 20, '$owner', '0xowner'), (?1, 5, 20, 'type', 'a')`,
+		`INSERT INTO numeric_attributes VALUES (?1, 1, 5, '$expiration', 10), (?1, 5, 20, '$expiration', 20)`,
+		`UPDATE last_block SET block = 6`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement, key); err != nil {
+			t.Fatalf("failed to insert test data: %v", err)
+		}
+	}
+	db.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err := NewSQLiteStore(logger, dbPath, 3)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore failed: %v", err)
+	}
+	defer s.Close()
+
+	if got := countRows(t, s, "entity_metadata"); got != 2 {
+		t.Errorf("expected 2 entity_metadata rows, got %d", got)
+	}
+	if got := countRows(t, s, "numeric_attributes"); got != 0 {
+		t.Errorf("expected $expiration to be removed from numeric_attributes, got %d rows", got)
+	}
+
+	for _, tc := range []struct {
+		atBlock    uint64
+		expiration uint64
+	}{
+		{atBlock: 2, expiration: 10},
+		{atBlock: 6, expiration: 20},
+	} {
+		entities := queryKeys(t, s, `$owner = "0xowner" && type = "a"`, &tc.atBlock)
+		if len(entities) != 1 {
+			t.Fatalf("expected 1 entity at block %d, got %d", tc.atBlock, len(entities))
+		}
+		if got := *entities[common.BytesToHash(key)].ExpiresAt; got != tc.expiration {
+			t.Errorf("expected expiration %d at block %d, got %d", tc.expiration, tc.atBlock, got)
+		}
+		if got := string(entities[common.BytesToHash(key)].Value); got != "data" {
+			t.Errorf("expected payload %q at block %d, got %q", "data", tc.atBlock, got)
+		}
+	}
+
+	if got := countRows(t, s, "payload_contents"); got != 1 {
+		t.Errorf("expected the payload to be stored once, got %d payload contents", got)
+	}
+
+	var toBlock uint64
+	err = s.writePool.QueryRow("SELECT to_block FROM payloads WHERE from_block = 5").Scan(&toBlock)
+	if err != nil {
+		t.Fatalf("failed to query payloads: %v", err)
+	}
+	if toBlock != math.MaxInt64 {
+		t.Errorf("expected the current content to be open ended, got to_block %d", toBlock)
+	}
+}
+
+func TestFollowEvents_DeduplicatesPayloads(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "template", nil, nil),
+				createOp(key2, owner, 100, "template", nil, nil),
+			}},
+			events.Block{Number: 2, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: key1, Owner: owner, BTL: 100, Content: []byte("changed")}},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	if got := countRows(t, s, "payload_contents"); got != 2 {
+		t.Fatalf("expected 2 distinct payload contents, got %d", got)
+	}
+
+	atBlock := uint64(1)
+	for key, entity := range queryKeys(t, s, `$all`, &atBlock) {
+		if string(entity.Value) != "template" {
+			t.Errorf("expected payload of %s at block 1 to be the template, got %q", key, entity.Value)
+		}
+	}
+
+	// Pruning the first version of key1 keeps the content that key2 still uses
+	err = s.PruneHistory(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("PruneHistory failed: %v", err)
+	}
+	if got := countRows(t, s, "payload_contents"); got != 2 {
+		t.Fatalf("expected 2 payload contents after pruning, got %d", got)
+	}
+
+	err = s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 3, Operations: []events.Operation{
+				{Delete: (*events.OPDelete)(&key2)},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	err = s.PruneHistory(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("PruneHistory failed: %v", err)
+	}
+	if got := countRows(t, s, "payload_contents"); got != 1 {
+		t.Fatalf("expected the unreferenced content to be removed, got %d payload contents", got)
+	}
+
+	entities := queryKeys(t, s, `$all`, nil)
+	if len(entities) != 1 || string(entities[key1].Value) != "changed" {
+		t.Errorf("expected only the updated entity to remain, got %v", entities)
+	}
+}
+
+func TestPruneHistory_Boundary(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+	key3 := common.HexToHash("0x3")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "one", nil, nil),
+				createOp(key2, owner, 100, "two", nil, nil),
+				createOp(key3, owner, 100, "three", nil, nil),
+			}},
+			// The first version of key1 ends at the boundary block
+			events.Block{Number: 3, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: key1, Owner: owner, BTL: 100, Content: []byte("one updated")}},
+			}},
+			// The first version of key2 ends after it
+			events.Block{Number: 4, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: key2, Owner: owner, BTL: 100, Content: []byte("two updated")}},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	atBlock := uint64(2)
+	if got := queryKeys(t, s, `$all`, &atBlock); len(got) != 3 {
+		t.Fatalf("expected 3 entities at block 2 before pruning, got %d", len(got))
+	}
+
+	if err := s.PruneHistory(context.Background(), 3); err != nil {
+		t.Fatalf("PruneHistory failed: %v", err)
+	}
+
+	// Only the version that ended at block 3 is gone, key3 started before the
+	// block but is still valid
+	got := queryKeys(t, s, `$all`, &atBlock)
+	if _, ok := got[key1]; ok || len(got) != 2 {
+		t.Errorf("expected key2 and key3 at block 2 after pruning, got %v", got)
+	}
+	atBlock = 3
+	if got := queryKeys(t, s, `$all`, &atBlock); len(got) != 3 {
+		t.Errorf("expected 3 entities at block 3 after pruning, got %d", len(got))
+	}
+	if got := countRows(t, s, "payloads"); got != 4 {
+		t.Errorf("expected 4 payload versions after pruning, got %d", got)
+	}
+	if got := countRows(t, s, "entity_metadata"); got != 4 {
+		t.Errorf("expected 4 metadata versions after pruning, got %d", got)
+	}
+}
+
+func TestFollowEvents_CompressesPayloads(t *testing.T) {
+	s := newTestStore(t, WithCompressionPolicy(CompressionPolicy{
+		ContentTypes: map[string]CompressionRule{
+			"text/*": {Codec: CodecZstd, MinSize: 64},
+		},
+	}))
+
+	owner := common.HexToAddress("0x1")
+	large := common.HexToHash("0x1")
+	small := common.HexToHash("0x2")
+	largeContent := strings.Repeat("compressible ", 100)
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(large, owner, 100, largeContent, nil, nil),
+				createOp(small, owner, 100, "tiny", nil, nil),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	codecs := map[string]string{}
+	rows, err := s.readPool.QueryContext(context.Background(), "SELECT codec, size, length(payload) FROM payload_contents")
+	if err != nil {
+		t.Fatalf("failed to query payload contents: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			codec  string
+			size   int
+			stored int
+		)
+		if err := rows.Scan(&codec, &size, &stored); err != nil {
+			t.Fatalf("failed to scan payload contents: %v", err)
+		}
+		if codec == string(CodecZstd) && stored >= size {
+			t.Errorf("expected compressed payload to be smaller than %d bytes, got %d", size, stored)
+		}
+		codecs[fmt.Sprint(size)] = codec
+	}
+	if codecs[fmt.Sprint(len(largeContent))] != string(CodecZstd) || codecs["4"] != string(CodecNone) {
+		t.Fatalf("unexpected codecs by payload size: %v", codecs)
+	}
+
+	entities := queryKeys(t, s, `$all`, nil)
+	if string(entities[large].Value) != largeContent {
+		t.Errorf("expected large payload to be decompressed, got %q", entities[large].Value)
+	}
+	if string(entities[small].Value) != "tiny" {
+		t.Errorf("expected small payload to be returned as is, got %q", entities[small].Value)
+	}
+}
+
+func TestFollowEvents_InternsKeysAndNames(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "a", map[string]string{"type": "a"}, map[string]uint64{"price": 1}),
+				createOp(key2, owner, 100, "b", map[string]string{"type": "b"}, map[string]uint64{"price": 2}),
+			}},
+			events.Block{Number: 2, Operations: []events.Operation{
+				{Delete: (*events.OPDelete)(&key2)},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	if got := countRows(t, s, "entity_keys"); got != 2 {
+		t.Fatalf("expected 2 entity keys, got %d", got)
+	}
+
+	// type, price and the synthetic attributes are only stored once
+	names := countRows(t, s, "attribute_names")
+	if names != 8 {
+		t.Fatalf("expected 8 attribute names, got %d", names)
+	}
+
+	entities := queryKeys(t, s, `type = "a" && price = 1`, nil)
+	if _, ok := entities[key1]; !ok || len(entities) != 1 {
+		t.Fatalf("expected only %s to match, got %v", key1, entities)
+	}
+
+	// The key of the deleted entity goes away once its history is pruned
+	err = s.PruneHistory(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("PruneHistory failed: %v", err)
+	}
+	if got := countRows(t, s, "entity_keys"); got != 1 {
+		t.Fatalf("expected 1 entity key after pruning, got %d", got)
+	}
+}
+
+func TestQueryEntities_ForcedEvaluator(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), owner, 100, "a", map[string]string{"type": "a"}, map[string]uint64{"price": 1}),
+				createOp(common.HexToHash("0x2"), owner, 100, "b", map[string]string{"type": "b"}, map[string]uint64{"price": 2}),
+				createOp(common.HexToHash("0x3"), owner, 100, "c", map[string]string{"type": "a"}, map[string]uint64{"price": 3}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	for _, q := range []string{`type = "a" || price = 2`, `type = "a" && price > 1`, `$all`} {
+		results := map[string]int{}
+		for _, evaluator := range []string{query.EvaluatorExists, query.EvaluatorTables} {
+			response, err := s.QueryEntities(context.Background(), q, &query.Options{Evaluator: evaluator})
+			if err != nil {
+				t.Fatalf("QueryEntities(%q) with the %s evaluator failed: %v", q, evaluator, err)
+			}
+			results[evaluator] = len(response.Data)
+		}
+		if results[query.EvaluatorExists] != results[query.EvaluatorTables] {
+			t.Errorf("evaluators disagree on %q: %v", q, results)
+		}
+	}
+
+	_, err = s.QueryEntities(context.Background(), `$all`, &query.Options{Evaluator: "unknown"})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown evaluator")
+	}
+}
+
+func TestQueryEntities_MixedEvaluator(t *testing.T) {
+	s := newTestStore(t)
+
+	ops := []events.Operation{}
+	for i := range 100 {
+		ops = append(ops, createOp(
+			common.BigToHash(big.NewInt(int64(i+1))),
+			common.HexToAddress("0x1"),
+			100,
+			"a",
+			map[string]string{"type": fmt.Sprint("type", i%2), "id": fmt.Sprint("id", i)},
+			nil,
+		))
+	}
+	if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	// The first branch matches half of the entities and the others a single
+	// one, so only the first branch is evaluated from the payloads
+	q := `type = "type0" && id ~ "id1*" || id = "id7" || id = "id9"`
+
+	explanation, err := s.Explain(context.Background(), q, nil)
+	if err != nil {
+		t.Fatalf("Explain failed: %v", err)
+	}
+	if explanation.Evaluator != query.EvaluatorMixed {
+		t.Errorf("expected the %s evaluator, got %s", query.EvaluatorMixed, explanation.Evaluator)
+	}
+
+	expected := []common.Hash{}
+	for _, i := range []int{7, 9, 10, 12, 14, 16, 18} {
+		expected = append(expected, common.BigToHash(big.NewInt(int64(i+1))))
+	}
+
+	response, err := s.QueryEntities(context.Background(), q, &query.Options{
+		IncludeData: &query.IncludeData{Key: true},
+	})
+	if err != nil {
+		t.Fatalf("QueryEntities failed: %v", err)
+	}
+
+	got := []common.Hash{}
+	for _, raw := range response.Data {
+		entity := query.EntityData{}
+		if err := json.Unmarshal(raw, &entity); err != nil {
+			t.Fatalf("failed to unmarshal entity: %v", err)
+		}
+		got = append(got, *entity.Key)
+	}
+	slices.SortFunc(got, func(a, b common.Hash) int { return a.Cmp(b) })
+
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("matched %v, expected %v", got, expected)
+	}
+
+	expectMatches(t, s, q, expected)
+}
+
+func TestFollowEvents_MaintainsStatistics(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+	key3 := common.HexToHash("0x3")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "a", map[string]string{"type": "a"}, map[string]uint64{"price": 10}),
+				createOp(key2, owner, 100, "b", map[string]string{"type": "a"}, map[string]uint64{"price": 20}),
+				createOp(key3, owner, 100, "c", map[string]string{"type": "b"}, map[string]uint64{"price": 30}),
+			}},
+			events.Block{Number: 2, Operations: []events.Operation{
+				{Update: &events.OPUpdate{Key: key1, Owner: owner, BTL: 100, Content: []byte("a"), StringAttributes: map[string]string{"type": "c"}}},
+				{Delete: (*events.OPDelete)(&key3)},
+				{ExtendBTL: &events.OPExtendBTL{Key: key2, BTL: 200}},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	statistics, err := s.GetStatistics(context.Background())
+	if err != nil {
+		t.Fatalf("GetStatistics failed: %v", err)
+	}
+
+	if statistics.BlockNumber != 2 || statistics.Entities != 2 {
+		t.Fatalf("expected 2 entities at block 2, got %d at block %d", statistics.Entities, statistics.BlockNumber)
+	}
+
+	byName := map[string]AttributeStatistics{}
+	for _, attribute := range statistics.Attributes {
+		byName[attribute.Name+"/"+attribute.Type] = attribute
+	}
+
+	typeStats := byName["type/string"]
+	if typeStats.Entities != 2 || typeStats.DistinctValues != 2 {
+		t.Errorf("unexpected statistics for type: %+v", typeStats)
+	}
+
+	// key1 no longer has a price and key3 is deleted
+	priceStats, ok := byName["price/numeric"]
+	if !ok || priceStats.Entities != 1 || priceStats.DistinctValues != 1 ||
+		priceStats.Min == nil || *priceStats.Min != 20 || priceStats.Max == nil || *priceStats.Max != 20 {
+		t.Errorf("unexpected statistics for price: %+v", priceStats)
+	}
+}
+
+func TestFollowEvents_ClosesContentOnExpiry(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	expiring := common.HexToHash("0x1")
+	living := common.HexToHash("0x2")
+	extended := common.HexToHash("0x3")
+	expired := common.HexToHash("0x4")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(expiring, owner, 10, "a", map[string]string{"type": "a"}, map[string]uint64{"n": 1}),
+				createOp(living, owner, 100, "b", map[string]string{"type": "a"}, map[string]uint64{"n": 2}),
+				createOp(extended, owner, 5, "c", map[string]string{"type": "a"}, map[string]uint64{"n": 3}),
+				createOp(expired, owner, 4, "d", map[string]string{"type": "a"}, map[string]uint64{"n": 4}),
+			}},
+			events.Block{Number: 3, Operations: []events.Operation{
+				{ExtendBTL: &events.OPExtendBTL{Key: extended, BTL: 50}},
+			}},
+			events.Block{Number: 5, Operations: []events.Operation{
+				{Expire: (*events.OPExpire)(&expired)},
+			}},
+		),
+		// The first entity expires at block 11 without an Expire operation
+		batchOf(events.Block{Number: 20}),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	var toBlock uint64
+	err = s.writePool.QueryRow(
+		"SELECT p.to_block FROM payloads AS p INNER JOIN entity_keys AS k ON k.id = p.entity_id WHERE k.entity_key = ?",
+		expiring.Bytes(),
+	).Scan(&toBlock)
+	if err != nil {
+		t.Fatalf("failed to get the payload of the expired entity: %v", err)
+	}
+	if toBlock != 11 {
+		t.Errorf("expected the content to end at the expiration block 11, got %d", toBlock)
+	}
+
+	statistics, err := s.GetStatistics(context.Background())
+	if err != nil {
+		t.Fatalf("GetStatistics failed: %v", err)
+	}
+	if statistics.Entities != 2 {
+		t.Errorf("expected 2 live entities, got %d", statistics.Entities)
+	}
+	for _, attribute := range statistics.Attributes {
+		if attribute.Name == "type" && attribute.Entities != 2 {
+			t.Errorf("expected 2 live entities with type, got %d", attribute.Entities)
+		}
+	}
+
+	// The entity is still visible before it expired
+	atBlock := uint64(10)
+	if got := queryKeys(t, s, `n = 1`, &atBlock); len(got) != 1 {
+		t.Errorf("expected the entity at block %d, got %d entities", atBlock, len(got))
+	}
+
+	if err := s.PruneHistory(context.Background(), 20); err != nil {
+		t.Fatalf("PruneHistory failed: %v", err)
+	}
+	if got := countRows(t, s, "payloads"); got != 2 {
+		t.Errorf("expected the payloads of the 2 live entities after pruning, got %d", got)
+	}
+	if got := countRows(t, s, "numeric_attributes WHERE name_id = (SELECT id FROM attribute_names WHERE name = 'n')"); got != 2 {
+		t.Errorf("expected the attributes of the 2 live entities after pruning, got %d", got)
+	}
+}
+
+func TestQueryEntities_OrdersByContentChange(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+	key3 := common.HexToHash("0x3")
+	key4 := common.HexToHash("0x4")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "a", nil, nil),
+				createOp(key2, owner, 100, "b", nil, nil),
+			}},
+			// Entities that changed at the same block are ordered by the time
+			// their key was first seen
+			events.Block{Number: 2, Operations: []events.Operation{
+				createOp(key4, owner, 100, "d", nil, nil),
+				createOp(key3, owner, 100, "c", nil, nil),
+			}},
+			// Metadata changes don't change the order
+			events.Block{Number: 3, Operations: []events.Operation{
+				{ExtendBTL: &events.OPExtendBTL{Key: key1, BTL: 100}},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	response, err := s.QueryEntities(context.Background(), `$all`, &query.Options{
+		IncludeData: &query.IncludeData{Key: true, LastMetadataChangeAtBlock: true},
+	})
+	if err != nil {
+		t.Fatalf("QueryEntities failed: %v", err)
+	}
+
+	keys := []common.Hash{}
+	metadataBlocks := []uint64{}
+	for _, raw := range response.Data {
+		entity := query.EntityData{}
+		if err := json.Unmarshal(raw, &entity); err != nil {
+			t.Fatalf("failed to unmarshal entity: %v", err)
+		}
+		if entity.LastMetadataChangeAtBlock == nil {
+			t.Fatalf("entity %s is missing the last metadata change", entity.Key)
+		}
+		keys = append(keys, *entity.Key)
+		metadataBlocks = append(metadataBlocks, *entity.LastMetadataChangeAtBlock)
+	}
+
+	expected := []common.Hash{key1, key2, key4, key3}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("got entities in the order %v, expected %v", keys, expected)
+	}
+	if expected := []uint64{3, 1, 2, 2}; fmt.Sprint(metadataBlocks) != fmt.Sprint(expected) {
+		t.Errorf("got the metadata changes %v, expected %v", metadataBlocks, expected)
+	}
+}
+
+func TestQueryEntities_DefaultOrderUsesIndex(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), owner, 100, "a", map[string]string{"type": "a"}, map[string]uint64{"price": 1}),
+				createOp(common.HexToHash("0x2"), owner, 100, "b", map[string]string{"type": "b"}, map[string]uint64{"price": 2}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	var usesTempBTree func(steps []*QueryPlanStep) bool
+	usesTempBTree = func(steps []*QueryPlanStep) bool {
+		for _, step := range steps {
+			if strings.Contains(step.Detail, "USE TEMP B-TREE") || usesTempBTree(step.Children) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The exists evaluator, which is used for the queries that match many
+	// entities, reads the payloads in the order of the index and stops after
+	// a page. The tables evaluator sorts the few matches it collects.
+	for _, q := range []string{`$all`, `type = "a"`, `price > 1`, `type = "a" || price > 1`} {
+		explanation, err := s.Explain(context.Background(), q, &query.Options{Evaluator: query.EvaluatorExists})
+		if err != nil {
+			t.Fatalf("Explain(%q) failed: %v", q, err)
+		}
+		if usesTempBTree(explanation.Plan) {
+			t.Errorf("query %q sorts the matches: %s", q, explanation.SQL)
+		}
+	}
+}
+
+func TestFollowEvents_StatisticsRangeIsUnsigned(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+	key1 := common.HexToHash("0x1")
+	key2 := common.HexToHash("0x2")
+	key3 := common.HexToHash("0x3")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, owner, 100, "a", nil, map[string]uint64{"price": 5}),
+				createOp(key2, owner, 100, "b", nil, map[string]uint64{"price": 1 << 63}),
+				createOp(key3, owner, 100, "c", nil, map[string]uint64{"price": math.MaxUint64}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	expectRange := func(min, max uint64) {
+		t.Helper()
+
+		statistics, err := s.GetStatistics(context.Background())
+		if err != nil {
+			t.Fatalf("GetStatistics failed: %v", err)
+		}
+		for _, attribute := range statistics.Attributes {
+			if attribute.Name != "price" {
+				continue
+			}
+			if attribute.Min == nil || attribute.Max == nil {
+				t.Fatalf("expected a range for price")
+			}
+			if *attribute.Min != min || *attribute.Max != max {
+				t.Errorf("expected the range [%d, %d], got [%d, %d]", min, max, *attribute.Min, *attribute.Max)
+			}
+			return
+		}
+		t.Errorf("expected statistics for price")
+	}
+
+	expectRange(5, math.MaxUint64)
+
+	err = s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 2, Operations: []events.Operation{
+				{Delete: (*events.OPDelete)(&key1)},
+				{Delete: (*events.OPDelete)(&key3)},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	expectRange(1<<63, 1<<63)
+}
+
+func TestListAttributeKeys(t *testing.T) {
+	s := newTestStore(t)
+
+	alice := common.HexToAddress("0xa")
+	bob := common.HexToAddress("0xb")
+	key1 := common.HexToHash("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(key1, alice, 100, "a", map[string]string{"type": "listing", "city": "Paris"}, map[string]uint64{"price": 1}),
+				createOp(common.HexToHash("0x2"), alice, 100, "b", map[string]string{"type": "listing"}, map[string]uint64{"price": 2}),
+				createOp(common.HexToHash("0x3"), bob, 100, "c", map[string]string{"type": "order"}, nil),
+			}},
+			events.Block{Number: 2, Operations: []events.Operation{
+				{Delete: (*events.OPDelete)(&key1)},
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	listKeys := func(atBlock *uint64, filter *AttributeKeysFilter) string {
+		t.Helper()
+		keys, err := s.ListAttributeKeys(context.Background(), atBlock, filter)
+		if err != nil {
+			t.Fatalf("ListAttributeKeys failed: %v", err)
+		}
+		parts := []string{}
+		for _, key := range keys {
+			parts = append(parts, fmt.Sprintf("%s:%s:%d", key.Name, key.Type, key.Entities))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	if got, want := listKeys(nil, nil), "price:numeric:1 type:string:2"; got != want {
+		t.Errorf("expected %q at the head, got %q", want, got)
+	}
+
+	atBlock := uint64(1)
+	if got, want := listKeys(&atBlock, nil), "city:string:1 price:numeric:2 type:string:3"; got != want {
+		t.Errorf("expected %q at block 1, got %q", want, got)
+	}
+
+	if got, want := listKeys(&atBlock, &AttributeKeysFilter{Query: `type = "listing"`, Owner: &alice}), "city:string:1 price:numeric:2 type:string:2"; got != want {
+		t.Errorf("expected %q for the listings of alice, got %q", want, got)
+	}
+
+	if got, want := listKeys(nil, &AttributeKeysFilter{Owner: &bob, IncludeSynthetic: true}), "$contentType:string:1 $createdAtBlock:numeric:1 $creator:string:1 $expiration:numeric:1 $key:string:1 $opIndex:numeric:1 $owner:string:1 $payloadSize:numeric:1 $sequence:numeric:1 $txIndex:numeric:1 type:string:1"; got != want {
+		t.Errorf("expected %q for bob, got %q", want, got)
+	}
+}
+
+func TestQueryFacets(t *testing.T) {
+	s := newTestStore(t)
+
+	alice := common.HexToAddress("0xa")
+	bob := common.HexToAddress("0xb")
+
+	listing := func(key string, owner common.Address, city string, rooms uint64) events.Operation {
+		return createOp(common.HexToHash(key), owner, 100, key, map[string]string{"type": "listing", "city": city}, map[string]uint64{"rooms": rooms})
+	}
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				listing("0x1", alice, "Paris", 2),
+				listing("0x2", alice, "Paris", 3),
+				listing("0x3", bob, "Berlin", 2),
+				listing("0x4", bob, "Rome", 2),
+				createOp(common.HexToHash("0x5"), bob, 100, "e", map[string]string{"type": "order", "city": "Rome"}, nil),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	response, err := s.QueryFacets(context.Background(), `type = "listing"`, &FacetOptions{
+		Facets: []Facet{
+			{Name: "city", Type: "string", Limit: 2},
+			{Name: "rooms", Type: "numeric"},
+			{Name: query.OwnerAttributeKey, Type: "string"},
+			{Name: query.ExpirationAttributeKey, Type: "numeric"},
+			{Name: query.ContentTypeAttributeKey, Type: "string"},
+			{Name: query.PayloadSizeAttributeKey, Type: "numeric"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("QueryFacets failed: %v", err)
+	}
+
+	if response.Entities != 4 || response.BlockNumber != 1 {
+		t.Fatalf("expected 4 matching entities at block 1, got %d at block %d", response.Entities, response.BlockNumber)
+	}
+
+	got := []string{}
+	for _, facet := range response.Facets {
+		values := []string{}
+		for _, value := range facet.Values {
+			values = append(values, fmt.Sprintf("%v=%d", value.Value, value.Entities))
+		}
+		got = append(got, facet.Name+": "+strings.Join(values, " "))
+	}
+
+	want := []string{
+		"city: Paris=2 Berlin=1",
+		"rooms: 2=3 3=1",
+		fmt.Sprintf("$owner: %s=2 %s=2", strings.ToLower(alice.Hex()), strings.ToLower(bob.Hex())),
+		"$expiration: 101=4",
+		"$contentType: text/plain=4",
+		"$payloadSize: 3=4",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected facets:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	_, err = s.QueryFacets(context.Background(), `$all`, &FacetOptions{Facets: []Facet{{Name: "city"}}})
+	if err == nil {
+		t.Fatalf("expected an error for a facet without a type")
+	}
+
+	_, err = s.QueryFacets(context.Background(), `$all`, &FacetOptions{Facets: []Facet{{Name: query.PayloadSizeAttributeKey, Type: "string"}}})
+	if err == nil {
+		t.Fatalf("expected an error for a metadata facet of the wrong type")
+	}
+}
+
+func TestQueryEntities_NestedParsing(t *testing.T) {
+	dnf := newTestStore(t)
+	nested := newTestStore(t, WithParseOptions(query.ParseOptions{Nested: true}))
+
+	owner := common.HexToAddress("0x1")
+	operations := []events.Operation{}
+	for i := range uint64(8) {
+		operations = append(operations, createOp(
+			common.BigToHash(new(big.Int).SetUint64(i+1)),
+			owner, 100, "x",
+			map[string]string{"type": []string{"a", "b"}[i%2]},
+			map[string]uint64{"n": i, "m": i % 3},
+		))
+	}
+
+	for _, s := range []*SQLiteStore{dnf, nested} {
+		err := s.FollowEvents(context.Background(), iterateBatches(
+			batchOf(events.Block{Number: 1, Operations: operations}),
+		))
+		if err != nil {
+			t.Fatalf("FollowEvents failed: %v", err)
+		}
+	}
+
+	queries := []string{
+		`(type = "a" || n > 5) && (m = 0 || m = 2)`,
+		`!(type = "a" && (n < 3 || m = 1)) && n != 7`,
+		`!((n >= 2 || m = 0) && type = "b") || n = 1`,
+	}
+	for _, q := range queries {
+		for _, evaluator := range []string{query.EvaluatorExists, query.EvaluatorTables} {
+			options := &query.Options{Evaluator: evaluator, IncludeData: &query.IncludeData{Key: true}}
+
+			expected, err := dnf.QueryEntities(context.Background(), q, options)
+			if err != nil {
+				t.Fatalf("QueryEntities(%q) failed: %v", q, err)
+			}
+			got, err := nested.QueryEntities(context.Background(), q, options)
+			if err != nil {
+				t.Fatalf("QueryEntities(%q) without DNF failed: %v", q, err)
+			}
+
+			if len(expected.Data) == 0 || fmt.Sprint(expected.Data) != fmt.Sprint(got.Data) {
+				t.Errorf("results of %q with the %s evaluator differ without DNF: %s != %s", q, evaluator, got.Data, expected.Data)
+			}
+		}
+	}
+}
+
+func TestQueryEntities_Exists(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), owner, 100, "a", map[string]string{"type": "a"}, nil),
+				createOp(common.HexToHash("0x2"), owner, 100, "b", nil, map[string]uint64{"type": 2}),
+				createOp(common.HexToHash("0x3"), owner, 100, "c", map[string]string{"other": "c"}, nil),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	cases := []struct {
+		query    string
+		expected []common.Hash
+	}{
+		{`exists(type)`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2")}},
+		{`!exists(type)`, []common.Hash{common.HexToHash("0x3")}},
+		{`!(exists(type) || exists(other))`, nil},
+		{`exists(type) && !exists(other)`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2")}},
+		{`exists(unknown)`, nil},
+		{`exists($owner)`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2"), common.HexToHash("0x3")}},
+		{`!exists($expiration)`, nil},
+	}
+
+	for _, c := range cases {
+		expectMatches(t, s, c.query, c.expected)
+	}
+}
+
+func TestQueryEntities_SyntheticAttributes(t *testing.T) {
+	s := newTestStore(t)
+
+	alice := common.HexToAddress("0xa")
+	bob := common.HexToAddress("0xb")
+
+	image := createOp(common.HexToHash("0x3"), bob, 100, "a larger payload", nil, nil)
+	image.Create.ContentType = "image/png"
+	image.OpIndex = 1
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), alice, 100, "a", nil, nil),
+			}},
+			events.Block{Number: 2, Operations: []events.Operation{
+				createOp(common.HexToHash("0x2"), alice, 100, "bb", nil, nil),
+				image,
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	cases := []struct {
+		query    string
+		expected []common.Hash
+	}{
+		{`$createdAtBlock > 1`, []common.Hash{common.HexToHash("0x2"), common.HexToHash("0x3")}},
+		{`$createdAtBlock <= 1`, []common.Hash{common.HexToHash("0x1")}},
+		{`$opIndex >= 1`, []common.Hash{common.HexToHash("0x3")}},
+		{`$owner IN ("` + bob.Hex() + `")`, []common.Hash{common.HexToHash("0x3")}},
+		{`$owner NOT IN ("` + bob.Hex() + `")`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2")}},
+		{`$contentType = "text/plain"`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2")}},
+		{`$contentType ~ "image/*"`, []common.Hash{common.HexToHash("0x3")}},
+		{`$payloadSize > 1 && $payloadSize < 10`, []common.Hash{common.HexToHash("0x2")}},
+		{`!($payloadSize >= 2)`, []common.Hash{common.HexToHash("0x1")}},
+		{`$key > "` + common.HexToHash("0x1").Hex() + `"`, []common.Hash{common.HexToHash("0x2"), common.HexToHash("0x3")}},
+	}
+
+	for _, c := range cases {
+		expectMatches(t, s, c.query, c.expected)
+	}
+}
+
+func TestQueryEntities_Between(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), owner, 100, "a", map[string]string{"name": "apple"}, map[string]uint64{"price": 5}),
+				createOp(common.HexToHash("0x2"), owner, 100, "b", map[string]string{"name": "banana"}, map[string]uint64{"price": 10}),
+				createOp(common.HexToHash("0x3"), owner, 100, "c", map[string]string{"name": "cherry"}, map[string]uint64{"price": 20}),
+				createOp(common.HexToHash("0x4"), owner, 100, "d", nil, nil),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	cases := []struct {
+		query    string
+		expected []common.Hash
+	}{
+		{`price BETWEEN 10 AND 20`, []common.Hash{common.HexToHash("0x2"), common.HexToHash("0x3")}},
+		{`price NOT BETWEEN 10 AND 20`, []common.Hash{common.HexToHash("0x1")}},
+		{`!(price BETWEEN 6 AND 20)`, []common.Hash{common.HexToHash("0x1")}},
+		{`name BETWEEN "b" AND "c"`, []common.Hash{common.HexToHash("0x2")}},
+		{`price BETWEEN 20 AND 10`, nil},
+		{`$payloadSize BETWEEN 1 AND 1 && price between 0 and 5`, []common.Hash{common.HexToHash("0x1")}},
+	}
+
+	for _, c := range cases {
+		expectMatches(t, s, c.query, c.expected)
+	}
+}
+
+func TestQueryEntities_AttributeComparisons(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), owner, 100, "a", map[string]string{"from": "a", "to": "b"}, map[string]uint64{"minBid": 1, "maxBid": 5, "deadline": 50}),
+				createOp(common.HexToHash("0x2"), owner, 10, "b", map[string]string{"from": "b", "to": "a"}, map[string]uint64{"minBid": 5, "maxBid": 5, "deadline": 200}),
+				createOp(common.HexToHash("0x3"), owner, 100, "c", nil, map[string]uint64{"minBid": 7}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	cases := []struct {
+		query    string
+		expected []common.Hash
+	}{
+		{`minBid < $attr(maxBid)`, []common.Hash{common.HexToHash("0x1")}},
+		{`!(minBid < $attr(maxBid))`, []common.Hash{common.HexToHash("0x2")}},
+		{`minBid = $attr(maxBid)`, []common.Hash{common.HexToHash("0x2")}},
+		{`maxBid >= $attr(minBid) + 4`, []common.Hash{common.HexToHash("0x1")}},
+		{`minBid > $attr(maxBid) - 1`, []common.Hash{common.HexToHash("0x2")}},
+		{`from < $attr(to)`, []common.Hash{common.HexToHash("0x1")}},
+		{`from < $attr(maxBid)`, nil},
+		{`$expiration > $attr(deadline)`, []common.Hash{common.HexToHash("0x1")}},
+		{`$expiration > $createdAtBlock + 50`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x3")}},
+		{`$owner = $creator`, []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2"), common.HexToHash("0x3")}},
+	}
+
+	for _, c := range cases {
+		expectMatches(t, s, c.query, c.expected)
+	}
+}
+
+func TestQueryEntities_Arguments(t *testing.T) {
+	s := newTestStore(t)
+
+	alice := common.HexToAddress("0xa")
+	bob := common.HexToAddress("0xb")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), alice, 100, "a", map[string]string{"name": `it's "quoted"`}, map[string]uint64{"price": 5}),
+				createOp(common.HexToHash("0x2"), alice, 100, "b", map[string]string{"name": "plain"}, map[string]uint64{"price": 20}),
+				createOp(common.HexToHash("0x3"), bob, 100, "c", map[string]string{"name": "plain"}, map[string]uint64{"price": 30}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	cases := []struct {
+		query     string
+		arguments []query.Argument
+		expected  []common.Hash
+	}{
+		{`$owner = $1 && price > $2`, []query.Argument{query.AddressArgument(alice), query.NumberArgument(10)}, []common.Hash{common.HexToHash("0x2")}},
+		{`name = $1`, []query.Argument{query.StringArgument(`it's "quoted"`)}, []common.Hash{common.HexToHash("0x1")}},
+		{`name = $1`, []query.Argument{query.StringArgument(`" || $all || "`)}, []common.Hash{}},
+		{`$key IN $1`, []query.Argument{query.StringsArgument(common.HexToHash("0x3").Hex())}, []common.Hash{common.HexToHash("0x3")}},
+	}
+
+	for _, c := range cases {
+		response, err := s.QueryEntities(context.Background(), c.query, &query.Options{
+			IncludeData: &query.IncludeData{Key: true},
+			Arguments:   c.arguments,
+		})
+		if err != nil {
+			t.Fatalf("QueryEntities(%q) failed: %v", c.query, err)
+		}
+
+		got := []common.Hash{}
+		for _, raw := range response.Data {
+			entity := query.EntityData{}
+			if err := json.Unmarshal(raw, &entity); err != nil {
+				t.Fatalf("failed to unmarshal entity: %v", err)
+			}
+			got = append(got, *entity.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expected) {
+			t.Errorf("%q with %v matched %v, expected %v", c.query, c.arguments, got, c.expected)
+		}
+	}
+
+	_, err = s.QueryEntities(context.Background(), `price > $1`, nil)
+	if !errors.Is(err, query.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument without arguments, got %v", err)
+	}
+}
+
+func TestQueryEntitiesAST(t *testing.T) {
+	s := newTestStore(t)
+
+	owner := common.HexToAddress("0x1")
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), owner, 100, "a", map[string]string{"type": "order"}, map[string]uint64{"price": 5}),
+				createOp(common.HexToHash("0x2"), owner, 100, "b", map[string]string{"type": "order"}, map[string]uint64{"price": 20}),
+				createOp(common.HexToHash("0x3"), owner, 100, "c", map[string]string{"type": `"quoted"`}, map[string]uint64{"price": 30}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	cases := []struct {
+		expr     query.Expr
+		expected int
+	}{
+		{query.And(query.Eq("type", "order"), query.Gt("price", 10)), 1},
+		{query.Eq("type", `"quoted"`), 1},
+		{query.Not(query.Eq("type", "order")), 1},
+	}
+
+	for _, c := range cases {
+		ast, err := query.Build(c.expr)
+		if err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+
+		response, err := s.QueryEntitiesAST(context.Background(), ast, nil)
+		if err != nil {
+			t.Fatalf("QueryEntitiesAST failed: %v", err)
+		}
+		if len(response.Data) != c.expected {
+			t.Errorf("expected %d entities, got %d", c.expected, len(response.Data))
+		}
+	}
+}
+
+func TestQueryEntities_ParseError(t *testing.T) {
+	s := newTestStore(t)
+
+	_, err := s.QueryEntities(context.Background(), `type = "order" & price > 10`, nil)
+
+	var parseError *query.ParseError
+	if !errors.As(err, &parseError) {
+		t.Fatalf("expected a ParseError, got %v", err)
+	}
+	if parseError.Line != 1 || parseError.Column != 16 || parseError.Token != "&" {
+		t.Errorf("unexpected position %d:%d of %q", parseError.Line, parseError.Column, parseError.Token)
+	}
+	if parseError.Suggestion == "" {
+		t.Errorf("expected a suggestion for a single &")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	s := newTestStore(t)
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, map[string]uint64{"price": 5}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	for _, evaluator := range []string{query.EvaluatorExists, query.EvaluatorTables} {
+		explanation, err := s.Explain(context.Background(), `type = "order" && price > $1`, &query.Options{
+			Evaluator: evaluator,
+			Arguments: []query.Argument{query.NumberArgument(1)},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+
+		if explanation.Evaluator != evaluator {
+			t.Errorf("expected the %s evaluator, got %s", evaluator, explanation.Evaluator)
+		}
+		if explanation.Query != `type = "order" && price > $1` {
+			t.Errorf("unexpected query %q", explanation.Query)
+		}
+		if explanation.SQL == "" || len(explanation.Args) == 0 {
+			t.Errorf("expected the SQL and its arguments, got %q %v", explanation.SQL, explanation.Args)
+		}
+		if len(explanation.Plan) == 0 {
+			t.Fatalf("expected a query plan")
+		}
+
+		// Every step is linked to its parent
+		var check func(steps []*QueryPlanStep, parent int)
+		check = func(steps []*QueryPlanStep, parent int) {
+			for _, step := range steps {
+				if step.Detail == "" {
+					t.Errorf("step %d has no detail", step.ID)
+				}
+				if parent != 0 && step.Parent != parent {
+					t.Errorf("step %d has parent %d, expected %d", step.ID, step.Parent, parent)
+				}
+				check(step.Children, step.ID)
+			}
+		}
+		check(explanation.Plan, 0)
+	}
+
+	_, err = s.Explain(context.Background(), `type = `, nil)
+	var parseError *query.ParseError
+	if !errors.As(err, &parseError) {
+		t.Errorf("expected a ParseError, got %v", err)
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	s := newTestStore(t, WithSlowQueryLog(0, 2))
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(
+			events.Block{Number: 1, Operations: []events.Operation{
+				createOp(common.HexToHash("0x1"), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, map[string]uint64{"price": 5}),
+				createOp(common.HexToHash("0x2"), common.HexToAddress("0x1"), 100, "b", map[string]string{"type": "order"}, map[string]uint64{"price": 20}),
+			}},
+		),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	queries := []string{`price > 1`, `price > 10`, `type = "order"`}
+	for _, q := range queries {
+		if _, err := s.QueryEntities(context.Background(), q, nil); err != nil {
+			t.Fatalf("QueryEntities(%q) failed: %v", q, err)
+		}
+		// The plans are recorded in the background
+		s.background.Wait()
+	}
+
+	slowQueries := s.SlowQueries()
+	if len(slowQueries) != 2 {
+		t.Fatalf("expected the last 2 queries, got %d", len(slowQueries))
+	}
+	for i, expected := range []struct {
+		query string
+		rows  uint64
+	}{{`price > 10`, 1}, {`type = "order"`, 2}} {
+		entry := slowQueries[i]
+		if entry.Query != expected.query || entry.Rows != expected.rows {
+			t.Errorf("entry %d is %q with %d rows, expected %q with %d rows", i, entry.Query, entry.Rows, expected.query, expected.rows)
+		}
+		if entry.SQL == "" || len(entry.Plan) == 0 || entry.AtBlock != 1 {
+			t.Errorf("entry %d is missing the SQL, the plan or the block: %+v", i, entry)
+		}
+	}
+
+	s.ClearSlowQueries()
+	if len(s.SlowQueries()) != 0 {
+		t.Errorf("expected no slow queries after clearing them")
+	}
+
+	// The row that is read to know whether there is a next page isn't
+	// counted
+	if _, err := s.QueryEntities(context.Background(), `type = "order"`, &query.Options{ResultsPerPage: 1}); err != nil {
+		t.Fatalf("QueryEntities failed: %v", err)
+	}
+	s.background.Wait()
+	if slowQueries := s.SlowQueries(); len(slowQueries) != 1 || slowQueries[0].Rows != 1 {
+		t.Errorf("expected a slow query with 1 row, got %+v", slowQueries)
+	}
+
+	for _, size := range []int{0, -1} {
+		disabled := newTestStore(t, WithSlowQueryLog(0, size))
+		if _, err := disabled.QueryEntities(context.Background(), `$all`, nil); err != nil {
+			t.Fatalf("QueryEntities failed: %v", err)
+		}
+		disabled.background.Wait()
+		if len(disabled.SlowQueries()) != 0 {
+			t.Errorf("expected no slow queries with a log of size %d", size)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err := NewSQLiteStore(logger, filepath.Join(t.TempDir(), "test.db"), 1, WithSlowQueryLog(0, 1))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore failed: %v", err)
+	}
+
+	if _, err := s.QueryEntities(context.Background(), `$all`, nil); err != nil {
+		t.Fatalf("QueryEntities failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The plan of the slow query was recorded before the pools were closed
+	if slowQueries := s.SlowQueries(); len(slowQueries) != 1 || len(slowQueries[0].Plan) == 0 {
+		t.Errorf("expected the slow query with its plan, got %+v", slowQueries)
+	}
+	if err := s.readPool.Ping(); err == nil {
+		t.Error("expected the read pool to be closed")
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	ops := []events.Operation{}
+	for i := range 3 {
+		ops = append(ops, createOp(common.BigToHash(big.NewInt(int64(i+1))), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, nil))
+	}
+
+	t.Run("max steps", func(t *testing.T) {
+		s := newTestStore(t, WithQueryLimits(QueryLimits{MaxSteps: 2000}))
+
+		many := []events.Operation{}
+		for i := range 200 {
+			many = append(many, createOp(common.BigToHash(big.NewInt(int64(i+1))), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, nil))
+		}
+		if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: many}))); err != nil {
+			t.Fatalf("FollowEvents failed: %v", err)
+		}
+
+		// The budget covers the rows that the query examines, not only the
+		// ones that it returns
+		_, err := s.QueryEntities(context.Background(), `type = "other"`, &query.Options{Evaluator: query.EvaluatorExists})
+		if !errors.Is(err, ErrTooManySteps) {
+			t.Errorf("expected ErrTooManySteps, got %v", err)
+		}
+
+		response, err := s.QueryEntities(context.Background(), `$key = 0x0000000000000000000000000000000000000000000000000000000000000001`, nil)
+		if err != nil {
+			t.Fatalf("QueryEntities failed: %v", err)
+		}
+		if len(response.Data) != 1 {
+			t.Errorf("expected 1 entity, got %d", len(response.Data))
+		}
+
+		// The connection doesn't keep the budget of the query
+		if _, err := s.readPool.ExecContext(context.Background(), "SELECT count(*) FROM payloads, payloads"); err != nil {
+			t.Errorf("query outside of the limits failed: %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		s := newTestStore(t, WithQueryLimits(QueryLimits{Timeout: time.Nanosecond}))
+		if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+			t.Fatalf("FollowEvents failed: %v", err)
+		}
+
+		_, err := s.QueryEntities(context.Background(), `type = "order"`, nil)
+		if !errors.Is(err, ErrQueryTimeout) {
+			t.Errorf("expected ErrQueryTimeout, got %v", err)
+		}
+
+		_, err = s.QueryFacets(context.Background(), `type = "order"`, &FacetOptions{Facets: []Facet{{Name: "type", Type: "string"}}})
+		if !errors.Is(err, ErrQueryTimeout) {
+			t.Errorf("expected ErrQueryTimeout for facets, got %v", err)
+		}
+	})
+
+	t.Run("admission", func(t *testing.T) {
+		a := newAdmission(QueryLimits{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: 10 * time.Millisecond})
+		if err := a.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+
+		// The slot doesn't free up while the query waits
+		if err := a.acquire(context.Background()); !errors.Is(err, ErrOverloaded) {
+			t.Errorf("expected ErrOverloaded after waiting, got %v", err)
+		}
+
+		// Without a timeout, a query waits until a slot frees up, but only one
+		// query can wait
+		a = newAdmission(QueryLimits{MaxConcurrent: 1, MaxQueued: 1})
+		if err := a.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+
+		waiting := make(chan error)
+		go func() { waiting <- a.acquire(context.Background()) }()
+		for a.queued.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if err := a.acquire(context.Background()); !errors.Is(err, ErrOverloaded) {
+			t.Errorf("expected ErrOverloaded with a full queue, got %v", err)
+		}
+
+		a.release()
+		if err := <-waiting; err != nil {
+			t.Errorf("expected the waiting query to run, got %v", err)
+		}
+
+		// By default, any number of queries wait for a slot
+		a = newAdmission(QueryLimits{MaxConcurrent: 1})
+		if err := a.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+		for range 3 {
+			go func() { waiting <- a.acquire(context.Background()) }()
+		}
+		for a.queued.Load() < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		for range 3 {
+			a.release()
+			if err := <-waiting; err != nil {
+				t.Errorf("expected the waiting query to run, got %v", err)
+			}
+		}
+
+		// Without a queue, a query fails while the slots are taken
+		a = newAdmission(QueryLimits{MaxConcurrent: 1, MaxQueued: -1})
+		if err := a.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+		if err := a.acquire(context.Background()); !errors.Is(err, ErrOverloaded) {
+			t.Errorf("expected ErrOverloaded without a queue, got %v", err)
+		}
+	})
+
+	t.Run("contended queries", func(t *testing.T) {
+		s := newTestStore(t, WithQueryLimits(QueryLimits{MaxConcurrent: 1}))
+		if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+			t.Fatalf("FollowEvents failed: %v", err)
+		}
+
+		// The queries that arrive while another one runs wait for it
+		errs := make(chan error, 8)
+		for range cap(errs) {
+			go func() {
+				_, err := s.QueryEntities(context.Background(), `type = "order"`, nil)
+				errs <- err
+			}()
+		}
+		for range cap(errs) {
+			if err := <-errs; err != nil {
+				t.Errorf("expected the contended query to run, got %v", err)
+			}
+		}
+	})
+}
+
+func TestEnsureBlockPresent_BoundedWait(t *testing.T) {
+	s := newTestStore(t, WithBlockWait(10, 50*time.Millisecond))
+
+	err := s.FollowEvents(context.Background(), iterateBatches(
+		batchOf(events.Block{Number: 1, Operations: []events.Operation{
+			createOp(common.HexToHash("0x1"), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, nil),
+		}}),
+	))
+	if err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	if err := s.EnsureBlockPresent(context.Background(), 1); err != nil {
+		t.Errorf("expected the head to be present, got %v", err)
+	}
+
+	for _, block := range []uint64{100, 5} {
+		atBlock := block
+		_, err := s.QueryEntities(context.Background(), `type = "order"`, &query.Options{AtBlock: &atBlock})
+
+		var notAvailable *BlockNotYetAvailableError
+		if !errors.As(err, &notAvailable) || !errors.Is(err, ErrBlockNotYetAvailable) {
+			t.Fatalf("expected ErrBlockNotYetAvailable for block %d, got %v", block, err)
+		}
+		if notAvailable.Block != block || notAvailable.Head != 1 {
+			t.Errorf("expected block %d with head 1, got %+v", block, notAvailable)
+		}
+	}
+}
+
+func TestQueryEntities_Cursor(t *testing.T) {
+	s := newTestStore(t, WithCursorKey([]byte("secret")))
+
+	ops := []events.Operation{}
+	for i := range 5 {
+		ops = append(ops, createOp(common.BigToHash(big.NewInt(int64(i+1))), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, map[string]uint64{"price": uint64(5 - i)}))
+	}
+	if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	options := &query.Options{
+		IncludeData:    &query.IncludeData{Key: true},
+		OrderBy:        []query.OrderByAnnotation{{Name: "price", Type: "numeric"}},
+		ResultsPerPage: 2,
+	}
+
+	keys := []common.Hash{}
+	var cursor string
+	for {
+		options.Cursor = cursor
+		response, err := s.QueryEntities(context.Background(), `type = "order"`, options)
+		if err != nil {
+			t.Fatalf("QueryEntities failed: %v", err)
+		}
+		for _, raw := range response.Data {
+			entity := query.EntityData{}
+			if err := json.Unmarshal(raw, &entity); err != nil {
+				t.Fatalf("failed to unmarshal entity: %v", err)
+			}
+			keys = append(keys, *entity.Key)
+		}
+		if response.Cursor == nil {
+			break
+		}
+		cursor = *response.Cursor
+	}
+
+	expected := []common.Hash{}
+	for i := range 5 {
+		expected = append(expected, common.BigToHash(big.NewInt(int64(5-i))))
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("paged through %v, expected %v", keys, expected)
+	}
+
+	// The cursor is only valid for the query and order it was produced for
+	options.Cursor = cursor
+	_, err := s.QueryEntities(context.Background(), `type = "other"`, options)
+	if !errors.Is(err, query.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for another query, got %v", err)
+	}
+
+	options.OrderBy[0].Descending = true
+	_, err = s.QueryEntities(context.Background(), `type = "order"`, options)
+	if !errors.Is(err, query.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for another order, got %v", err)
+	}
+}
+
+func TestQueryEntities_PreviousCursor(t *testing.T) {
+	s := newTestStore(t)
+
+	ops := []events.Operation{}
+	for i := range 7 {
+		ops = append(ops, createOp(common.BigToHash(big.NewInt(int64(i+1))), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, map[string]uint64{"price": uint64(i % 3)}))
+	}
+	if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	page := func(cursor string) ([]string, *query.QueryResponse) {
+		response, err := s.QueryEntities(context.Background(), `type = "order"`, &query.Options{
+			IncludeData:    &query.IncludeData{Key: true},
+			OrderBy:        []query.OrderByAnnotation{{Name: "price", Type: "numeric", Descending: true}},
+			ResultsPerPage: 3,
+			Cursor:         cursor,
+		})
+		if err != nil {
+			t.Fatalf("QueryEntities failed: %v", err)
+		}
+
+		keys := []string{}
+		for _, raw := range response.Data {
+			entity := query.EntityData{}
+			if err := json.Unmarshal(raw, &entity); err != nil {
+				t.Fatalf("failed to unmarshal entity: %v", err)
+			}
+			keys = append(keys, entity.Key.Big().String())
+		}
+		return keys, response
+	}
+
+	// Go forward through all pages, then back to the first one
+	pages := [][]string{}
+	first, response := page("")
+	pages = append(pages, first)
+	if response.PreviousCursor != nil {
+		t.Errorf("expected no previous cursor on the first page")
+	}
+	for response.Cursor != nil {
+		var keys []string
+		keys, response = page(*response.Cursor)
+		pages = append(pages, keys)
+	}
+
+	expected := [][]string{{"3", "6", "2"}, {"5", "1", "4"}, {"7"}}
+	if fmt.Sprint(pages) != fmt.Sprint(expected) {
+		t.Fatalf("paged forward through %v, expected %v", pages, expected)
+	}
+
+	for i := len(expected) - 2; i >= 0; i-- {
+		if response.PreviousCursor == nil {
+			t.Fatalf("expected a previous cursor before page %d", i+1)
+		}
+		var keys []string
+		keys, response = page(*response.PreviousCursor)
+		if fmt.Sprint(keys) != fmt.Sprint(expected[i]) {
+			t.Errorf("paged back to %v, expected %v", keys, expected[i])
+		}
+		if response.Cursor == nil {
+			t.Errorf("expected a next cursor after paging back to page %d", i)
+		}
+	}
+	if response.PreviousCursor != nil {
+		t.Errorf("expected no previous cursor after paging back to the first page")
+	}
+
+	// And forward again from a page that was reached backward
+	keys, _ := page(*response.Cursor)
+	if fmt.Sprint(keys) != fmt.Sprint(expected[1]) {
+		t.Errorf("paged forward to %v, expected %v", keys, expected[1])
+	}
+}
+
+func TestStreamEntities(t *testing.T) {
+	s := newTestStore(t)
+
+	ops := []events.Operation{}
+	for i := range 7 {
+		ops = append(ops, createOp(common.BigToHash(big.NewInt(int64(i+1))), common.HexToAddress("0x1"), 100, "a", map[string]string{"type": "order"}, map[string]uint64{"price": uint64(i % 3)}))
+	}
+	if err := s.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+
+	// The stream reads pages of 2 entities
+	options := &query.Options{
+		ResultsPerPage: 2,
+		IncludeData:    &query.IncludeData{Key: true},
+		OrderBy:        []query.OrderByAnnotation{{Name: "price", Type: "numeric", Descending: true}},
+	}
+
+	keys := []string{}
+	for entity, err := range s.StreamEntities(context.Background(), `type = "order"`, options) {
+		if err != nil {
+			t.Fatalf("StreamEntities failed: %v", err)
+		}
+		keys = append(keys, entity.Key.Big().String())
+	}
+	if expected := []string{"3", "6", "2", "5", "1", "4", "7"}; fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("streamed %v, expected %v", keys, expected)
+	}
+
+	// Breaking out of the loop stops the stream
+	ast, err := query.Build(query.Eq("type", "order"))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	count := 0
+	for _, err := range s.StreamEntitiesAST(context.Background(), ast, options) {
+		if err != nil {
+			t.Fatalf("StreamEntitiesAST failed: %v", err)
+		}
+		count++
+		if count == 3 {
+			break
+		}
+	}
+	if count != 3 {
+		t.Errorf("expected to stop after 3 entities, got %d", count)
+	}
+
+	// The caller's time doesn't count against the limits, and the stream
+	// doesn't hold a slot while the caller handles an entity
+	limited := newTestStore(t, WithQueryLimits(QueryLimits{Timeout: 50 * time.Millisecond, MaxConcurrent: 1}))
+	if err := limited.FollowEvents(context.Background(), iterateBatches(batchOf(events.Block{Number: 1, Operations: ops}))); err != nil {
+		t.Fatalf("FollowEvents failed: %v", err)
+	}
+	count = 0
+	for _, err := range limited.StreamEntities(context.Background(), `type = "order"`, options) {
+		if err != nil {
+			t.Fatalf("StreamEntities with a slow consumer failed: %v", err)
+		}
+		if _, err := limited.QueryEntities(context.Background(), `type = "order"`, nil); err != nil {
+			t.Fatalf("QueryEntities while streaming failed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		count++
+	}
+	if count != 7 {
+		t.Errorf("expected 7 entities with a slow consumer, got %d", count)
+	}
+
+	// A cancelled context ends the stream with an error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	count = 0
+	var streamErr error
+	for _, err := range s.StreamEntities(ctx, `type = "order"`, options) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		count++
+		cancel()
+	}
+	if !errors.Is(streamErr, context.Canceled) || count == 0 || count >= 7 {
+		t.Errorf("expected the stream to end with context.Canceled, got %v after %d entities", streamErr, count)
+	}
+
+	for _, err := range s.StreamEntities(context.Background(), `type = `, nil) {
+		var parseError *query.ParseError
+		if !errors.As(err, &parseError) {
+			t.Errorf("expected a ParseError, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+	"github.com/Arkiv-Network/sqlite-store/store"
+)
+
+// AttributeStatistics describes the values of an attribute across all live
+// entities.
+type AttributeStatistics struct {
+	Name string `json:"name"`
+	// Either "string" or "numeric"
+	Type           string `json:"type"`
+	Entities       uint64 `json:"entities"`
+	DistinctValues uint64 `json:"distinctValues"`
+	// The range of values, only set for numeric attributes
+	Min *uint64 `json:"min,omitempty"`
+	Max *uint64 `json:"max,omitempty"`
+}
+
+// Statistics describes the live entities at the latest block. It is
+// maintained by FollowEvents as part of every batch.
+type Statistics struct {
+	BlockNumber uint64                `json:"blockNumber"`
+	Entities    uint64                `json:"entities"`
+	Attributes  []AttributeStatistics `json:"attributes"`
+}
+
+func (s *SQLiteStore) GetStatistics(ctx context.Context) (*Statistics, error) {
+	tx, err := s.readPool.BeginTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	st := store.New(tx)
+
+	block, err := st.GetLastBlock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last block: %w", err)
+	}
+
+	entities, err := st.GetEntityCount(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get entity count: %w", err)
+	}
+
+	rows, err := st.ListAttributeStatistics(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attribute statistics: %w", err)
+	}
+
+	statistics := &Statistics{
+		BlockNumber: uint64(block),
+		Entities:    uint64(entities),
+		Attributes:  make([]AttributeStatistics, 0, len(rows)),
+	}
+
+	for _, row := range rows {
+		attribute := AttributeStatistics{
+			Name:           row.Name,
+			Type:           row.ValueType,
+			Entities:       uint64(row.Entities),
+			DistinctValues: uint64(row.DistinctValues),
+		}
+		// Numeric values are stored as their two's complement, see store.Uint64
+		if row.MinValue.Valid {
+			value := uint64(row.MinValue.Int64)
+			attribute.Min = &value
+		}
+		if row.MaxValue.Valid {
+			value := uint64(row.MaxValue.Int64)
+			attribute.Max = &value
+		}
+		statistics.Attributes = append(statistics.Attributes, attribute)
+	}
+
+	return statistics, nil
+}
+
+type attributeStatisticsKey struct {
+	name    string
+	numeric bool
+}
+
+// plannerStatistics makes the statistics available to the query planner.
+type plannerStatistics struct {
+	blockNumber uint64
+	entities    uint64
+	attributes  map[attributeStatisticsKey]query.AttributeStatistics
+}
+
+var _ query.Statistics = &plannerStatistics{}
+
+func newPlannerStatistics(statistics *Statistics) *plannerStatistics {
+	p := &plannerStatistics{
+		blockNumber: statistics.BlockNumber,
+		entities:    statistics.Entities,
+		attributes:  make(map[attributeStatisticsKey]query.AttributeStatistics, len(statistics.Attributes)),
+	}
+	for _, attribute := range statistics.Attributes {
+		p.attributes[attributeStatisticsKey{name: attribute.Name, numeric: attribute.Type == "numeric"}] = query.AttributeStatistics{
+			Entities:       attribute.Entities,
+			DistinctValues: attribute.DistinctValues,
+		}
+	}
+	return p
+}
+
+func (p *plannerStatistics) Entities() uint64 {
+	return p.entities
+}
+
+func (p *plannerStatistics) Attribute(name string, numeric bool) (query.AttributeStatistics, bool) {
+	stats, ok := p.attributes[attributeStatisticsKey{name: name, numeric: numeric}]
+	return stats, ok
+}
+
+// plannerStatisticsAt returns the statistics for the planner, they are only
+// read again once the head has moved past the cached ones. The lock is not
+// held while reading them, so concurrent queries may read them more than once.
+func (s *SQLiteStore) plannerStatisticsAt(ctx context.Context, head uint64) (*plannerStatistics, error) {
+	s.statisticsMu.Lock()
+	cached := s.statistics
+	s.statisticsMu.Unlock()
+
+	if cached != nil && cached.blockNumber >= head {
+		return cached, nil
+	}
+
+	read, err := s.GetStatistics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statistics := newPlannerStatistics(read)
+
+	s.statisticsMu.Lock()
+	defer s.statisticsMu.Unlock()
+
+	// Another query may have read newer statistics in the meantime
+	if s.statistics == nil || s.statistics.blockNumber < statistics.blockNumber {
+		s.statistics = statistics
+	}
+
+	return statistics, nil
+}
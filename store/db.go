@@ -24,33 +24,78 @@ func New(db DBTX) *Queries {
 func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	q := Queries{db: db}
 	var err error
+	if q.copyCreationNumericAttributesStmt, err = db.PrepareContext(ctx, copyCreationNumericAttributes); err != nil {
+		return nil, fmt.Errorf("error preparing query CopyCreationNumericAttributes: %w", err)
+	}
+	if q.copyCreationStringAttributesStmt, err = db.PrepareContext(ctx, copyCreationStringAttributes); err != nil {
+		return nil, fmt.Errorf("error preparing query CopyCreationStringAttributes: %w", err)
+	}
+	if q.deleteEntityMetadataEndedByBlockStmt, err = db.PrepareContext(ctx, deleteEntityMetadataEndedByBlock); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteEntityMetadataEndedByBlock: %w", err)
+	}
 	if q.deleteNumericAttributesBeforeBlockStmt, err = db.PrepareContext(ctx, deleteNumericAttributesBeforeBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query DeleteNumericAttributesBeforeBlock: %w", err)
 	}
+	if q.deleteNumericAttributesEndedByBlockStmt, err = db.PrepareContext(ctx, deleteNumericAttributesEndedByBlock); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteNumericAttributesEndedByBlock: %w", err)
+	}
 	if q.deletePayloadsBeforeBlockStmt, err = db.PrepareContext(ctx, deletePayloadsBeforeBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query DeletePayloadsBeforeBlock: %w", err)
 	}
+	if q.deletePayloadsEndedByBlockStmt, err = db.PrepareContext(ctx, deletePayloadsEndedByBlock); err != nil {
+		return nil, fmt.Errorf("error preparing query DeletePayloadsEndedByBlock: %w", err)
+	}
 	if q.deleteStringAttributesBeforeBlockStmt, err = db.PrepareContext(ctx, deleteStringAttributesBeforeBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query DeleteStringAttributesBeforeBlock: %w", err)
 	}
+	if q.deleteStringAttributesEndedByBlockStmt, err = db.PrepareContext(ctx, deleteStringAttributesEndedByBlock); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteStringAttributesEndedByBlock: %w", err)
+	}
+	if q.deleteUnusedEntityKeysStmt, err = db.PrepareContext(ctx, deleteUnusedEntityKeys); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteUnusedEntityKeys: %w", err)
+	}
 	if q.getCreatorStmt, err = db.PrepareContext(ctx, getCreator); err != nil {
 		return nil, fmt.Errorf("error preparing query GetCreator: %w", err)
 	}
+	if q.getEntityCountStmt, err = db.PrepareContext(ctx, getEntityCount); err != nil {
+		return nil, fmt.Errorf("error preparing query GetEntityCount: %w", err)
+	}
 	if q.getLastBlockStmt, err = db.PrepareContext(ctx, getLastBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query GetLastBlock: %w", err)
 	}
+	if q.getLatestEntityMetadataStmt, err = db.PrepareContext(ctx, getLatestEntityMetadata); err != nil {
+		return nil, fmt.Errorf("error preparing query GetLatestEntityMetadata: %w", err)
+	}
 	if q.getLatestPayloadStmt, err = db.PrepareContext(ctx, getLatestPayload); err != nil {
 		return nil, fmt.Errorf("error preparing query GetLatestPayload: %w", err)
 	}
+	if q.insertEntityMetadataStmt, err = db.PrepareContext(ctx, insertEntityMetadata); err != nil {
+		return nil, fmt.Errorf("error preparing query InsertEntityMetadata: %w", err)
+	}
 	if q.insertNumericAttributeStmt, err = db.PrepareContext(ctx, insertNumericAttribute); err != nil {
 		return nil, fmt.Errorf("error preparing query InsertNumericAttribute: %w", err)
 	}
 	if q.insertPayloadStmt, err = db.PrepareContext(ctx, insertPayload); err != nil {
 		return nil, fmt.Errorf("error preparing query InsertPayload: %w", err)
 	}
+	if q.insertPayloadContentStmt, err = db.PrepareContext(ctx, insertPayloadContent); err != nil {
+		return nil, fmt.Errorf("error preparing query InsertPayloadContent: %w", err)
+	}
 	if q.insertStringAttributeStmt, err = db.PrepareContext(ctx, insertStringAttribute); err != nil {
 		return nil, fmt.Errorf("error preparing query InsertStringAttribute: %w", err)
 	}
+	if q.insertUpdatedPayloadStmt, err = db.PrepareContext(ctx, insertUpdatedPayload); err != nil {
+		return nil, fmt.Errorf("error preparing query InsertUpdatedPayload: %w", err)
+	}
+	if q.listAttributeStatisticsStmt, err = db.PrepareContext(ctx, listAttributeStatistics); err != nil {
+		return nil, fmt.Errorf("error preparing query ListAttributeStatistics: %w", err)
+	}
+	if q.listExpiringEntitiesStmt, err = db.PrepareContext(ctx, listExpiringEntities); err != nil {
+		return nil, fmt.Errorf("error preparing query ListExpiringEntities: %w", err)
+	}
+	if q.terminateEntityMetadataAtBlockStmt, err = db.PrepareContext(ctx, terminateEntityMetadataAtBlock); err != nil {
+		return nil, fmt.Errorf("error preparing query TerminateEntityMetadataAtBlock: %w", err)
+	}
 	if q.terminateNumericAttributesAtBlockStmt, err = db.PrepareContext(ctx, terminateNumericAttributesAtBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query TerminateNumericAttributesAtBlock: %w", err)
 	}
@@ -60,6 +105,12 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.terminateStringAttributesAtBlockStmt, err = db.PrepareContext(ctx, terminateStringAttributesAtBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query TerminateStringAttributesAtBlock: %w", err)
 	}
+	if q.upsertAttributeNameStmt, err = db.PrepareContext(ctx, upsertAttributeName); err != nil {
+		return nil, fmt.Errorf("error preparing query UpsertAttributeName: %w", err)
+	}
+	if q.upsertEntityKeyStmt, err = db.PrepareContext(ctx, upsertEntityKey); err != nil {
+		return nil, fmt.Errorf("error preparing query UpsertEntityKey: %w", err)
+	}
 	if q.upsertLastBlockStmt, err = db.PrepareContext(ctx, upsertLastBlock); err != nil {
 		return nil, fmt.Errorf("error preparing query UpsertLastBlock: %w", err)
 	}
@@ -68,36 +119,86 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 
 func (q *Queries) Close() error {
 	var err error
+	if q.copyCreationNumericAttributesStmt != nil {
+		if cerr := q.copyCreationNumericAttributesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing copyCreationNumericAttributesStmt: %w", cerr)
+		}
+	}
+	if q.copyCreationStringAttributesStmt != nil {
+		if cerr := q.copyCreationStringAttributesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing copyCreationStringAttributesStmt: %w", cerr)
+		}
+	}
+	if q.deleteEntityMetadataEndedByBlockStmt != nil {
+		if cerr := q.deleteEntityMetadataEndedByBlockStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteEntityMetadataEndedByBlockStmt: %w", cerr)
+		}
+	}
 	if q.deleteNumericAttributesBeforeBlockStmt != nil {
 		if cerr := q.deleteNumericAttributesBeforeBlockStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing deleteNumericAttributesBeforeBlockStmt: %w", cerr)
 		}
 	}
+	if q.deleteNumericAttributesEndedByBlockStmt != nil {
+		if cerr := q.deleteNumericAttributesEndedByBlockStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteNumericAttributesEndedByBlockStmt: %w", cerr)
+		}
+	}
 	if q.deletePayloadsBeforeBlockStmt != nil {
 		if cerr := q.deletePayloadsBeforeBlockStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing deletePayloadsBeforeBlockStmt: %w", cerr)
 		}
 	}
+	if q.deletePayloadsEndedByBlockStmt != nil {
+		if cerr := q.deletePayloadsEndedByBlockStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deletePayloadsEndedByBlockStmt: %w", cerr)
+		}
+	}
 	if q.deleteStringAttributesBeforeBlockStmt != nil {
 		if cerr := q.deleteStringAttributesBeforeBlockStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing deleteStringAttributesBeforeBlockStmt: %w", cerr)
 		}
 	}
+	if q.deleteStringAttributesEndedByBlockStmt != nil {
+		if cerr := q.deleteStringAttributesEndedByBlockStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteStringAttributesEndedByBlockStmt: %w", cerr)
+		}
+	}
+	if q.deleteUnusedEntityKeysStmt != nil {
+		if cerr := q.deleteUnusedEntityKeysStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteUnusedEntityKeysStmt: %w", cerr)
+		}
+	}
 	if q.getCreatorStmt != nil {
 		if cerr := q.getCreatorStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getCreatorStmt: %w", cerr)
 		}
 	}
+	if q.getEntityCountStmt != nil {
+		if cerr := q.getEntityCountStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getEntityCountStmt: %w", cerr)
+		}
+	}
 	if q.getLastBlockStmt != nil {
 		if cerr := q.getLastBlockStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getLastBlockStmt: %w", cerr)
 		}
 	}
+	if q.getLatestEntityMetadataStmt != nil {
+		if cerr := q.getLatestEntityMetadataStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getLatestEntityMetadataStmt: %w", cerr)
+		}
+	}
 	if q.getLatestPayloadStmt != nil {
 		if cerr := q.getLatestPayloadStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getLatestPayloadStmt: %w", cerr)
 		}
 	}
+	if q.insertEntityMetadataStmt != nil {
+		if cerr := q.insertEntityMetadataStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing insertEntityMetadataStmt: %w", cerr)
+		}
+	}
 	if q.insertNumericAttributeStmt != nil {
 		if cerr := q.insertNumericAttributeStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing insertNumericAttributeStmt: %w", cerr)
@@ -108,11 +209,36 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing insertPayloadStmt: %w", cerr)
 		}
 	}
+	if q.insertPayloadContentStmt != nil {
+		if cerr := q.insertPayloadContentStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing insertPayloadContentStmt: %w", cerr)
+		}
+	}
 	if q.insertStringAttributeStmt != nil {
 		if cerr := q.insertStringAttributeStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing insertStringAttributeStmt: %w", cerr)
 		}
 	}
+	if q.insertUpdatedPayloadStmt != nil {
+		if cerr := q.insertUpdatedPayloadStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing insertUpdatedPayloadStmt: %w", cerr)
+		}
+	}
+	if q.listAttributeStatisticsStmt != nil {
+		if cerr := q.listAttributeStatisticsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing listAttributeStatisticsStmt: %w", cerr)
+		}
+	}
+	if q.listExpiringEntitiesStmt != nil {
+		if cerr := q.listExpiringEntitiesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing listExpiringEntitiesStmt: %w", cerr)
+		}
+	}
+	if q.terminateEntityMetadataAtBlockStmt != nil {
+		if cerr := q.terminateEntityMetadataAtBlockStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing terminateEntityMetadataAtBlockStmt: %w", cerr)
+		}
+	}
 	if q.terminateNumericAttributesAtBlockStmt != nil {
 		if cerr := q.terminateNumericAttributesAtBlockStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing terminateNumericAttributesAtBlockStmt: %w", cerr)
@@ -128,6 +254,16 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing terminateStringAttributesAtBlockStmt: %w", cerr)
 		}
 	}
+	if q.upsertAttributeNameStmt != nil {
+		if cerr := q.upsertAttributeNameStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing upsertAttributeNameStmt: %w", cerr)
+		}
+	}
+	if q.upsertEntityKeyStmt != nil {
+		if cerr := q.upsertEntityKeyStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing upsertEntityKeyStmt: %w", cerr)
+		}
+	}
 	if q.upsertLastBlockStmt != nil {
 		if cerr := q.upsertLastBlockStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing upsertLastBlockStmt: %w", cerr)
@@ -170,39 +306,73 @@ func (q *Queries) queryRow(ctx context.Context, stmt *sql.Stmt, query string, ar
 }
 
 type Queries struct {
-	db                                     DBTX
-	tx                                     *sql.Tx
-	deleteNumericAttributesBeforeBlockStmt *sql.Stmt
-	deletePayloadsBeforeBlockStmt          *sql.Stmt
-	deleteStringAttributesBeforeBlockStmt  *sql.Stmt
-	getCreatorStmt                         *sql.Stmt
-	getLastBlockStmt                       *sql.Stmt
-	getLatestPayloadStmt                   *sql.Stmt
-	insertNumericAttributeStmt             *sql.Stmt
-	insertPayloadStmt                      *sql.Stmt
-	insertStringAttributeStmt              *sql.Stmt
-	terminateNumericAttributesAtBlockStmt  *sql.Stmt
-	terminatePayloadsAtBlockStmt           *sql.Stmt
-	terminateStringAttributesAtBlockStmt   *sql.Stmt
-	upsertLastBlockStmt                    *sql.Stmt
+	db                                      DBTX
+	tx                                      *sql.Tx
+	copyCreationNumericAttributesStmt       *sql.Stmt
+	copyCreationStringAttributesStmt        *sql.Stmt
+	deleteEntityMetadataEndedByBlockStmt    *sql.Stmt
+	deleteNumericAttributesBeforeBlockStmt  *sql.Stmt
+	deleteNumericAttributesEndedByBlockStmt *sql.Stmt
+	deletePayloadsBeforeBlockStmt           *sql.Stmt
+	deletePayloadsEndedByBlockStmt          *sql.Stmt
+	deleteStringAttributesBeforeBlockStmt   *sql.Stmt
+	deleteStringAttributesEndedByBlockStmt  *sql.Stmt
+	deleteUnusedEntityKeysStmt              *sql.Stmt
+	getCreatorStmt                          *sql.Stmt
+	getEntityCountStmt                      *sql.Stmt
+	getLastBlockStmt                        *sql.Stmt
+	getLatestEntityMetadataStmt             *sql.Stmt
+	getLatestPayloadStmt                    *sql.Stmt
+	insertEntityMetadataStmt                *sql.Stmt
+	insertNumericAttributeStmt              *sql.Stmt
+	insertPayloadStmt                       *sql.Stmt
+	insertPayloadContentStmt                *sql.Stmt
+	insertStringAttributeStmt               *sql.Stmt
+	insertUpdatedPayloadStmt                *sql.Stmt
+	listAttributeStatisticsStmt             *sql.Stmt
+	listExpiringEntitiesStmt                *sql.Stmt
+	terminateEntityMetadataAtBlockStmt      *sql.Stmt
+	terminateNumericAttributesAtBlockStmt   *sql.Stmt
+	terminatePayloadsAtBlockStmt            *sql.Stmt
+	terminateStringAttributesAtBlockStmt    *sql.Stmt
+	upsertAttributeNameStmt                 *sql.Stmt
+	upsertEntityKeyStmt                     *sql.Stmt
+	upsertLastBlockStmt                     *sql.Stmt
 }
 
 func (q *Queries) WithTx(tx *sql.Tx) *Queries {
 	return &Queries{
-		db:                                     tx,
-		tx:                                     tx,
-		deleteNumericAttributesBeforeBlockStmt: q.deleteNumericAttributesBeforeBlockStmt,
-		deletePayloadsBeforeBlockStmt:          q.deletePayloadsBeforeBlockStmt,
-		deleteStringAttributesBeforeBlockStmt:  q.deleteStringAttributesBeforeBlockStmt,
-		getCreatorStmt:                         q.getCreatorStmt,
-		getLastBlockStmt:                       q.getLastBlockStmt,
-		getLatestPayloadStmt:                   q.getLatestPayloadStmt,
-		insertNumericAttributeStmt:             q.insertNumericAttributeStmt,
-		insertPayloadStmt:                      q.insertPayloadStmt,
-		insertStringAttributeStmt:              q.insertStringAttributeStmt,
-		terminateNumericAttributesAtBlockStmt:  q.terminateNumericAttributesAtBlockStmt,
-		terminatePayloadsAtBlockStmt:           q.terminatePayloadsAtBlockStmt,
-		terminateStringAttributesAtBlockStmt:   q.terminateStringAttributesAtBlockStmt,
-		upsertLastBlockStmt:                    q.upsertLastBlockStmt,
+		db:                                      tx,
+		tx:                                      tx,
+		copyCreationNumericAttributesStmt:       q.copyCreationNumericAttributesStmt,
+		copyCreationStringAttributesStmt:        q.copyCreationStringAttributesStmt,
+		deleteEntityMetadataEndedByBlockStmt:    q.deleteEntityMetadataEndedByBlockStmt,
+		deleteNumericAttributesBeforeBlockStmt:  q.deleteNumericAttributesBeforeBlockStmt,
+		deleteNumericAttributesEndedByBlockStmt: q.deleteNumericAttributesEndedByBlockStmt,
+		deletePayloadsBeforeBlockStmt:           q.deletePayloadsBeforeBlockStmt,
+		deletePayloadsEndedByBlockStmt:          q.deletePayloadsEndedByBlockStmt,
+		deleteStringAttributesBeforeBlockStmt:   q.deleteStringAttributesBeforeBlockStmt,
+		deleteStringAttributesEndedByBlockStmt:  q.deleteStringAttributesEndedByBlockStmt,
+		deleteUnusedEntityKeysStmt:              q.deleteUnusedEntityKeysStmt,
+		getCreatorStmt:                          q.getCreatorStmt,
+		getEntityCountStmt:                      q.getEntityCountStmt,
+		getLastBlockStmt:                        q.getLastBlockStmt,
+		getLatestEntityMetadataStmt:             q.getLatestEntityMetadataStmt,
+		getLatestPayloadStmt:                    q.getLatestPayloadStmt,
+		insertEntityMetadataStmt:                q.insertEntityMetadataStmt,
+		insertNumericAttributeStmt:              q.insertNumericAttributeStmt,
+		insertPayloadStmt:                       q.insertPayloadStmt,
+		insertPayloadContentStmt:                q.insertPayloadContentStmt,
+		insertStringAttributeStmt:               q.insertStringAttributeStmt,
+		insertUpdatedPayloadStmt:                q.insertUpdatedPayloadStmt,
+		listAttributeStatisticsStmt:             q.listAttributeStatisticsStmt,
+		listExpiringEntitiesStmt:                q.listExpiringEntitiesStmt,
+		terminateEntityMetadataAtBlockStmt:      q.terminateEntityMetadataAtBlockStmt,
+		terminateNumericAttributesAtBlockStmt:   q.terminateNumericAttributesAtBlockStmt,
+		terminatePayloadsAtBlockStmt:            q.terminatePayloadsAtBlockStmt,
+		terminateStringAttributesAtBlockStmt:    q.terminateStringAttributesAtBlockStmt,
+		upsertAttributeNameStmt:                 q.upsertAttributeNameStmt,
+		upsertEntityKeyStmt:                     q.upsertEntityKeyStmt,
+		upsertLastBlockStmt:                     q.upsertLastBlockStmt,
 	}
 }
@@ -4,33 +4,77 @@
 
 package store
 
+import (
+	"database/sql"
+)
+
+type AttributeName struct {
+	ID   int64
+	Name string
+}
+
+type AttributeStatistic struct {
+	NameID         int64
+	ValueType      string
+	Entities       int64
+	DistinctValues int64
+	MinValue       sql.NullInt64
+	MaxValue       sql.NullInt64
+}
+
+type EntityKey struct {
+	ID        int64
+	EntityKey []byte
+}
+
+type EntityMetadata struct {
+	EntityID  int64
+	FromBlock Uint64
+	ToBlock   Uint64
+	Owner     string
+	ExpiresAt Uint64
+}
+
+type EntityStatistic struct {
+	ID       int64
+	Entities int64
+}
+
 type LastBlock struct {
 	ID    int64
 	Block int64
 }
 
 type NumericAttribute struct {
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 	ToBlock   Uint64
-	Key       string
+	NameID    int64
 	Value     Uint64
 }
 
 type Payload struct {
-	EntityKey         []byte
+	EntityID          int64
 	FromBlock         Uint64
 	ToBlock           Uint64
-	Payload           []byte
+	PayloadHash       []byte
 	ContentType       string
 	StringAttributes  string
 	NumericAttributes string
 }
 
+type PayloadContent struct {
+	Hash     []byte
+	Payload  []byte
+	RefCount int64
+	Codec    string
+	Size     int64
+}
+
 type StringAttribute struct {
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 	ToBlock   Uint64
-	Key       string
+	NameID    int64
 	Value     string
 }
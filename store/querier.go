@@ -9,19 +9,53 @@ import (
 )
 
 type Querier interface {
+	CopyCreationNumericAttributes(ctx context.Context, arg CopyCreationNumericAttributesParams) error
+	CopyCreationStringAttributes(ctx context.Context, arg CopyCreationStringAttributesParams) error
+	DeleteEntityMetadataEndedByBlock(ctx context.Context, toBlock Uint64) error
 	DeleteNumericAttributesBeforeBlock(ctx context.Context, fromBlock Uint64) error
+	DeleteNumericAttributesEndedByBlock(ctx context.Context, toBlock Uint64) error
 	DeletePayloadsBeforeBlock(ctx context.Context, fromBlock Uint64) error
+	DeletePayloadsEndedByBlock(ctx context.Context, toBlock Uint64) error
 	DeleteStringAttributesBeforeBlock(ctx context.Context, fromBlock Uint64) error
+	// The Delete*EndedByBlock queries remove the versions that ended at or before
+	// the given block, they are not visible to queries at that block or later.
+	// Unlike the Delete*BeforeBlock queries, they keep the versions that are
+	// still valid at the block, however early they started.
+	DeleteStringAttributesEndedByBlock(ctx context.Context, toBlock Uint64) error
+	// Entity keys are only removed once no version of the entity is left.
+	DeleteUnusedEntityKeys(ctx context.Context) error
 	GetCreator(ctx context.Context, arg GetCreatorParams) (string, error)
+	GetEntityCount(ctx context.Context) (int64, error)
 	GetLastBlock(ctx context.Context) (int64, error)
-	GetLatestPayload(ctx context.Context, entityKey []byte) (GetLatestPayloadRow, error)
+	GetLatestEntityMetadata(ctx context.Context, entityID int64) (GetLatestEntityMetadataRow, error)
+	GetLatestPayload(ctx context.Context, entityID int64) (GetLatestPayloadRow, error)
+	// The conflict clause takes care of several changes to the same entity in a
+	// single block, the last one wins.
+	InsertEntityMetadata(ctx context.Context, arg InsertEntityMetadataParams) error
 	InsertNumericAttribute(ctx context.Context, arg InsertNumericAttributeParams) error
 	InsertPayload(ctx context.Context, arg InsertPayloadParams) error
+	// The reference count is maintained by triggers on payloads, so the content
+	// needs to be inserted before the payload that points at it.
+	InsertPayloadContent(ctx context.Context, arg InsertPayloadContentParams) error
 	InsertStringAttribute(ctx context.Context, arg InsertStringAttributeParams) error
+	// The attributes that an entity keeps from its creation are copied from the
+	// version that the update replaces, so that the writer doesn't need to decode
+	// and encode them again.
+	InsertUpdatedPayload(ctx context.Context, arg InsertUpdatedPayloadParams) error
+	ListAttributeStatistics(ctx context.Context) ([]ListAttributeStatisticsRow, error)
+	// The entities that expire within the given range of blocks without having
+	// been deleted or extended, meaning their latest metadata row ends at the
+	// expiration.
+	ListExpiringEntities(ctx context.Context, arg ListExpiringEntitiesParams) ([]ListExpiringEntitiesRow, error)
+	TerminateEntityMetadataAtBlock(ctx context.Context, arg TerminateEntityMetadataAtBlockParams) error
 	TerminateNumericAttributesAtBlock(ctx context.Context, arg TerminateNumericAttributesAtBlockParams) error
 	// TerminateEntityAtBlock is split into 3 separate queries for SQLite compatibility
 	TerminatePayloadsAtBlock(ctx context.Context, arg TerminatePayloadsAtBlockParams) error
 	TerminateStringAttributesAtBlock(ctx context.Context, arg TerminateStringAttributesAtBlockParams) error
+	UpsertAttributeName(ctx context.Context, name string) (int64, error)
+	// The conflict clause turns the insert into a no-op for keys that already
+	// exist, so that RETURNING also yields the id of existing keys.
+	UpsertEntityKey(ctx context.Context, entityKey []byte) (int64, error)
 	UpsertLastBlock(ctx context.Context, block int64) error
 }
 
@@ -7,8 +7,73 @@ package store
 
 import (
 	"context"
+	"database/sql"
 )
 
+const copyCreationNumericAttributes = `-- name: CopyCreationNumericAttributes :exec
+INSERT INTO numeric_attributes (entity_id, from_block, to_block, name_id, value)
+SELECT a.entity_id, ?1, ?2, a.name_id, a.value
+FROM numeric_attributes AS a
+INNER JOIN attribute_names AS n ON n.id = a.name_id
+WHERE a.entity_id = ?3
+    AND a.from_block = ?4
+    AND n.name IN ('$createdAtBlock', '$sequence', '$txIndex', '$opIndex')
+`
+
+type CopyCreationNumericAttributesParams struct {
+	FromBlock         Uint64
+	ToBlock           Uint64
+	EntityID          int64
+	PreviousFromBlock Uint64
+}
+
+func (q *Queries) CopyCreationNumericAttributes(ctx context.Context, arg CopyCreationNumericAttributesParams) error {
+	_, err := q.exec(ctx, q.copyCreationNumericAttributesStmt, copyCreationNumericAttributes,
+		arg.FromBlock,
+		arg.ToBlock,
+		arg.EntityID,
+		arg.PreviousFromBlock,
+	)
+	return err
+}
+
+const copyCreationStringAttributes = `-- name: CopyCreationStringAttributes :exec
+INSERT INTO string_attributes (entity_id, from_block, to_block, name_id, value)
+SELECT a.entity_id, ?1, ?2, a.name_id, a.value
+FROM string_attributes AS a
+INNER JOIN attribute_names AS n ON n.id = a.name_id
+WHERE a.entity_id = ?3
+    AND a.from_block = ?4
+    AND n.name = '$creator'
+`
+
+type CopyCreationStringAttributesParams struct {
+	FromBlock         Uint64
+	ToBlock           Uint64
+	EntityID          int64
+	PreviousFromBlock Uint64
+}
+
+func (q *Queries) CopyCreationStringAttributes(ctx context.Context, arg CopyCreationStringAttributesParams) error {
+	_, err := q.exec(ctx, q.copyCreationStringAttributesStmt, copyCreationStringAttributes,
+		arg.FromBlock,
+		arg.ToBlock,
+		arg.EntityID,
+		arg.PreviousFromBlock,
+	)
+	return err
+}
+
+const deleteEntityMetadataEndedByBlock = `-- name: DeleteEntityMetadataEndedByBlock :exec
+DELETE FROM entity_metadata
+WHERE to_block <= ?
+`
+
+func (q *Queries) DeleteEntityMetadataEndedByBlock(ctx context.Context, toBlock Uint64) error {
+	_, err := q.exec(ctx, q.deleteEntityMetadataEndedByBlockStmt, deleteEntityMetadataEndedByBlock, toBlock)
+	return err
+}
+
 const deleteNumericAttributesBeforeBlock = `-- name: DeleteNumericAttributesBeforeBlock :exec
 DELETE FROM numeric_attributes
 WHERE from_block < ?
@@ -19,6 +84,16 @@ func (q *Queries) DeleteNumericAttributesBeforeBlock(ctx context.Context, fromBl
 	return err
 }
 
+const deleteNumericAttributesEndedByBlock = `-- name: DeleteNumericAttributesEndedByBlock :exec
+DELETE FROM numeric_attributes
+WHERE to_block <= ?
+`
+
+func (q *Queries) DeleteNumericAttributesEndedByBlock(ctx context.Context, toBlock Uint64) error {
+	_, err := q.exec(ctx, q.deleteNumericAttributesEndedByBlockStmt, deleteNumericAttributesEndedByBlock, toBlock)
+	return err
+}
+
 const deletePayloadsBeforeBlock = `-- name: DeletePayloadsBeforeBlock :exec
 DELETE FROM payloads
 WHERE from_block < ?
@@ -29,6 +104,16 @@ func (q *Queries) DeletePayloadsBeforeBlock(ctx context.Context, fromBlock Uint6
 	return err
 }
 
+const deletePayloadsEndedByBlock = `-- name: DeletePayloadsEndedByBlock :exec
+DELETE FROM payloads
+WHERE to_block <= ?
+`
+
+func (q *Queries) DeletePayloadsEndedByBlock(ctx context.Context, toBlock Uint64) error {
+	_, err := q.exec(ctx, q.deletePayloadsEndedByBlockStmt, deletePayloadsEndedByBlock, toBlock)
+	return err
+}
+
 const deleteStringAttributesBeforeBlock = `-- name: DeleteStringAttributesBeforeBlock :exec
 DELETE FROM string_attributes
 WHERE from_block < ?
@@ -39,25 +124,64 @@ func (q *Queries) DeleteStringAttributesBeforeBlock(ctx context.Context, fromBlo
 	return err
 }
 
+const deleteStringAttributesEndedByBlock = `-- name: DeleteStringAttributesEndedByBlock :exec
+DELETE FROM string_attributes
+WHERE to_block <= ?
+`
+
+// The Delete*EndedByBlock queries remove the versions that ended at or before
+// the given block, they are not visible to queries at that block or later.
+// Unlike the Delete*BeforeBlock queries, they keep the versions that are
+// still valid at the block, however early they started.
+func (q *Queries) DeleteStringAttributesEndedByBlock(ctx context.Context, toBlock Uint64) error {
+	_, err := q.exec(ctx, q.deleteStringAttributesEndedByBlockStmt, deleteStringAttributesEndedByBlock, toBlock)
+	return err
+}
+
+const deleteUnusedEntityKeys = `-- name: DeleteUnusedEntityKeys :exec
+DELETE FROM entity_keys
+WHERE NOT EXISTS (SELECT 1 FROM payloads AS p WHERE p.entity_id = entity_keys.id)
+    AND NOT EXISTS (SELECT 1 FROM entity_metadata AS m WHERE m.entity_id = entity_keys.id)
+`
+
+// Entity keys are only removed once no version of the entity is left.
+func (q *Queries) DeleteUnusedEntityKeys(ctx context.Context) error {
+	_, err := q.exec(ctx, q.deleteUnusedEntityKeysStmt, deleteUnusedEntityKeys)
+	return err
+}
+
 const getCreator = `-- name: GetCreator :one
 SELECT value FROM string_attributes
-WHERE entity_key = ? AND key = '$creator' AND from_block <= ?
+WHERE entity_id = ?
+    AND name_id = (SELECT id FROM attribute_names WHERE name = '$creator')
+    AND from_block <= ?
 ORDER BY from_block DESC
 LIMIT 1
 `
 
 type GetCreatorParams struct {
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 }
 
 func (q *Queries) GetCreator(ctx context.Context, arg GetCreatorParams) (string, error) {
-	row := q.queryRow(ctx, q.getCreatorStmt, getCreator, arg.EntityKey, arg.FromBlock)
+	row := q.queryRow(ctx, q.getCreatorStmt, getCreator, arg.EntityID, arg.FromBlock)
 	var value string
 	err := row.Scan(&value)
 	return value, err
 }
 
+const getEntityCount = `-- name: GetEntityCount :one
+SELECT entities FROM entity_statistics
+`
+
+func (q *Queries) GetEntityCount(ctx context.Context) (int64, error) {
+	row := q.queryRow(ctx, q.getEntityCountStmt, getEntityCount)
+	var entities int64
+	err := row.Scan(&entities)
+	return entities, err
+}
+
 const getLastBlock = `-- name: GetLastBlock :one
 SELECT block FROM last_block
 `
@@ -69,28 +193,53 @@ func (q *Queries) GetLastBlock(ctx context.Context) (int64, error) {
 	return block, err
 }
 
+const getLatestEntityMetadata = `-- name: GetLatestEntityMetadata :one
+SELECT from_block, to_block, owner, expires_at
+FROM entity_metadata
+WHERE entity_id = ? ORDER BY from_block DESC LIMIT 1
+`
+
+type GetLatestEntityMetadataRow struct {
+	FromBlock Uint64
+	ToBlock   Uint64
+	Owner     string
+	ExpiresAt Uint64
+}
+
+func (q *Queries) GetLatestEntityMetadata(ctx context.Context, entityID int64) (GetLatestEntityMetadataRow, error) {
+	row := q.queryRow(ctx, q.getLatestEntityMetadataStmt, getLatestEntityMetadata, entityID)
+	var i GetLatestEntityMetadataRow
+	err := row.Scan(
+		&i.FromBlock,
+		&i.ToBlock,
+		&i.Owner,
+		&i.ExpiresAt,
+	)
+	return i, err
+}
+
 const getLatestPayload = `-- name: GetLatestPayload :one
-SELECT from_block, to_block AS old_to_block, payload, content_type, string_attributes, numeric_attributes
+SELECT from_block, to_block AS old_to_block, payload_hash, content_type, string_attributes, numeric_attributes
 FROM payloads
-WHERE entity_key = ? ORDER BY from_block DESC LIMIT 1
+WHERE entity_id = ? ORDER BY from_block DESC LIMIT 1
 `
 
 type GetLatestPayloadRow struct {
 	FromBlock         Uint64
 	OldToBlock        Uint64
-	Payload           []byte
+	PayloadHash       []byte
 	ContentType       string
 	StringAttributes  string
 	NumericAttributes string
 }
 
-func (q *Queries) GetLatestPayload(ctx context.Context, entityKey []byte) (GetLatestPayloadRow, error) {
-	row := q.queryRow(ctx, q.getLatestPayloadStmt, getLatestPayload, entityKey)
+func (q *Queries) GetLatestPayload(ctx context.Context, entityID int64) (GetLatestPayloadRow, error) {
+	row := q.queryRow(ctx, q.getLatestPayloadStmt, getLatestPayload, entityID)
 	var i GetLatestPayloadRow
 	err := row.Scan(
 		&i.FromBlock,
 		&i.OldToBlock,
-		&i.Payload,
+		&i.PayloadHash,
 		&i.ContentType,
 		&i.StringAttributes,
 		&i.NumericAttributes,
@@ -98,30 +247,65 @@ func (q *Queries) GetLatestPayload(ctx context.Context, entityKey []byte) (GetLa
 	return i, err
 }
 
+const insertEntityMetadata = `-- name: InsertEntityMetadata :exec
+INSERT INTO entity_metadata (
+    entity_id,
+    from_block,
+    to_block,
+    owner,
+    expires_at
+) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (entity_id, from_block) DO UPDATE SET
+    to_block = EXCLUDED.to_block,
+    owner = EXCLUDED.owner,
+    expires_at = EXCLUDED.expires_at
+`
+
+type InsertEntityMetadataParams struct {
+	EntityID  int64
+	FromBlock Uint64
+	ToBlock   Uint64
+	Owner     string
+	ExpiresAt Uint64
+}
+
+// The conflict clause takes care of several changes to the same entity in a
+// single block, the last one wins.
+func (q *Queries) InsertEntityMetadata(ctx context.Context, arg InsertEntityMetadataParams) error {
+	_, err := q.exec(ctx, q.insertEntityMetadataStmt, insertEntityMetadata,
+		arg.EntityID,
+		arg.FromBlock,
+		arg.ToBlock,
+		arg.Owner,
+		arg.ExpiresAt,
+	)
+	return err
+}
+
 const insertNumericAttribute = `-- name: InsertNumericAttribute :exec
 INSERT INTO numeric_attributes (
-    entity_key,
+    entity_id,
     from_block,
     to_block,
-    key,
+    name_id,
     value
 ) VALUES (?, ?, ?, ?, ?)
 `
 
 type InsertNumericAttributeParams struct {
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 	ToBlock   Uint64
-	Key       string
+	NameID    int64
 	Value     Uint64
 }
 
 func (q *Queries) InsertNumericAttribute(ctx context.Context, arg InsertNumericAttributeParams) error {
 	_, err := q.exec(ctx, q.insertNumericAttributeStmt, insertNumericAttribute,
-		arg.EntityKey,
+		arg.EntityID,
 		arg.FromBlock,
 		arg.ToBlock,
-		arg.Key,
+		arg.NameID,
 		arg.Value,
 	)
 	return err
@@ -129,10 +313,10 @@ func (q *Queries) InsertNumericAttribute(ctx context.Context, arg InsertNumericA
 
 const insertPayload = `-- name: InsertPayload :exec
 INSERT INTO payloads (
-    entity_key,
+    entity_id,
     from_block,
     to_block,
-    payload,
+    payload_hash,
     content_type,
     string_attributes,
     numeric_attributes
@@ -140,10 +324,10 @@ INSERT INTO payloads (
 `
 
 type InsertPayloadParams struct {
-	EntityKey         []byte
+	EntityID          int64
 	FromBlock         Uint64
 	ToBlock           Uint64
-	Payload           []byte
+	PayloadHash       []byte
 	ContentType       string
 	StringAttributes  string
 	NumericAttributes string
@@ -151,10 +335,10 @@ type InsertPayloadParams struct {
 
 func (q *Queries) InsertPayload(ctx context.Context, arg InsertPayloadParams) error {
 	_, err := q.exec(ctx, q.insertPayloadStmt, insertPayload,
-		arg.EntityKey,
+		arg.EntityID,
 		arg.FromBlock,
 		arg.ToBlock,
-		arg.Payload,
+		arg.PayloadHash,
 		arg.ContentType,
 		arg.StringAttributes,
 		arg.NumericAttributes,
@@ -162,87 +346,313 @@ func (q *Queries) InsertPayload(ctx context.Context, arg InsertPayloadParams) er
 	return err
 }
 
+const insertPayloadContent = `-- name: InsertPayloadContent :exec
+INSERT INTO payload_contents (
+    hash,
+    payload,
+    codec,
+    size
+) VALUES (?, ?, ?, ?)
+ON CONFLICT (hash) DO NOTHING
+`
+
+type InsertPayloadContentParams struct {
+	Hash    []byte
+	Payload []byte
+	Codec   string
+	Size    int64
+}
+
+// The reference count is maintained by triggers on payloads, so the content
+// needs to be inserted before the payload that points at it.
+func (q *Queries) InsertPayloadContent(ctx context.Context, arg InsertPayloadContentParams) error {
+	_, err := q.exec(ctx, q.insertPayloadContentStmt, insertPayloadContent,
+		arg.Hash,
+		arg.Payload,
+		arg.Codec,
+		arg.Size,
+	)
+	return err
+}
+
 const insertStringAttribute = `-- name: InsertStringAttribute :exec
 INSERT INTO string_attributes (
-    entity_key,
+    entity_id,
     from_block,
     to_block,
-    key,
+    name_id,
     value
 ) VALUES (?, ?, ?, ?, ?)
 `
 
 type InsertStringAttributeParams struct {
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 	ToBlock   Uint64
-	Key       string
+	NameID    int64
 	Value     string
 }
 
 func (q *Queries) InsertStringAttribute(ctx context.Context, arg InsertStringAttributeParams) error {
 	_, err := q.exec(ctx, q.insertStringAttributeStmt, insertStringAttribute,
-		arg.EntityKey,
+		arg.EntityID,
 		arg.FromBlock,
 		arg.ToBlock,
-		arg.Key,
+		arg.NameID,
 		arg.Value,
 	)
 	return err
 }
 
+const insertUpdatedPayload = `-- name: InsertUpdatedPayload :exec
+INSERT INTO payloads (
+    entity_id,
+    from_block,
+    to_block,
+    payload_hash,
+    content_type,
+    string_attributes,
+    numeric_attributes
+)
+SELECT
+    p.entity_id,
+    ?1,
+    ?2,
+    ?3,
+    ?4,
+    json_set(?5,
+        '$."$creator"', json_extract(p.string_attributes, '$."$creator"')),
+    json_set(?6,
+        '$."$createdAtBlock"', json_extract(p.numeric_attributes, '$."$createdAtBlock"'),
+        '$."$sequence"', json_extract(p.numeric_attributes, '$."$sequence"'),
+        '$."$txIndex"', json_extract(p.numeric_attributes, '$."$txIndex"'),
+        '$."$opIndex"', json_extract(p.numeric_attributes, '$."$opIndex"'))
+FROM payloads AS p
+WHERE p.entity_id = ?7 AND p.from_block = ?8
+`
+
+type InsertUpdatedPayloadParams struct {
+	FromBlock         Uint64
+	ToBlock           Uint64
+	PayloadHash       []byte
+	ContentType       string
+	StringAttributes  interface{}
+	NumericAttributes interface{}
+	EntityID          int64
+	PreviousFromBlock Uint64
+}
+
+// The attributes that an entity keeps from its creation are copied from the
+// version that the update replaces, so that the writer doesn't need to decode
+// and encode them again.
+func (q *Queries) InsertUpdatedPayload(ctx context.Context, arg InsertUpdatedPayloadParams) error {
+	_, err := q.exec(ctx, q.insertUpdatedPayloadStmt, insertUpdatedPayload,
+		arg.FromBlock,
+		arg.ToBlock,
+		arg.PayloadHash,
+		arg.ContentType,
+		arg.StringAttributes,
+		arg.NumericAttributes,
+		arg.EntityID,
+		arg.PreviousFromBlock,
+	)
+	return err
+}
+
+const listAttributeStatistics = `-- name: ListAttributeStatistics :many
+SELECT n.name, s.value_type, s.entities, s.distinct_values, s.min_value, s.max_value
+FROM attribute_statistics AS s
+INNER JOIN attribute_names AS n ON n.id = s.name_id
+WHERE s.entities > 0
+ORDER BY n.name, s.value_type
+`
+
+type ListAttributeStatisticsRow struct {
+	Name           string
+	ValueType      string
+	Entities       int64
+	DistinctValues int64
+	MinValue       sql.NullInt64
+	MaxValue       sql.NullInt64
+}
+
+func (q *Queries) ListAttributeStatistics(ctx context.Context) ([]ListAttributeStatisticsRow, error) {
+	rows, err := q.query(ctx, q.listAttributeStatisticsStmt, listAttributeStatistics)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListAttributeStatisticsRow{}
+	for rows.Next() {
+		var i ListAttributeStatisticsRow
+		if err := rows.Scan(
+			&i.Name,
+			&i.ValueType,
+			&i.Entities,
+			&i.DistinctValues,
+			&i.MinValue,
+			&i.MaxValue,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listExpiringEntities = `-- name: ListExpiringEntities :many
+SELECT m.entity_id, m.expires_at
+FROM entity_metadata AS m
+WHERE m.expires_at > ?1
+    AND m.expires_at <= ?2
+    AND m.to_block = m.expires_at
+    AND NOT EXISTS (
+        SELECT 1 FROM entity_metadata AS n
+        WHERE n.entity_id = m.entity_id AND n.from_block > m.from_block
+    )
+`
+
+type ListExpiringEntitiesParams struct {
+	AfterBlock Uint64
+	UntilBlock Uint64
+}
+
+type ListExpiringEntitiesRow struct {
+	EntityID  int64
+	ExpiresAt Uint64
+}
+
+// The entities that expire within the given range of blocks without having
+// been deleted or extended, meaning their latest metadata row ends at the
+// expiration.
+func (q *Queries) ListExpiringEntities(ctx context.Context, arg ListExpiringEntitiesParams) ([]ListExpiringEntitiesRow, error) {
+	rows, err := q.query(ctx, q.listExpiringEntitiesStmt, listExpiringEntities, arg.AfterBlock, arg.UntilBlock)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListExpiringEntitiesRow{}
+	for rows.Next() {
+		var i ListExpiringEntitiesRow
+		if err := rows.Scan(&i.EntityID, &i.ExpiresAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const terminateEntityMetadataAtBlock = `-- name: TerminateEntityMetadataAtBlock :exec
+UPDATE entity_metadata
+SET to_block = ?1
+WHERE entity_id = ?2 AND from_block = ?3
+`
+
+type TerminateEntityMetadataAtBlockParams struct {
+	ToBlock   Uint64
+	EntityID  int64
+	FromBlock Uint64
+}
+
+func (q *Queries) TerminateEntityMetadataAtBlock(ctx context.Context, arg TerminateEntityMetadataAtBlockParams) error {
+	_, err := q.exec(ctx, q.terminateEntityMetadataAtBlockStmt, terminateEntityMetadataAtBlock, arg.ToBlock, arg.EntityID, arg.FromBlock)
+	return err
+}
+
 const terminateNumericAttributesAtBlock = `-- name: TerminateNumericAttributesAtBlock :exec
 UPDATE numeric_attributes
 SET to_block = ?1
-WHERE entity_key = ?2 AND from_block = ?3
+WHERE entity_id = ?2 AND from_block = ?3
 `
 
 type TerminateNumericAttributesAtBlockParams struct {
 	ToBlock   Uint64
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 }
 
 func (q *Queries) TerminateNumericAttributesAtBlock(ctx context.Context, arg TerminateNumericAttributesAtBlockParams) error {
-	_, err := q.exec(ctx, q.terminateNumericAttributesAtBlockStmt, terminateNumericAttributesAtBlock, arg.ToBlock, arg.EntityKey, arg.FromBlock)
+	_, err := q.exec(ctx, q.terminateNumericAttributesAtBlockStmt, terminateNumericAttributesAtBlock, arg.ToBlock, arg.EntityID, arg.FromBlock)
 	return err
 }
 
 const terminatePayloadsAtBlock = `-- name: TerminatePayloadsAtBlock :exec
 UPDATE payloads
 SET to_block = ?1
-WHERE entity_key = ?2 AND from_block = ?3
+WHERE entity_id = ?2 AND from_block = ?3
 `
 
 type TerminatePayloadsAtBlockParams struct {
 	ToBlock   Uint64
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 }
 
 // TerminateEntityAtBlock is split into 3 separate queries for SQLite compatibility
 func (q *Queries) TerminatePayloadsAtBlock(ctx context.Context, arg TerminatePayloadsAtBlockParams) error {
-	_, err := q.exec(ctx, q.terminatePayloadsAtBlockStmt, terminatePayloadsAtBlock, arg.ToBlock, arg.EntityKey, arg.FromBlock)
+	_, err := q.exec(ctx, q.terminatePayloadsAtBlockStmt, terminatePayloadsAtBlock, arg.ToBlock, arg.EntityID, arg.FromBlock)
 	return err
 }
 
 const terminateStringAttributesAtBlock = `-- name: TerminateStringAttributesAtBlock :exec
 UPDATE string_attributes
 SET to_block = ?1
-WHERE entity_key = ?2 AND from_block = ?3
+WHERE entity_id = ?2 AND from_block = ?3
 `
 
 type TerminateStringAttributesAtBlockParams struct {
 	ToBlock   Uint64
-	EntityKey []byte
+	EntityID  int64
 	FromBlock Uint64
 }
 
 func (q *Queries) TerminateStringAttributesAtBlock(ctx context.Context, arg TerminateStringAttributesAtBlockParams) error {
-	_, err := q.exec(ctx, q.terminateStringAttributesAtBlockStmt, terminateStringAttributesAtBlock, arg.ToBlock, arg.EntityKey, arg.FromBlock)
+	_, err := q.exec(ctx, q.terminateStringAttributesAtBlockStmt, terminateStringAttributesAtBlock, arg.ToBlock, arg.EntityID, arg.FromBlock)
 	return err
 }
 
+const upsertAttributeName = `-- name: UpsertAttributeName :one
+INSERT INTO attribute_names (name)
+VALUES (?)
+ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+RETURNING id
+`
+
+func (q *Queries) UpsertAttributeName(ctx context.Context, name string) (int64, error) {
+	row := q.queryRow(ctx, q.upsertAttributeNameStmt, upsertAttributeName, name)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const upsertEntityKey = `-- name: UpsertEntityKey :one
+INSERT INTO entity_keys (entity_key)
+VALUES (?)
+ON CONFLICT (entity_key) DO UPDATE SET entity_key = EXCLUDED.entity_key
+RETURNING id
+`
+
+// The conflict clause turns the insert into a no-op for keys that already
+// exist, so that RETURNING also yields the id of existing keys.
+func (q *Queries) UpsertEntityKey(ctx context.Context, entityKey []byte) (int64, error) {
+	row := q.queryRow(ctx, q.upsertEntityKeyStmt, upsertEntityKey, entityKey)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
 const upsertLastBlock = `-- name: UpsertLastBlock :exec
 INSERT INTO last_block (id, block)
 VALUES (1, ?)
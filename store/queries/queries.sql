@@ -1,32 +1,104 @@
+-- The conflict clause turns the insert into a no-op for keys that already
+-- exist, so that RETURNING also yields the id of existing keys.
+-- name: UpsertEntityKey :one
+INSERT INTO entity_keys (entity_key)
+VALUES (?)
+ON CONFLICT (entity_key) DO UPDATE SET entity_key = EXCLUDED.entity_key
+RETURNING id;
+
+-- name: UpsertAttributeName :one
+INSERT INTO attribute_names (name)
+VALUES (?)
+ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+RETURNING id;
+
 -- name: InsertStringAttribute :exec
 INSERT INTO string_attributes (
-    entity_key,
+    entity_id,
     from_block,
     to_block,
-    key,
+    name_id,
     value
 ) VALUES (?, ?, ?, ?, ?);
 
 -- name: InsertNumericAttribute :exec
 INSERT INTO numeric_attributes (
-    entity_key,
+    entity_id,
     from_block,
     to_block,
-    key,
+    name_id,
     value
 ) VALUES (?, ?, ?, ?, ?);
 
 -- name: InsertPayload :exec
 INSERT INTO payloads (
-    entity_key,
+    entity_id,
     from_block,
     to_block,
-    payload,
+    payload_hash,
     content_type,
     string_attributes,
     numeric_attributes
 ) VALUES (?, ?, ?, ?, ?, ?, ?);
 
+-- The attributes that an entity keeps from its creation are copied from the
+-- version that the update replaces, so that the writer doesn't need to decode
+-- and encode them again.
+-- name: InsertUpdatedPayload :exec
+INSERT INTO payloads (
+    entity_id,
+    from_block,
+    to_block,
+    payload_hash,
+    content_type,
+    string_attributes,
+    numeric_attributes
+)
+SELECT
+    p.entity_id,
+    sqlc.arg(from_block),
+    sqlc.arg(to_block),
+    sqlc.arg(payload_hash),
+    sqlc.arg(content_type),
+    json_set(sqlc.arg(string_attributes),
+        '$."$creator"', json_extract(p.string_attributes, '$."$creator"')),
+    json_set(sqlc.arg(numeric_attributes),
+        '$."$createdAtBlock"', json_extract(p.numeric_attributes, '$."$createdAtBlock"'),
+        '$."$sequence"', json_extract(p.numeric_attributes, '$."$sequence"'),
+        '$."$txIndex"', json_extract(p.numeric_attributes, '$."$txIndex"'),
+        '$."$opIndex"', json_extract(p.numeric_attributes, '$."$opIndex"'))
+FROM payloads AS p
+WHERE p.entity_id = sqlc.arg(entity_id) AND p.from_block = sqlc.arg(previous_from_block);
+
+-- name: CopyCreationStringAttributes :exec
+INSERT INTO string_attributes (entity_id, from_block, to_block, name_id, value)
+SELECT a.entity_id, sqlc.arg(from_block), sqlc.arg(to_block), a.name_id, a.value
+FROM string_attributes AS a
+INNER JOIN attribute_names AS n ON n.id = a.name_id
+WHERE a.entity_id = sqlc.arg(entity_id)
+    AND a.from_block = sqlc.arg(previous_from_block)
+    AND n.name = '$creator';
+
+-- name: CopyCreationNumericAttributes :exec
+INSERT INTO numeric_attributes (entity_id, from_block, to_block, name_id, value)
+SELECT a.entity_id, sqlc.arg(from_block), sqlc.arg(to_block), a.name_id, a.value
+FROM numeric_attributes AS a
+INNER JOIN attribute_names AS n ON n.id = a.name_id
+WHERE a.entity_id = sqlc.arg(entity_id)
+    AND a.from_block = sqlc.arg(previous_from_block)
+    AND n.name IN ('$createdAtBlock', '$sequence', '$txIndex', '$opIndex');
+
+-- The reference count is maintained by triggers on payloads, so the content
+-- needs to be inserted before the payload that points at it.
+-- name: InsertPayloadContent :exec
+INSERT INTO payload_contents (
+    hash,
+    payload,
+    codec,
+    size
+) VALUES (?, ?, ?, ?)
+ON CONFLICT (hash) DO NOTHING;
+
 -- name: DeleteStringAttributesBeforeBlock :exec
 DELETE FROM string_attributes
 WHERE from_block < ?;
@@ -39,6 +111,32 @@ WHERE from_block < ?;
 DELETE FROM payloads
 WHERE from_block < ?;
 
+-- The Delete*EndedByBlock queries remove the versions that ended at or before
+-- the given block, they are not visible to queries at that block or later.
+-- Unlike the Delete*BeforeBlock queries, they keep the versions that are
+-- still valid at the block, however early they started.
+-- name: DeleteStringAttributesEndedByBlock :exec
+DELETE FROM string_attributes
+WHERE to_block <= ?;
+
+-- name: DeleteNumericAttributesEndedByBlock :exec
+DELETE FROM numeric_attributes
+WHERE to_block <= ?;
+
+-- name: DeletePayloadsEndedByBlock :exec
+DELETE FROM payloads
+WHERE to_block <= ?;
+
+-- name: DeleteEntityMetadataEndedByBlock :exec
+DELETE FROM entity_metadata
+WHERE to_block <= ?;
+
+-- Entity keys are only removed once no version of the entity is left.
+-- name: DeleteUnusedEntityKeys :exec
+DELETE FROM entity_keys
+WHERE NOT EXISTS (SELECT 1 FROM payloads AS p WHERE p.entity_id = entity_keys.id)
+    AND NOT EXISTS (SELECT 1 FROM entity_metadata AS m WHERE m.entity_id = entity_keys.id);
+
 -- name: UpsertLastBlock :exec
 INSERT INTO last_block (id, block)
 VALUES (1, ?)
@@ -49,7 +147,9 @@ SELECT block FROM last_block;
 
 -- name: GetCreator :one
 SELECT value FROM string_attributes
-WHERE entity_key = ? AND key = '$creator' AND from_block <= ?
+WHERE entity_id = ?
+    AND name_id = (SELECT id FROM attribute_names WHERE name = '$creator')
+    AND from_block <= ?
 ORDER BY from_block DESC
 LIMIT 1;
 
@@ -57,22 +157,71 @@ LIMIT 1;
 -- name: TerminatePayloadsAtBlock :exec
 UPDATE payloads
 SET to_block = sqlc.arg(to_block)
-WHERE entity_key = sqlc.arg(entity_key) AND from_block = sqlc.arg(from_block);
+WHERE entity_id = sqlc.arg(entity_id) AND from_block = sqlc.arg(from_block);
 
 -- name: TerminateStringAttributesAtBlock :exec
 UPDATE string_attributes
 SET to_block = sqlc.arg(to_block)
-WHERE entity_key = sqlc.arg(entity_key) AND from_block = sqlc.arg(from_block);
+WHERE entity_id = sqlc.arg(entity_id) AND from_block = sqlc.arg(from_block);
 
 -- name: TerminateNumericAttributesAtBlock :exec
 UPDATE numeric_attributes
 SET to_block = sqlc.arg(to_block)
-WHERE entity_key = sqlc.arg(entity_key) AND from_block = sqlc.arg(from_block);
+WHERE entity_id = sqlc.arg(entity_id) AND from_block = sqlc.arg(from_block);
 
 -- name: GetLatestPayload :one
-SELECT from_block, to_block AS old_to_block, payload, content_type, string_attributes, numeric_attributes
+SELECT from_block, to_block AS old_to_block, payload_hash, content_type, string_attributes, numeric_attributes
 FROM payloads
-WHERE entity_key = ? ORDER BY from_block DESC LIMIT 1;
+WHERE entity_id = ? ORDER BY from_block DESC LIMIT 1;
+
+-- The conflict clause takes care of several changes to the same entity in a
+-- single block, the last one wins.
+-- name: InsertEntityMetadata :exec
+INSERT INTO entity_metadata (
+    entity_id,
+    from_block,
+    to_block,
+    owner,
+    expires_at
+) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (entity_id, from_block) DO UPDATE SET
+    to_block = EXCLUDED.to_block,
+    owner = EXCLUDED.owner,
+    expires_at = EXCLUDED.expires_at;
+
+-- name: TerminateEntityMetadataAtBlock :exec
+UPDATE entity_metadata
+SET to_block = sqlc.arg(to_block)
+WHERE entity_id = sqlc.arg(entity_id) AND from_block = sqlc.arg(from_block);
+
+-- name: GetLatestEntityMetadata :one
+SELECT from_block, to_block, owner, expires_at
+FROM entity_metadata
+WHERE entity_id = ? ORDER BY from_block DESC LIMIT 1;
+
+-- The entities that expire within the given range of blocks without having
+-- been deleted or extended, meaning their latest metadata row ends at the
+-- expiration.
+-- name: ListExpiringEntities :many
+SELECT m.entity_id, m.expires_at
+FROM entity_metadata AS m
+WHERE m.expires_at > sqlc.arg(after_block)
+    AND m.expires_at <= sqlc.arg(until_block)
+    AND m.to_block = m.expires_at
+    AND NOT EXISTS (
+        SELECT 1 FROM entity_metadata AS n
+        WHERE n.entity_id = m.entity_id AND n.from_block > m.from_block
+    );
+
+-- name: ListAttributeStatistics :many
+SELECT n.name, s.value_type, s.entities, s.distinct_values, s.min_value, s.max_value
+FROM attribute_statistics AS s
+INNER JOIN attribute_names AS n ON n.id = s.name_id
+WHERE s.entities > 0
+ORDER BY n.name, s.value_type;
+
+-- name: GetEntityCount :one
+SELECT entities FROM entity_statistics;
 
 -- -- name: GetOldStringAttributes :many
 -- SELECT entity_key, to_block AS old_to_block, key, value
@@ -99,3 +248,4 @@ WHERE entity_key = ? ORDER BY from_block DESC LIMIT 1;
 -- SELECT entity_key, key, value
 -- FROM numeric_attributes
 -- WHERE entity_key = ? AND from_block <= ? AND to_block > ?;
+
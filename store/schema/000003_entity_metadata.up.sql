@@ -0,0 +1,44 @@
+-- Ownership and expiration are versioned separately from the content of an
+-- entity, so that extending the BTL or changing the owner only needs to write
+-- a single row instead of copying the payload and all attributes.
+CREATE TABLE entity_metadata (
+    entity_key BLOB NOT NULL,
+    from_block INTEGER NOT NULL,
+    to_block INTEGER NOT NULL,
+    owner TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    PRIMARY KEY (entity_key, from_block)
+);
+
+INSERT INTO entity_metadata (entity_key, from_block, to_block, owner, expires_at)
+SELECT
+    entity_key,
+    from_block,
+    to_block,
+    COALESCE(string_attributes ->> '$.$owner', ''),
+    COALESCE(numeric_attributes ->> '$.$expiration', to_block)
+FROM payloads;
+
+CREATE INDEX entity_metadata_owner_idx ON entity_metadata (owner, from_block, to_block);
+CREATE INDEX entity_metadata_expires_at_idx ON entity_metadata (expires_at, from_block, to_block);
+CREATE INDEX entity_metadata_delete_index ON entity_metadata (to_block);
+
+-- The owner and expiration are no longer part of the content
+DELETE FROM string_attributes WHERE key = '$owner';
+DELETE FROM numeric_attributes WHERE key = '$expiration';
+
+UPDATE payloads SET
+    string_attributes = json_remove(string_attributes, '$.$owner'),
+    numeric_attributes = json_remove(numeric_attributes, '$.$expiration');
+
+-- Content that is still current stays valid until it gets updated or the
+-- entity is deleted or expires, the lifetime of the entity is tracked in
+-- entity_metadata.
+UPDATE payloads SET to_block = 9223372036854775807
+WHERE to_block > (SELECT block FROM last_block);
+
+UPDATE string_attributes SET to_block = 9223372036854775807
+WHERE to_block > (SELECT block FROM last_block);
+
+UPDATE numeric_attributes SET to_block = 9223372036854775807
+WHERE to_block > (SELECT block FROM last_block);
@@ -0,0 +1,38 @@
+-- Payloads are stored once per distinct content, the versions in payloads
+-- point at them through the keccak256 hash of the content.
+CREATE TABLE payload_contents (
+    hash BLOB NOT NULL,
+    payload BLOB NOT NULL,
+    -- The number of rows in payloads that point at this content, maintained
+    -- by the triggers below
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (hash)
+);
+
+INSERT INTO payload_contents (hash, payload, ref_count)
+SELECT keccak256(payload), payload, COUNT(*)
+FROM payloads
+GROUP BY payload;
+
+ALTER TABLE payloads ADD COLUMN payload_hash BLOB NOT NULL DEFAULT x'';
+
+UPDATE payloads SET payload_hash = keccak256(payload);
+
+ALTER TABLE payloads DROP COLUMN payload;
+
+CREATE TRIGGER payloads_reference_content AFTER INSERT ON payloads
+BEGIN
+    UPDATE payload_contents SET ref_count = ref_count + 1
+    WHERE hash = NEW.payload_hash;
+END;
+
+-- Content is removed as soon as the last version that uses it is deleted,
+-- for example when pruning history
+CREATE TRIGGER payloads_release_content AFTER DELETE ON payloads
+BEGIN
+    UPDATE payload_contents SET ref_count = ref_count - 1
+    WHERE hash = OLD.payload_hash;
+
+    DELETE FROM payload_contents
+    WHERE hash = OLD.payload_hash AND ref_count <= 0;
+END;
@@ -0,0 +1,8 @@
+-- The codec that the payload is compressed with, the empty string means the
+-- payload is stored as is
+ALTER TABLE payload_contents ADD COLUMN codec TEXT NOT NULL DEFAULT '';
+
+-- The size of the payload before compression
+ALTER TABLE payload_contents ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+
+UPDATE payload_contents SET size = length(payload);
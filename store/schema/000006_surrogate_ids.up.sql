@@ -0,0 +1,138 @@
+-- Entity keys and attribute names are interned into dictionary tables, so
+-- that every row and index of the attribute and payload tables only stores a
+-- small integer instead of the 32 byte key and the name of the attribute.
+CREATE TABLE entity_keys (
+    id INTEGER NOT NULL,
+    entity_key BLOB NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE (entity_key)
+);
+
+CREATE TABLE attribute_names (
+    id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE (name)
+);
+
+INSERT INTO entity_keys (entity_key)
+SELECT entity_key FROM payloads
+UNION
+SELECT entity_key FROM entity_metadata;
+
+INSERT INTO attribute_names (name)
+SELECT key FROM string_attributes
+UNION
+SELECT key FROM numeric_attributes;
+
+-- SQLite can't change the primary key of a table, so the tables are rebuilt.
+-- The indexes and triggers of the old tables are dropped together with them.
+ALTER TABLE string_attributes RENAME TO string_attributes_old;
+ALTER TABLE numeric_attributes RENAME TO numeric_attributes_old;
+ALTER TABLE payloads RENAME TO payloads_old;
+ALTER TABLE entity_metadata RENAME TO entity_metadata_old;
+
+CREATE TABLE string_attributes (
+    entity_id INTEGER NOT NULL,
+    from_block INTEGER NOT NULL,
+    to_block INTEGER NOT NULL,
+    name_id INTEGER NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (entity_id, name_id, from_block)
+);
+
+CREATE TABLE numeric_attributes (
+    entity_id INTEGER NOT NULL,
+    from_block INTEGER NOT NULL,
+    to_block INTEGER NOT NULL,
+    name_id INTEGER NOT NULL,
+    value INTEGER NOT NULL,
+    PRIMARY KEY (entity_id, name_id, from_block)
+);
+
+CREATE TABLE payloads (
+    entity_id INTEGER NOT NULL,
+    from_block INTEGER NOT NULL,
+    to_block INTEGER NOT NULL,
+    payload_hash BLOB NOT NULL,
+    content_type TEXT NOT NULL DEFAULT '',
+    string_attributes TEXT NOT NULL DEFAULT '{}',
+    numeric_attributes TEXT NOT NULL DEFAULT '{}',
+    PRIMARY KEY (entity_id, from_block)
+);
+
+CREATE TABLE entity_metadata (
+    entity_id INTEGER NOT NULL,
+    from_block INTEGER NOT NULL,
+    to_block INTEGER NOT NULL,
+    owner TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    PRIMARY KEY (entity_id, from_block)
+);
+
+INSERT INTO string_attributes (entity_id, from_block, to_block, name_id, value)
+SELECT k.id, a.from_block, a.to_block, n.id, a.value
+FROM string_attributes_old AS a
+INNER JOIN entity_keys AS k ON k.entity_key = a.entity_key
+INNER JOIN attribute_names AS n ON n.name = a.key;
+
+INSERT INTO numeric_attributes (entity_id, from_block, to_block, name_id, value)
+SELECT k.id, a.from_block, a.to_block, n.id, a.value
+FROM numeric_attributes_old AS a
+INNER JOIN entity_keys AS k ON k.entity_key = a.entity_key
+INNER JOIN attribute_names AS n ON n.name = a.key;
+
+-- The reference counts of payload_contents stay valid, since the triggers are
+-- only created after the rows have been copied
+INSERT INTO payloads (entity_id, from_block, to_block, payload_hash, content_type, string_attributes, numeric_attributes)
+SELECT k.id, p.from_block, p.to_block, p.payload_hash, p.content_type, p.string_attributes, p.numeric_attributes
+FROM payloads_old AS p
+INNER JOIN entity_keys AS k ON k.entity_key = p.entity_key;
+
+INSERT INTO entity_metadata (entity_id, from_block, to_block, owner, expires_at)
+SELECT k.id, m.from_block, m.to_block, m.owner, m.expires_at
+FROM entity_metadata_old AS m
+INNER JOIN entity_keys AS k ON k.entity_key = m.entity_key;
+
+DROP TABLE string_attributes_old;
+DROP TABLE numeric_attributes_old;
+DROP TABLE payloads_old;
+DROP TABLE entity_metadata_old;
+
+-- Indexes for string_attributes
+CREATE INDEX string_attributes_entity_key_value_index ON string_attributes (from_block, to_block, name_id, value);
+CREATE INDEX string_attributes_kv_temporal_idx ON string_attributes (name_id, value, from_block DESC, to_block DESC);
+CREATE INDEX string_attributes_entity_key_index ON string_attributes (from_block, to_block, name_id);
+CREATE INDEX string_attributes_delete_index ON string_attributes (to_block);
+CREATE INDEX string_attributes_entity_kv_idx ON string_attributes (entity_id, name_id, from_block DESC);
+
+-- Indexes for numeric_attributes
+CREATE INDEX numeric_attributes_entity_key_value_index ON numeric_attributes (from_block, to_block, name_id, value);
+CREATE INDEX numeric_attributes_entity_key_index ON numeric_attributes (from_block, to_block, name_id);
+CREATE INDEX numeric_attributes_kv_temporal_idx ON numeric_attributes (name_id, value, from_block DESC, to_block DESC);
+CREATE INDEX numeric_attributes_delete_index ON numeric_attributes (to_block);
+CREATE INDEX numeric_attributes_entity_kv_idx ON numeric_attributes (entity_id, name_id, from_block DESC);
+
+-- Indexes for payloads
+CREATE INDEX payloads_entity_key_index ON payloads (from_block, entity_id, to_block);
+CREATE INDEX payloads_delete_index ON payloads (to_block);
+
+-- Indexes for entity_metadata
+CREATE INDEX entity_metadata_owner_idx ON entity_metadata (owner, from_block, to_block);
+CREATE INDEX entity_metadata_expires_at_idx ON entity_metadata (expires_at, from_block, to_block);
+CREATE INDEX entity_metadata_delete_index ON entity_metadata (to_block);
+
+CREATE TRIGGER payloads_reference_content AFTER INSERT ON payloads
+BEGIN
+    UPDATE payload_contents SET ref_count = ref_count + 1
+    WHERE hash = NEW.payload_hash;
+END;
+
+CREATE TRIGGER payloads_release_content AFTER DELETE ON payloads
+BEGIN
+    UPDATE payload_contents SET ref_count = ref_count - 1
+    WHERE hash = OLD.payload_hash;
+
+    DELETE FROM payload_contents
+    WHERE hash = OLD.payload_hash AND ref_count <= 0;
+END;
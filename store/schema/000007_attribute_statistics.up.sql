@@ -0,0 +1,129 @@
+-- Statistics about the attributes of the live entities, meaning the content
+-- rows that haven't been terminated yet. They are kept up to date by the
+-- triggers below, within the same transaction that changes the attributes.
+CREATE TABLE attribute_statistics (
+    name_id INTEGER NOT NULL,
+    -- Either 'string' or 'numeric'
+    value_type TEXT NOT NULL,
+    -- The number of live entities that carry the attribute
+    entities INTEGER NOT NULL DEFAULT 0,
+    -- The number of distinct values among the live entities
+    distinct_values INTEGER NOT NULL DEFAULT 0,
+    -- The range of values of numeric attributes
+    min_value INTEGER,
+    max_value INTEGER,
+    PRIMARY KEY (name_id, value_type)
+);
+
+CREATE TABLE entity_statistics (
+    id INTEGER NOT NULL DEFAULT 1 CHECK (id = 1),
+    -- The number of live entities
+    entities INTEGER NOT NULL,
+    PRIMARY KEY (id)
+);
+
+INSERT INTO attribute_statistics (name_id, value_type, entities, distinct_values)
+SELECT name_id, 'string', COUNT(*), COUNT(DISTINCT value)
+FROM string_attributes
+WHERE to_block = 9223372036854775807
+GROUP BY name_id;
+
+INSERT INTO attribute_statistics (name_id, value_type, entities, distinct_values, min_value, max_value)
+SELECT name_id, 'numeric', COUNT(*), COUNT(DISTINCT value), MIN(value), MAX(value)
+FROM numeric_attributes
+WHERE to_block = 9223372036854775807
+GROUP BY name_id;
+
+INSERT INTO entity_statistics (id, entities)
+SELECT 1, COUNT(*)
+FROM payloads
+WHERE to_block = 9223372036854775807;
+
+-- A value is new if no other live entity has it. An entity has at most one
+-- live row per attribute, since the previous version is terminated before the
+-- new one is inserted.
+CREATE TRIGGER string_attributes_statistics_insert AFTER INSERT ON string_attributes
+WHEN NEW.to_block = 9223372036854775807
+BEGIN
+    INSERT INTO attribute_statistics (name_id, value_type, entities, distinct_values)
+    VALUES (NEW.name_id, 'string', 1, 1)
+    ON CONFLICT (name_id, value_type) DO UPDATE SET
+        entities = entities + 1,
+        distinct_values = distinct_values + NOT EXISTS (
+            SELECT 1 FROM string_attributes AS a
+            WHERE a.name_id = NEW.name_id
+                AND a.value = NEW.value
+                AND a.to_block = 9223372036854775807
+                AND a.entity_id != NEW.entity_id
+        );
+END;
+
+CREATE TRIGGER string_attributes_statistics_terminate AFTER UPDATE OF to_block ON string_attributes
+WHEN OLD.to_block = 9223372036854775807 AND NEW.to_block != 9223372036854775807
+BEGIN
+    UPDATE attribute_statistics SET
+        entities = entities - 1,
+        distinct_values = distinct_values - NOT EXISTS (
+            SELECT 1 FROM string_attributes AS a
+            WHERE a.name_id = NEW.name_id
+                AND a.value = NEW.value
+                AND a.to_block = 9223372036854775807
+        )
+    WHERE name_id = NEW.name_id AND value_type = 'string';
+END;
+
+CREATE TRIGGER numeric_attributes_statistics_insert AFTER INSERT ON numeric_attributes
+WHEN NEW.to_block = 9223372036854775807
+BEGIN
+    INSERT INTO attribute_statistics (name_id, value_type, entities, distinct_values, min_value, max_value)
+    VALUES (NEW.name_id, 'numeric', 1, 1, NEW.value, NEW.value)
+    ON CONFLICT (name_id, value_type) DO UPDATE SET
+        entities = entities + 1,
+        distinct_values = distinct_values + NOT EXISTS (
+            SELECT 1 FROM numeric_attributes AS a
+            WHERE a.name_id = NEW.name_id
+                AND a.value = NEW.value
+                AND a.to_block = 9223372036854775807
+                AND a.entity_id != NEW.entity_id
+        ),
+        min_value = COALESCE(min(min_value, EXCLUDED.min_value), EXCLUDED.min_value),
+        max_value = COALESCE(max(max_value, EXCLUDED.max_value), EXCLUDED.max_value);
+END;
+
+-- The range only needs to be looked up again when the terminated row held one
+-- of its bounds
+CREATE TRIGGER numeric_attributes_statistics_terminate AFTER UPDATE OF to_block ON numeric_attributes
+WHEN OLD.to_block = 9223372036854775807 AND NEW.to_block != 9223372036854775807
+BEGIN
+    UPDATE attribute_statistics SET
+        entities = entities - 1,
+        distinct_values = distinct_values - NOT EXISTS (
+            SELECT 1 FROM numeric_attributes AS a
+            WHERE a.name_id = NEW.name_id
+                AND a.value = NEW.value
+                AND a.to_block = 9223372036854775807
+        ),
+        min_value = CASE WHEN min_value = NEW.value THEN (
+            SELECT a.value FROM numeric_attributes AS a
+            WHERE a.name_id = NEW.name_id AND a.to_block = 9223372036854775807
+            ORDER BY a.value ASC LIMIT 1
+        ) ELSE min_value END,
+        max_value = CASE WHEN max_value = NEW.value THEN (
+            SELECT a.value FROM numeric_attributes AS a
+            WHERE a.name_id = NEW.name_id AND a.to_block = 9223372036854775807
+            ORDER BY a.value DESC LIMIT 1
+        ) ELSE max_value END
+    WHERE name_id = NEW.name_id AND value_type = 'numeric';
+END;
+
+CREATE TRIGGER payloads_statistics_insert AFTER INSERT ON payloads
+WHEN NEW.to_block = 9223372036854775807
+BEGIN
+    UPDATE entity_statistics SET entities = entities + 1 WHERE id = 1;
+END;
+
+CREATE TRIGGER payloads_statistics_terminate AFTER UPDATE OF to_block ON payloads
+WHEN OLD.to_block = 9223372036854775807 AND NEW.to_block != 9223372036854775807
+BEGIN
+    UPDATE entity_statistics SET entities = entities - 1 WHERE id = 1;
+END;
@@ -0,0 +1,38 @@
+-- Content rows used to stay open after their entity expired without an
+-- explicit Expire operation. They are closed at the block the entity expired
+-- at, so that pruning removes them and the statistics no longer count them.
+UPDATE payloads SET to_block = (
+    SELECT m.expires_at FROM entity_metadata AS m
+    WHERE m.entity_id = payloads.entity_id
+    ORDER BY m.from_block DESC LIMIT 1
+)
+WHERE to_block = 9223372036854775807
+    AND (
+        SELECT m.expires_at FROM entity_metadata AS m
+        WHERE m.entity_id = payloads.entity_id
+        ORDER BY m.from_block DESC LIMIT 1
+    ) <= (SELECT block FROM last_block);
+
+UPDATE string_attributes SET to_block = (
+    SELECT m.expires_at FROM entity_metadata AS m
+    WHERE m.entity_id = string_attributes.entity_id
+    ORDER BY m.from_block DESC LIMIT 1
+)
+WHERE to_block = 9223372036854775807
+    AND (
+        SELECT m.expires_at FROM entity_metadata AS m
+        WHERE m.entity_id = string_attributes.entity_id
+        ORDER BY m.from_block DESC LIMIT 1
+    ) <= (SELECT block FROM last_block);
+
+UPDATE numeric_attributes SET to_block = (
+    SELECT m.expires_at FROM entity_metadata AS m
+    WHERE m.entity_id = numeric_attributes.entity_id
+    ORDER BY m.from_block DESC LIMIT 1
+)
+WHERE to_block = 9223372036854775807
+    AND (
+        SELECT m.expires_at FROM entity_metadata AS m
+        WHERE m.entity_id = numeric_attributes.entity_id
+        ORDER BY m.from_block DESC LIMIT 1
+    ) <= (SELECT block FROM last_block);
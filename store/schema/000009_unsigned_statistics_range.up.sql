@@ -0,0 +1,102 @@
+-- Numeric attributes are unsigned 64 bit values stored as their two's
+-- complement, so values of 2^63 and above are negative in SQLite. The range
+-- of the statistics is therefore computed in unsigned order, where all
+-- negative values come after the positive ones.
+DROP TRIGGER numeric_attributes_statistics_insert;
+DROP TRIGGER numeric_attributes_statistics_terminate;
+
+CREATE TRIGGER numeric_attributes_statistics_insert AFTER INSERT ON numeric_attributes
+WHEN NEW.to_block = 9223372036854775807
+BEGIN
+    INSERT INTO attribute_statistics (name_id, value_type, entities, distinct_values, min_value, max_value)
+    VALUES (NEW.name_id, 'numeric', 1, 1, NEW.value, NEW.value)
+    ON CONFLICT (name_id, value_type) DO UPDATE SET
+        entities = entities + 1,
+        distinct_values = distinct_values + NOT EXISTS (
+            SELECT 1 FROM numeric_attributes AS a
+            WHERE a.name_id = NEW.name_id
+                AND a.value = NEW.value
+                AND a.to_block = 9223372036854775807
+                AND a.entity_id != NEW.entity_id
+        ),
+        min_value = CASE
+            WHEN min_value IS NULL THEN EXCLUDED.min_value
+            WHEN (min_value < 0) = (EXCLUDED.min_value < 0) THEN min(min_value, EXCLUDED.min_value)
+            WHEN min_value >= 0 THEN min_value
+            ELSE EXCLUDED.min_value
+        END,
+        max_value = CASE
+            WHEN max_value IS NULL THEN EXCLUDED.max_value
+            WHEN (max_value < 0) = (EXCLUDED.max_value < 0) THEN max(max_value, EXCLUDED.max_value)
+            WHEN max_value < 0 THEN max_value
+            ELSE EXCLUDED.max_value
+        END;
+END;
+
+-- The range only needs to be looked up again when the terminated row held one
+-- of its bounds. Each bound is looked up separately among the positive and
+-- the negative values, so that the index on the values can be used.
+CREATE TRIGGER numeric_attributes_statistics_terminate AFTER UPDATE OF to_block ON numeric_attributes
+WHEN OLD.to_block = 9223372036854775807 AND NEW.to_block != 9223372036854775807
+BEGIN
+    UPDATE attribute_statistics SET
+        entities = entities - 1,
+        distinct_values = distinct_values - NOT EXISTS (
+            SELECT 1 FROM numeric_attributes AS a
+            WHERE a.name_id = NEW.name_id
+                AND a.value = NEW.value
+                AND a.to_block = 9223372036854775807
+        ),
+        min_value = CASE WHEN min_value = NEW.value THEN COALESCE(
+            (
+                SELECT a.value FROM numeric_attributes AS a
+                WHERE a.name_id = NEW.name_id AND a.value >= 0 AND a.to_block = 9223372036854775807
+                ORDER BY a.value ASC LIMIT 1
+            ),
+            (
+                SELECT a.value FROM numeric_attributes AS a
+                WHERE a.name_id = NEW.name_id AND a.value < 0 AND a.to_block = 9223372036854775807
+                ORDER BY a.value ASC LIMIT 1
+            )
+        ) ELSE min_value END,
+        max_value = CASE WHEN max_value = NEW.value THEN COALESCE(
+            (
+                SELECT a.value FROM numeric_attributes AS a
+                WHERE a.name_id = NEW.name_id AND a.value < 0 AND a.to_block = 9223372036854775807
+                ORDER BY a.value DESC LIMIT 1
+            ),
+            (
+                SELECT a.value FROM numeric_attributes AS a
+                WHERE a.name_id = NEW.name_id AND a.value >= 0 AND a.to_block = 9223372036854775807
+                ORDER BY a.value DESC LIMIT 1
+            )
+        ) ELSE max_value END
+    WHERE name_id = NEW.name_id AND value_type = 'numeric';
+END;
+
+UPDATE attribute_statistics SET
+    min_value = COALESCE(
+        (
+            SELECT a.value FROM numeric_attributes AS a
+            WHERE a.name_id = attribute_statistics.name_id AND a.value >= 0 AND a.to_block = 9223372036854775807
+            ORDER BY a.value ASC LIMIT 1
+        ),
+        (
+            SELECT a.value FROM numeric_attributes AS a
+            WHERE a.name_id = attribute_statistics.name_id AND a.value < 0 AND a.to_block = 9223372036854775807
+            ORDER BY a.value ASC LIMIT 1
+        )
+    ),
+    max_value = COALESCE(
+        (
+            SELECT a.value FROM numeric_attributes AS a
+            WHERE a.name_id = attribute_statistics.name_id AND a.value < 0 AND a.to_block = 9223372036854775807
+            ORDER BY a.value DESC LIMIT 1
+        ),
+        (
+            SELECT a.value FROM numeric_attributes AS a
+            WHERE a.name_id = attribute_statistics.name_id AND a.value >= 0 AND a.to_block = 9223372036854775807
+            ORDER BY a.value DESC LIMIT 1
+        )
+    )
+WHERE value_type = 'numeric';
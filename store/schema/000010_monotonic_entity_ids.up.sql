@@ -0,0 +1,15 @@
+-- The ids of the entity keys break ties when entities are ordered, so the id
+-- of a pruned entity must not be given to a new one. AUTOINCREMENT keeps the
+-- ids increasing, which needs the table to be rebuilt.
+CREATE TABLE entity_keys_new (
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    entity_key BLOB NOT NULL,
+    UNIQUE (entity_key)
+);
+
+INSERT INTO entity_keys_new (id, entity_key)
+SELECT id, entity_key FROM entity_keys;
+
+DROP TABLE entity_keys;
+
+ALTER TABLE entity_keys_new RENAME TO entity_keys;
@@ -0,0 +1,132 @@
+package sqlitestore
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/Arkiv-Network/sqlite-store/query"
+)
+
+// streamPageSize is the number of entities that StreamEntities reads per
+// query and keeps in memory until the caller has handled them.
+const streamPageSize = 1000
+
+// StreamEntities returns all entities that match the query, in the order of
+// the options, without the page limits of QueryEntities. All entities are
+// read at the same block, the latest block when the iteration starts unless
+// the options pin one. ResultsPerPage sets the size of the pages, up to
+// streamPageSize, and a cursor can be given to continue after it.
+//
+// The entities are read in pages, so memory use doesn't grow with the number
+// of results. A page is read completely before its entities are yielded, so
+// the time the caller takes doesn't count against the query limits and no
+// read connection is held in the meantime. The iteration stops with an error
+// once the context is done.
+func (s *SQLiteStore) StreamEntities(
+	ctx context.Context,
+	req string,
+	op *query.Options,
+) iter.Seq2[*query.EntityData, error] {
+	return func(yield func(*query.EntityData, error) bool) {
+		ast, err := query.ParseWithOptions(req, s.log, s.parseOptions)
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to parse query: %w", err))
+			return
+		}
+
+		s.streamEntities(ctx, req, ast, op, yield)
+	}
+}
+
+// StreamEntitiesAST is like StreamEntities, but takes a query that was already
+// parsed or built with query.Build.
+func (s *SQLiteStore) StreamEntitiesAST(
+	ctx context.Context,
+	ast *query.AST,
+	op *query.Options,
+) iter.Seq2[*query.EntityData, error] {
+	return func(yield func(*query.EntityData, error) bool) {
+		s.streamEntities(ctx, ast.String(), ast, op, yield)
+	}
+}
+
+func (s *SQLiteStore) streamEntities(
+	ctx context.Context,
+	req string,
+	ast *query.AST,
+	op *query.Options,
+	yield func(*query.EntityData, error) bool,
+) {
+	pageSize := uint64(streamPageSize)
+	if op != nil && op.ResultsPerPage > 0 {
+		pageSize = min(pageSize, op.ResultsPerPage)
+	}
+
+	prepared, err := s.prepareQuery(ctx, ast, op, pageSize)
+	if err != nil {
+		yield(nil, err)
+		return
+	}
+
+	options := prepared.options
+	if options.Backward {
+		yield(nil, fmt.Errorf("%w: entities can only be streamed forward", query.ErrInvalidCursor))
+		return
+	}
+
+	// The block stays the same for all pages, even if new blocks are processed
+	// in the meantime
+	err = s.EnsureBlockPresent(ctx, options.AtBlock)
+	if err != nil {
+		yield(nil, err)
+		return
+	}
+
+	evaluatedQuery := prepared.query
+	page := make([]*query.EntityData, 0, pageSize)
+	for {
+		// The page is read before it is handed out, so that the connection
+		// and the slot of the query are released while the caller handles it
+		var last *query.Cursor
+		page = page[:0]
+		err := s.QueryEntitiesInternalIterator(
+			ctx,
+			req,
+			evaluatedQuery,
+			options,
+			func(entity *query.EntityData, cursor *query.Cursor) error {
+				page = append(page, entity)
+				last = cursor
+				return nil
+			},
+		)
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to execute query: %w", err))
+			return
+		}
+
+		for _, entity := range page {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(entity, nil) {
+				return
+			}
+		}
+
+		// A page that isn't full is the last one
+		if uint64(len(page)) < pageSize {
+			return
+		}
+
+		// The next page starts after the last entity of this one
+		options.Cursor = last.ColumnValues
+		evaluatedQuery, err = prepared.evaluator.EvaluateAST(prepared.ast, options)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+	}
+}